@@ -0,0 +1,227 @@
+package ctl_monitor_lib
+
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "log"
+import "time"
+
+// how often to check that the logs that issued SCTs have included what they promised.  0 turns the auditor off, though the "AuditSCTs" command still works.  set from the command line
+var SCT_AUDIT_INTERVAL time.Duration = 0
+
+// each promise of a log to include a leaf: the log, the hash of the leaf, the SCT's timestamp, and when the log's maximum merge delay runs out ('due', in milliseconds like 'timestamp').  once the log has proven inclusion, the proof's leaf index and tree size are kept
+const CREATE_SCT_AUDITS_TABLE string = "CREATE TABLE IF NOT EXISTS sct_audits (sct_ctl TEXT, entry_leaf_hash TEXT, log_id TEXT, timestamp INTEGER, due INTEGER, status TEXT, leaf_index INTEGER, tree_size INTEGER, checked INTEGER, PRIMARY KEY (sct_ctl, entry_leaf_hash) )"
+
+// the states of an audit.  an overdue SCT can still be included later; it's included late then, but it's included
+const AUDIT_PENDING string = "pending"
+const AUDIT_INCLUDED string = "included"
+const AUDIT_OVERDUE string = "overdue"
+
+// an SCT that's been audited, or is waiting to be
+type sct_audit_row struct {
+    sct_ctl string
+    entry_leaf_hash string
+    timestamp uint64
+    due uint64
+    status string
+}
+
+// queue an SCT to be audited once the log's maximum merge delay has passed, unless it already is.  'db' is either the database or a transaction
+func queueSCTAudit(db execer, sct_ctl string, log_id string, entry_leaf_hash string, timestamp uint64, mmd time.Duration) error {
+
+    due := timestamp + uint64(mmd / time.Millisecond)
+    _, err := db.Exec("INSERT OR IGNORE INTO sct_audits (sct_ctl, entry_leaf_hash, log_id, timestamp, due, status) VALUES (?, ?, ?, ?, ?, ?)", sct_ctl, entry_leaf_hash, log_id, timestamp, due, AUDIT_PENDING)
+
+    return err
+
+}
+
+// queue an SCT that didn't come from a certificate we found, like one the log returned when a certificate was submitted to it, to be audited.  'ctl_host' has to be one of the logs being monitored, so it can be audited, and its maximum merge delay is known
+func (c *Controller) submitSCT(ctl_host string, entry_leaf_hash []byte, timestamp uint64) error {
+
+    c.lock.Lock()
+    monitor := c.monitors[ctl_host]
+    c.lock.Unlock()
+    if monitor == nil {
+        return errors.New("Not monitoring " + ctl_host)
+    }
+    if len(entry_leaf_hash) != 32 {
+        return errors.New("Invalid leaf hash: must be 32 bytes")
+    }
+
+    log_id := ""
+    if monitor.log_key != nil {
+        log_id = base64.StdEncoding.EncodeToString(monitor.log_key.log_id[:])
+    }
+
+    return queueSCTAudit(c.shared.database, ctl_host, log_id, base64.StdEncoding.EncodeToString(entry_leaf_hash), timestamp, monitor.mmd)
+
+}
+
+// audit the SCTs in the background, every SCT_AUDIT_INTERVAL, until the controller is shut down
+func (c *Controller) runSCTAuditor() {
+
+    ticker := time.NewTicker(SCT_AUDIT_INTERVAL)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- c.done:
+            return
+        case <- ticker.C:
+            c.auditSCTs(time.Now())
+        }
+    }
+
+}
+
+// ask each log for an inclusion proof of every leaf it promised to include that should be in it by 'now', against the log's current verified tree head.  a leaf that isn't there, or whose proof doesn't verify, is overdue: it's written to the log as an ALERT the first time, and counted in the 'overdue_sct_metric' gauge until the log includes it.  SCTs from logs that aren't being monitored can't be audited, since there's no tree head to check them against.  returns the number of SCTs found included and newly overdue
+func (c *Controller) auditSCTs(now time.Time) (int, int) {
+
+// the auditor and the "AuditSCTs" command shouldn't both raise the same alert
+    c.audit_lock.Lock()
+    defer c.audit_lock.Unlock()
+
+    rows, err := c.shared.database.Query("SELECT sct_ctl, entry_leaf_hash, timestamp, due, status FROM sct_audits WHERE status != ? AND due <= ?", AUDIT_INCLUDED, now.UnixMilli())
+    if err != nil {
+        log.Println("Error accessing database.")
+        log.Println(err)
+        return 0, 0
+    }
+    var audits []sct_audit_row
+    var row sct_audit_row
+    for rows.Next() {
+        err = rows.Scan(&row.sct_ctl, &row.entry_leaf_hash, &row.timestamp, &row.due, &row.status)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            log.Println(err)
+            continue
+        }
+        audits = append(audits, row)
+    }
+    rows.Close()
+
+    if c.shared.VERBOSE { fmt.Printf("Auditing %d SCTs\n", len(audits)) }
+
+    included := 0
+    overdue := 0
+    for _, audit := range audits {
+        c.lock.Lock()
+        monitor := c.monitors[audit.sct_ctl]
+        c.lock.Unlock()
+        if monitor == nil {
+            continue
+        }
+
+// the log only had to include the leaf in tree heads signed after the maximum merge delay
+        sth := monitor.getTreeHead()
+        if sth.Timestamp < audit.due {
+            continue
+        }
+        hash, err := base64.StdEncoding.DecodeString(audit.entry_leaf_hash)
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+        root, err := base64.StdEncoding.DecodeString(sth.Sha256_root_hash)
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+
+// a log that doesn't have the leaf says so with a 4xx status.  anything else (a network error, or a 5xx that outlasted the retries) isn't the log saying so; try again next time
+        leaf_index, audit_path, err := getProofByHash(audit.sct_ctl, hash, sth.Tree_size, monitor.done)
+        if err != nil && !clientError(err) {
+            log.Println("Error getting an inclusion proof from", audit.sct_ctl)
+            log.Println(err)
+            monitor.countRequestFailure(err)
+            continue
+        }
+        if err == nil {
+            err = verifyInclusionProof(leaf_index, sth.Tree_size, hash, root, audit_path)
+            if err != nil {
+                log.Printf("ALERT: %s could not prove inclusion of leaf %s in the tree of size %d: %v\n", audit.sct_ctl, audit.entry_leaf_hash, sth.Tree_size, err)
+                monitor.inclusion_failure_metrics.WithLabelValues(audit.sct_ctl).Inc()
+            }
+        }
+
+        if err == nil {
+            _, err = c.shared.database.Exec("UPDATE sct_audits SET status = ?, leaf_index = ?, tree_size = ?, checked = ? WHERE sct_ctl = ? AND entry_leaf_hash = ?", AUDIT_INCLUDED, leaf_index, sth.Tree_size, now.UnixMilli(), audit.sct_ctl, audit.entry_leaf_hash)
+            if audit.status == AUDIT_OVERDUE {
+                log.Printf("%s included leaf %s late, %v after its maximum merge delay\n", audit.sct_ctl, audit.entry_leaf_hash, time.Duration(sth.Timestamp - audit.due) * time.Millisecond)
+            }
+            included += 1
+        } else {
+            _, err = c.shared.database.Exec("UPDATE sct_audits SET status = ?, checked = ? WHERE sct_ctl = ? AND entry_leaf_hash = ?", AUDIT_OVERDUE, now.UnixMilli(), audit.sct_ctl, audit.entry_leaf_hash)
+            if audit.status == AUDIT_PENDING {
+                log.Printf("ALERT: %s has not included leaf %s, which it promised at %d to include within its maximum merge delay\n", audit.sct_ctl, audit.entry_leaf_hash, audit.timestamp)
+                overdue += 1
+            }
+        }
+        if err != nil {
+            log.Println(err)
+        }
+    }
+
+    c.updateOverdueSCTMetrics()
+    if c.shared.VERBOSE { fmt.Printf("Audited SCTs: %d included, %d newly overdue\n", included, overdue) }
+
+    return included, overdue
+
+}
+
+// set the 'overdue_sct_metric' gauge of each log to the number of its SCTs that are overdue
+func (c *Controller) updateOverdueSCTMetrics() {
+
+    counts := make(map[string]int)
+    for _, monitor := range c.getMonitors() {
+        counts[monitor.ctl_host] = 0
+    }
+
+    rows, err := c.shared.database.Query("SELECT sct_ctl, COUNT(*) FROM sct_audits WHERE status = ? GROUP BY sct_ctl", AUDIT_OVERDUE)
+    if err != nil {
+        log.Println("Error accessing database.")
+        log.Println(err)
+        return
+    }
+    defer rows.Close()
+    var ctl_host string
+    var count int
+    for rows.Next() {
+        err = rows.Scan(&ctl_host, &count)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            continue
+        }
+        counts[ctl_host] = count
+    }
+
+    for ctl_host, count := range counts {
+        c.shared.overdue_sct_metrics.WithLabelValues(ctl_host).Set(float64(count))
+    }
+
+}
+
+// the SCTs that are overdue, oldest first
+func (s *sharedState) listOverdueSCTs() ([]sct_audit_row, error) {
+
+    rows, err := s.database.Query("SELECT sct_ctl, entry_leaf_hash, timestamp, due, status FROM sct_audits WHERE status = ? ORDER BY due", AUDIT_OVERDUE)
+    if err != nil {
+        log.Println("Error accessing database.")
+        return nil, err
+    }
+    defer rows.Close()
+
+    var results []sct_audit_row
+    var row sct_audit_row
+    for rows.Next() {
+        err = rows.Scan(&row.sct_ctl, &row.entry_leaf_hash, &row.timestamp, &row.due, &row.status)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            return results, err
+        }
+        results = append(results, row)
+    }
+
+    return results, rows.Err()
+
+}
@@ -0,0 +1,37 @@
+package ctl_monitor_lib
+
+import "database/sql"
+
+// load the checkpoint for this log: the last verified signed tree head, and the index of the next entry to search.  the third return value is false if there's no checkpoint
+func (m *Monitor) loadCheckpoint() (Signed_tree_head, uint64, bool, error) {
+
+    var sth Signed_tree_head
+    var next_index uint64
+
+    row := m.database.QueryRow("SELECT next_index, tree_size, timestamp, root_hash, signature FROM checkpoints WHERE ctl = ?", m.ctl_host)
+    err := row.Scan(&next_index, &sth.Tree_size, &sth.Timestamp, &sth.Sha256_root_hash, &sth.Tree_head_signature)
+    if err == sql.ErrNoRows {
+        return sth, 0, false, nil
+    }
+    if err != nil {
+        return sth, 0, false, err
+    }
+
+    return sth, next_index, true, nil
+
+}
+
+// anything a statement can be run on: the database itself, or a transaction
+type execer interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// store the current tree head and 'next_index', the index of the next entry to search, so a restart can pick up where this run stopped.  'db' is either the database or a transaction, so the checkpoint can be saved along with the rows it covers
+func (m *Monitor) saveCheckpoint(db execer, next_index uint64) error {
+
+    sth := m.getTreeHead()
+    _, err := db.Exec("INSERT OR REPLACE INTO checkpoints (ctl, next_index, tree_size, timestamp, root_hash, signature) VALUES (?, ?, ?, ?, ?, ?)", m.ctl_host, next_index, sth.Tree_size, sth.Timestamp, sth.Sha256_root_hash, sth.Tree_head_signature)
+
+    return err
+
+}
@@ -6,41 +6,75 @@ import "github.com/gorilla/mux"
 import "strings"
 import "log"
 import "time"
+import "sort"
+import "sync"
+import "errors"
+import "encoding/base64"
+import "strconv"
+import "encoding/json"
 
 type Controller struct {
-    monitor Monitor
+    shared *sharedState
+    monitors map[string]*Monitor
+    lock sync.Mutex
+// whether monitors should be actively checking for new entries
+    auto bool
+// the log list file (if any), the log states to monitor from it, and the logs that came from it
+    log_list string
+    log_states []string
+    log_list_hosts map[string]bool
+// the logs given on the command line that couldn't be added at start-up, which are being retried
+    retrying map[string]bool
+    audit_lock sync.Mutex
+// the other instances to exchange signed tree heads with
+    gossip_peers []string
+    gossip_lock sync.Mutex
+// closed by shutdown, and the goroutines it waits for
+    done chan struct{}
+    running sync.WaitGroup
 }
 
 // print status
 func (c *Controller) Status(w http.ResponseWriter, r *http.Request) {
 
-    fmt.Fprintf(w, "Monitoring the certificate transparency log %s for certificates for the following hostnames:\n %v\nThe certificate transparency log was last updated at %s and contains %d entries.\n", c.monitor.CTL_host(), c.monitor.getHostnames(), time.Unix(0, int64(c.monitor.getTimestamp())*1e6).String(), c.monitor.getTreeSize())
+    fmt.Fprintf(w, "Monitoring for certificates for the following hostnames:\n %v\n", c.shared.getHostnames())
+
+    for _, monitor := range c.getMonitors() {
+        fmt.Fprintf(w, "The certificate transparency log %s was last updated at %s and contains %d entries, of which %d have been searched.\n", monitor.CTL_host(), time.Unix(0, int64(monitor.getTimestamp())*1e6).String(), monitor.getTreeSize(), monitor.getNextIndex())
+    }
 
 }
 
-// add hostnames (comma-separated list)
+// add hostnames (comma-separated list), or typed watch rules (one per 'hostname' parameter)
 func (c *Controller) AddHostname(w http.ResponseWriter, r *http.Request) {
 
-    vars := mux.Vars(r)
-    new_hostnames := vars["hostname"]
-
-    new_hostnames_list := strings.Split(new_hostnames, ",")
+    var new_hostnames_list []string
+    for _, value := range r.URL.Query()["hostname"] {
+        new_hostnames_list = append(new_hostnames_list, splitRules(value)...)
+    }
 
-    c.monitor.addHostnames(new_hostnames_list)
+    err := c.shared.addHostnames(new_hostnames_list)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
 
-    fmt.Fprintf(w, "Added %v to hostname list. Now monitoring for certificates for the following list:\n %v\n", new_hostnames, c.monitor.getHostnames())
+    fmt.Fprintf(w, "Added %v to hostname list. Now monitoring for certificates for the following list:\n %v\n", new_hostnames_list, c.shared.getHostnames())
 
 }
 
-// remove hostname
+// remove hostname, given either the rule or its id
 func (c *Controller) RemoveHostname(w http.ResponseWriter, r *http.Request) {
 
     vars := mux.Vars(r)
     hostname := vars["hostname"]
 
-    c.monitor.removeHostname(hostname)
+    if c.shared.removeHostname(hostname) == nil {
+        fmt.Fprintf(w, "%s is not on the hostname list.\n", hostname)
+        return
+    }
 
-    fmt.Fprintf(w, "Removed %s from hostname list. Now monitoring for certificates for the following list:\n %v\n", hostname, c.monitor.getHostnames())
+    fmt.Fprintf(w, "Removed %s from hostname list. Now monitoring for certificates for the following list:\n %v\n", hostname, c.shared.getHostnames())
 
 }
 
@@ -50,20 +84,25 @@ func (c *Controller) DeleteHostname(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     hostname := vars["hostname"]
 
-    c.monitor.removeHostname(hostname)
+// the rows and metrics are labeled with the rule as it was given, even if it was removed by id
+    if removed := c.shared.removeHostname(hostname); removed != nil {
+        hostname = removed.text
+    }
 
-    fmt.Fprintf(w, "Removed %s from hostname list. Now monitoring for certificates for the following list:\n %v\n", hostname, c.monitor.getHostnames())
+    fmt.Fprintf(w, "Removed %s from hostname list. Now monitoring for certificates for the following list:\n %v\n", hostname, c.shared.getHostnames())
 
-    c.monitor.deleteDBEntries(hostname)
+    c.shared.deleteDBEntries(hostname)
 
     fmt.Fprintf(w, "Deleted certificates for %s from the database and removed the corresponding metrics", hostname)
 
 }
 
-// list hostnames
+// list hostnames, with the id and kind of each rule
 func (c *Controller) ListHostnames(w http.ResponseWriter, r *http.Request) {
 
-    fmt.Fprintf(w, "%v\n", c.monitor.getHostnames())
+    for _, rule := range c.shared.getRules() {
+        fmt.Fprintf(w, "%d\t%s\t%s\n", rule.id, rule.kind, rule.text)
+    }
 
 }
 
@@ -73,7 +112,24 @@ func (c *Controller) ListCertificates (w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     hostname := vars["hostname"]
 
-    results := c.monitor.listCerts(hostname)
+// any other parameters are metadata fields to search by, like serial=SERIAL
+    filters := make(map[string]string)
+    for field, values := range r.URL.Query() {
+        if field == "hostname" || len(values) == 0 {
+            continue
+        }
+        if !isMetadataColumn(field) {
+            http.Error(w, "Unknown certificate field " + field, http.StatusBadRequest)
+            return
+        }
+        filters[field] = values[0]
+    }
+
+    results, err := c.shared.listCerts(hostname, filters)
+    if err != nil {
+        http.Error(w, "Error listing certificates: " + err.Error(), http.StatusInternalServerError)
+        return
+    }
 
     fmt.Fprintf(w, "Certificates for %s:\n", hostname)
 
@@ -83,29 +139,656 @@ func (c *Controller) ListCertificates (w http.ResponseWriter, r *http.Request) {
 
 }
 
-// initialize new controller
-func NewController(ctl_host string, hostnames []string, verbose bool, no_auto bool, build bool, no_delete bool, non_strict bool) (*Controller, error) {
+// list the registrable domains the specified hostname (a registrable or keyword rule, usually) has matched, in the order they were first seen
+func (c *Controller) ListRegistrableDomains(w http.ResponseWriter, r *http.Request) {
+
+    vars := mux.Vars(r)
+    hostname := vars["hostname"]
+
+    results, err := c.shared.listRegistrableDomains(hostname)
+    if err != nil {
+        http.Error(w, "Error listing registrable domains: " + err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    fmt.Fprintf(w, "Registrable domains for %s:\n", hostname)
+
+    for _, entry := range results {
+        fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", entry.registrable_domain, entry.timestamp, entry.name, entry.ctl)
+    }
+
+}
+
+// list the certificates in the chains of the certificates for the specified hostname, with how far up the chains each is, and how many certificates it's in the chain of
+func (c *Controller) ListIssuers(w http.ResponseWriter, r *http.Request) {
+
+    vars := mux.Vars(r)
+    hostname := vars["hostname"]
+
+    results, err := c.shared.listIssuers(hostname)
+    if err != nil {
+        http.Error(w, "Error listing issuers: " + err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    fmt.Fprintf(w, "Issuers of certificates for %s:\n", hostname)
+
+    for _, entry := range results {
+        fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", entry.fingerprint, entry.position, entry.certificates, entry.subject)
+    }
+
+}
+
+// list the precertificates for the specified hostname that no certificate has been issued from, then the ones that have, with how long after the precertificate the certificate was logged
+func (c *Controller) ListPrecertificates(w http.ResponseWriter, r *http.Request) {
+
+    vars := mux.Vars(r)
+    hostname := vars["hostname"]
+
+    results, err := c.shared.listIssuances(hostname)
+    if err != nil {
+        http.Error(w, "Error listing precertificates: " + err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    fmt.Fprintf(w, "Precertificates for %s:\n", hostname)
+
+    for _, entry := range results {
+        if entry.cert_timestamp < 0 {
+            fmt.Fprintf(w, "%d\t%s\t%s\tnot issued\n", entry.precert_timestamp, entry.precert_ctl, entry.common_name)
+            continue
+        }
+        delay := time.Duration(entry.cert_timestamp - int64(entry.precert_timestamp)) * time.Millisecond
+        fmt.Fprintf(w, "%d\t%s\t%s\tissued after %v, in %s\n", entry.precert_timestamp, entry.precert_ctl, entry.common_name, delay, entry.cert_ctl)
+    }
+
+}
+
+// list the SCTs embedded in the certificates for the specified hostname: which logs promised to include them, and whether the promise was signed with the log's key
+func (c *Controller) ListSCTs(w http.ResponseWriter, r *http.Request) {
+
+    vars := mux.Vars(r)
+    hostname := vars["hostname"]
+
+    results, err := c.shared.listSCTs(hostname)
+    if err != nil {
+        http.Error(w, "Error listing SCTs: " + err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    fmt.Fprintf(w, "SCTs in certificates for %s:\n", hostname)
+
+    for _, entry := range results {
+        issued_by := entry.sct_ctl
+        if issued_by == "" {
+            issued_by = entry.log_id
+        }
+        fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", entry.timestamp, issued_by, entry.status, entry.common_name)
+    }
+
+}
+
+// queue an SCT to be audited: the log CTL promised at TIMESTAMP to include the leaf whose hash (base64) is LEAF_HASH
+func (c *Controller) SubmitSCT(w http.ResponseWriter, r *http.Request) {
+
+    ctl_host := r.URL.Query().Get("ctl")
+    if !strings.HasSuffix(ctl_host, "/") {
+        ctl_host = ctl_host + "/"
+    }
+    leaf_hash, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("leaf_hash"))
+    if err != nil {
+        http.Error(w, "Invalid leaf hash: " + err.Error(), http.StatusBadRequest)
+        return
+    }
+    timestamp, err := strconv.ParseUint(r.URL.Query().Get("timestamp"), 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid timestamp: " + err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    err = c.submitSCT(ctl_host, leaf_hash, timestamp)
+    if err != nil {
+        http.Error(w, "Error submitting SCT: " + err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    fmt.Fprintf(w, "Will audit the SCT from %s.\n", ctl_host)
+
+}
+
+// audit every SCT whose log's maximum merge delay has passed now, and list the ones that are overdue
+func (c *Controller) AuditSCTs(w http.ResponseWriter, r *http.Request) {
+
+    included, overdue := c.auditSCTs(time.Now())
+    fmt.Fprintf(w, "%d SCTs were included, and %d are newly overdue.\n", included, overdue)
+
+    results, err := c.shared.listOverdueSCTs()
+    if err != nil {
+        http.Error(w, "Error listing overdue SCTs: " + err.Error(), http.StatusInternalServerError)
+        return
+    }
+    fmt.Fprintf(w, "Overdue SCTs:\n")
+    for _, entry := range results {
+        fmt.Fprintf(w, "%d\t%s\t%s\tdue at %d\n", entry.timestamp, entry.sct_ctl, entry.entry_leaf_hash, entry.due)
+    }
+
+}
+
+// list the signed tree heads fetched from the log CTL, newest first, with what checking each found.  with 'since' or 'until' (milliseconds), only the ones fetched in between
+func (c *Controller) ListSTHHistory(w http.ResponseWriter, r *http.Request) {
+
+    vars := mux.Vars(r)
+    ctl_host := vars["ctl"]
+    if !strings.HasSuffix(ctl_host, "/") {
+        ctl_host = ctl_host + "/"
+    }
+
+    var limits [2]uint64
+    for i, name := range []string{"since", "until"} {
+        if r.URL.Query().Get(name) == "" {
+            continue
+        }
+        var err error
+        limits[i], err = strconv.ParseUint(r.URL.Query().Get(name), 10, 64)
+        if err != nil {
+            http.Error(w, "Invalid " + name + ": " + err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    results, err := c.shared.listSTHHistory(ctl_host, limits[0], limits[1])
+    if err != nil {
+        http.Error(w, "Error listing signed tree heads: " + err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    fmt.Fprintf(w, "Signed tree heads fetched from %s:\n", ctl_host)
+    for _, row := range results {
+        fmt.Fprintf(w, "fetched %d\tsize %d\ttimestamp %d\troot %s\t%s\t%s\t%s\n", row.fetched, row.sth.Tree_size, row.sth.Timestamp, row.sth.Sha256_root_hash, row.verification, row.consistency, row.err)
+    }
+
+}
+
+// publish the tree heads this instance has adopted, as JSON, for its peers.  with 'since' (milliseconds), only the ones fetched after it
+func (c *Controller) GetSTHs(w http.ResponseWriter, r *http.Request) {
+
+    var since uint64
+    if r.URL.Query().Get("since") != "" {
+        var err error
+        since, err = strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+        if err != nil {
+            http.Error(w, "Invalid since: " + err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    results, err := c.shared.listVerifiedSTHs(since)
+    if err != nil {
+        http.Error(w, "Error listing signed tree heads: " + err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(results)
+
+}
+
+// ask the peers for their tree heads now, and list the ones that are inconsistent with this instance's
+func (c *Controller) Gossip(w http.ResponseWriter, r *http.Request) {
+
+    if len(c.gossip_peers) == 0 {
+        fmt.Fprintf(w, "No gossip peers were given on the command line.\n")
+        return
+    }
+
+    checked, inconsistent := c.gossip()
+    fmt.Fprintf(w, "Checked %d signed tree heads from %s; %d were inconsistent.\n", checked, strings.Join(c.gossip_peers, ", "), inconsistent)
+
+    results, err := c.shared.listPeerSTHs(GOSSIP_INCONSISTENT)
+    if err != nil {
+        http.Error(w, "Error listing signed tree heads: " + err.Error(), http.StatusInternalServerError)
+        return
+    }
+    fmt.Fprintf(w, "Inconsistent signed tree heads:\n")
+    for _, row := range results {
+        fmt.Fprintf(w, "%s\t%s\tsize %d\troot %s\ttimestamp %d\t%s\n", row.peer, row.sth.Ctl, row.sth.Tree_size, row.sth.Sha256_root_hash, row.sth.Timestamp, row.reason)
+    }
+
+}
+
+// read the public suffix list file again
+func (c *Controller) ReloadPublicSuffixList(w http.ResponseWriter, r *http.Request) {
+
+    if PSL_FILE == "" {
+        fmt.Fprintf(w, "No public suffix list was given on the command line; using the built-in one.\n")
+        return
+    }
+
+    err := reloadPublicSuffixList()
+    if err != nil {
+        fmt.Fprintf(w, "Could not reload %s: %v\n", PSL_FILE, err)
+        return
+    }
+
+    fmt.Fprintf(w, "Reloaded %s.\n", PSL_FILE)
+
+}
+
+// initialize new controller, with a monitor for each of 'ctl_hosts'.  the i-th entry of 'log_keys' (if there is one) is the public key of the i-th log.  if 'log_list' isn't empty, a monitor is also started for each log in the list in one of 'log_states'
+func NewController(ctl_hosts []string, log_keys []string, log_list string, log_states []string, database_name string, hostnames []string, verbose bool, no_auto bool, build bool, no_delete bool, non_strict bool) (*Controller, error) {
 
     var c Controller
-// initialize new monitor
-    monitor, err := NewMonitor(ctl_host, hostnames, verbose, no_delete, non_strict)
+    c.monitors = make(map[string]*Monitor)
+    c.auto = !no_auto
+    c.log_list = log_list
+    c.log_states = log_states
+    c.log_list_hosts = make(map[string]bool)
+    c.retrying = make(map[string]bool)
+    c.done = make(chan struct{})
+
+// initialize the database and metrics shared by all the monitors
+    shared, err := newSharedState(database_name, hostnames, verbose, no_delete, non_strict)
     if err != nil {
         log.Println("Error initializing controller.")
         return &c, err
     }
-    c.monitor = *monitor
+    c.shared = shared
+
+// initialize a new monitor for each log.  this starts actively monitoring, unless --no-auto is set
+    for i, ctl_host := range ctl_hosts {
+        log_key := ""
+        if i < len(log_keys) {
+            log_key = log_keys[i]
+        }
+// a log that's down at start-up shouldn't keep the others from starting
+        _, err := c.addLog(ctl_host, log_key, DEFAULT_MMD, 0)
+        if err != nil {
+            log.Printf("Error adding %s; retrying in the background\n", ctl_host)
+            log.Println(err)
+            if !strings.HasSuffix(ctl_host, "/") {
+                ctl_host = ctl_host + "/"
+            }
+            c.retrying[ctl_host] = true
+            c.spawn(func() { c.retryAddLog(ctl_host, log_key) })
+        }
+    }
 
-// start actively monitoring, unless --no-auto is set
-    if !no_auto {
-        go c.monitor.Activate(c.monitor.Signal)
+    if c.log_list != "" {
+        _, _, _, err = c.reloadLogList()
+        if err != nil {
+            log.Println("Error initializing controller.")
+            return &c, err
+        }
     }
 
 // if --build is set, build a database
     if build {
-        go c.monitor.buildDB()
+        for _, monitor := range c.getMonitors() {
+            c.spawn(func() { monitor.buildDB() })
+        }
     }
 
-    return &c, err
+    if SCT_AUDIT_INTERVAL > 0 {
+        c.spawn(c.runSCTAuditor)
+    }
+
+    for _, peer := range GOSSIP_PEERS {
+        if !strings.HasSuffix(peer, "/") {
+            peer = peer + "/"
+        }
+        c.gossip_peers = append(c.gossip_peers, peer)
+    }
+    if len(c.gossip_peers) > 0 && GOSSIP_INTERVAL > 0 {
+        c.spawn(c.runGossip)
+    }
+
+    return &c, nil
+
+}
+
+// start a new monitor for 'ctl_host', unless there's one already
+func (c *Controller) addLog(ctl_host string, log_key string, mmd time.Duration, fetch_concurrency int) (*Monitor, error) {
+
+    if !strings.HasSuffix(ctl_host, "/") {
+        ctl_host = ctl_host + "/"
+    }
+
+    c.lock.Lock()
+    _, ok := c.monitors[ctl_host]
+    c.lock.Unlock()
+    if ok {
+        return nil, errors.New("Already monitoring " + ctl_host)
+    }
+
+// getting the first tree head can take a while if the log is slow, so don't hold up the other logs while it does
+    monitor, err := NewMonitor(ctl_host, log_key, mmd, fetch_concurrency, c.shared)
+    if err != nil {
+        return nil, err
+    }
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if _, ok := c.monitors[ctl_host]; ok {
+        return nil, errors.New("Already monitoring " + ctl_host)
+    }
+    c.insertMonitor(monitor)
+
+    return monitor, nil
+
+}
+
+// try every SLEEP to add a log that couldn't be added at start-up, until it's added or removed
+func (c *Controller) retryAddLog(ctl_host string, log_key string) {
+
+    for {
+        select {
+        case <- c.done:
+            return
+        case <- time.After(SLEEP):
+        }
+        c.lock.Lock()
+        retrying := c.retrying[ctl_host]
+        c.lock.Unlock()
+        if !retrying {
+            return
+        }
+
+        _, err := c.addLog(ctl_host, log_key, DEFAULT_MMD, 0)
+        if err == nil {
+            c.lock.Lock()
+            removed := !c.retrying[ctl_host]
+            delete(c.retrying, ctl_host)
+            c.lock.Unlock()
+// it was removed while it was being added
+            if removed {
+                c.removeLog(ctl_host)
+                return
+            }
+            log.Printf("Added %s after retrying\n", ctl_host)
+            return
+        }
+        log.Printf("Error adding %s; retrying in %v\n", ctl_host, SLEEP)
+        log.Println(err)
+    }
+
+}
+
+// restart monitoring a log with a new key or MMD.  the new monitor is set up before the old one is stopped, so if that fails the log is still monitored as it was
+func (c *Controller) replaceLog(ctl_host string, log_key string, mmd time.Duration, fetch_concurrency int) (*Monitor, error) {
+
+    monitor, err := NewMonitor(ctl_host, log_key, mmd, fetch_concurrency, c.shared)
+    if err != nil {
+        return nil, err
+    }
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    old_monitor, ok := c.monitors[ctl_host]
+    if !ok {
+        return nil, errors.New("Not monitoring " + ctl_host)
+    }
+    c.stopMonitor(old_monitor)
+    close(old_monitor.done)
+    if old_monitor.log_key != nil && (monitor.log_key == nil || monitor.log_key.log_id != old_monitor.log_key.log_id) {
+        c.shared.removeKnownLog(old_monitor.log_key.log_id)
+    }
+    c.insertMonitor(monitor)
+
+    return monitor, nil
+
+}
+
+// add a new monitor to the list and start it.  the caller holds c.lock
+func (c *Controller) insertMonitor(monitor *Monitor) {
+
+    c.monitors[monitor.ctl_host] = monitor
+
+// a monitor resuming from a checkpoint has to backfill the entries logged while we were down.  the monitor's goroutine does that on its first check; without it, do it now
+    if c.auto {
+        c.startMonitor(monitor)
+    } else if monitor.resumed {
+        c.spawn(func() { monitor.Check() })
+    }
+
+}
+
+// stop and forget the monitor for 'ctl_host'.  certificates already found in the log stay in the database
+func (c *Controller) removeLog(ctl_host string) error {
+
+    if !strings.HasSuffix(ctl_host, "/") {
+        ctl_host = ctl_host + "/"
+    }
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    monitor, ok := c.monitors[ctl_host]
+    if !ok && c.retrying[ctl_host] {
+        delete(c.retrying, ctl_host)
+        return nil
+    }
+    if !ok {
+        return errors.New("Not monitoring " + ctl_host)
+    }
+    c.stopMonitor(monitor)
+    close(monitor.done)
+    if monitor.log_key != nil {
+        c.shared.removeKnownLog(monitor.log_key.log_id)
+    }
+    delete(c.monitors, ctl_host)
+    delete(c.log_list_hosts, ctl_host)
+
+    return nil
+
+}
+
+// run 'f' in a goroutine that shutdown waits for
+func (c *Controller) spawn(f func()) {
+
+    c.running.Add(1)
+    go func() {
+        defer c.running.Done()
+        f()
+    }()
+
+}
+
+// stop every monitor and background task, and wait for them to finish.  a request being retried gives up, rather than waiting out its backoff
+func (c *Controller) shutdown() {
+
+    close(c.done)
+    c.lock.Lock()
+    for ctl_host := range c.retrying {
+        delete(c.retrying, ctl_host)
+    }
+    c.lock.Unlock()
+    for _, monitor := range c.getMonitors() {
+        c.removeLog(monitor.ctl_host)
+    }
+    c.running.Wait()
+
+}
+
+// read the log list again, start monitors for logs that are new to it, and stop monitors for logs that came from it but are no longer in it (or are no longer in one of the chosen states).  logs added by hand are left alone.  returns the logs added and removed
+func (c *Controller) reloadLogList() ([]string, []string, []string, error) {
+
+    logs, err := loadLogList(c.log_list, c.log_states, time.Now())
+    if err != nil {
+        return nil, nil, nil, err
+    }
+
+    var added []string
+    var removed []string
+    var restarted []string
+    wanted := make(map[string]bool)
+
+    for _, entry := range logs {
+        ctl_host := entry.Url
+        if !strings.HasSuffix(ctl_host, "/") {
+            ctl_host = ctl_host + "/"
+        }
+        wanted[ctl_host] = true
+
+        c.lock.Lock()
+        monitor, ok := c.monitors[ctl_host]
+        c.lock.Unlock()
+// a log whose key was rotated, or whose MMD changed, is restarted with the new ones
+        if ok {
+            if !entry.changed(monitor) {
+                continue
+            }
+            _, err := c.replaceLog(ctl_host, entry.Key, entry.mmd(), entry.Fetch_concurrency)
+            if err != nil {
+                log.Println("Error restarting", ctl_host, "from the log list")
+                log.Println(err)
+                continue
+            }
+            restarted = append(restarted, ctl_host)
+            continue
+        }
+
+// a log that's down shouldn't keep the others from starting
+        _, err := c.addLog(ctl_host, entry.Key, entry.mmd(), entry.Fetch_concurrency)
+        if err != nil {
+            log.Println("Error adding", ctl_host, "from the log list")
+            log.Println(err)
+            continue
+        }
+        c.lock.Lock()
+        c.log_list_hosts[ctl_host] = true
+        c.lock.Unlock()
+        added = append(added, ctl_host)
+    }
+
+    c.lock.Lock()
+    var stale []string
+    for ctl_host := range c.log_list_hosts {
+        if !wanted[ctl_host] {
+            stale = append(stale, ctl_host)
+        }
+    }
+    c.lock.Unlock()
+
+    for _, ctl_host := range stale {
+        err := c.removeLog(ctl_host)
+        if err == nil {
+            removed = append(removed, ctl_host)
+        }
+    }
+
+    if c.shared.VERBOSE { fmt.Printf("Reloaded log list %s; added %v, removed %v, restarted %v\n", c.log_list, added, removed, restarted) }
+
+    return added, removed, restarted, nil
+
+}
+
+// list the monitors, sorted by log url
+func (c *Controller) getMonitors() []*Monitor {
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    var monitors []*Monitor
+    for _, monitor := range c.monitors {
+        monitors = append(monitors, monitor)
+    }
+    sort.Slice(monitors, func(i, j int) bool { return monitors[i].ctl_host < monitors[j].ctl_host })
+
+    return monitors
+
+}
+
+// start a monitor's goroutine, if it isn't already running.  the caller must hold c.lock
+func (c *Controller) startMonitor(monitor *Monitor) {
+
+    if !monitor.active {
+        monitor.active = true
+        monitor.stop = make(chan struct{})
+        stop := monitor.stop
+        c.spawn(func() { monitor.Activate(stop) })
+    }
+
+}
+
+// stop a monitor's goroutine, if it's running.  the caller must hold c.lock
+func (c *Controller) stopMonitor(monitor *Monitor) {
+
+    if monitor.active {
+        monitor.Stop(monitor.stop)
+        monitor.active = false
+    }
+
+}
+
+// start monitoring a new log (and optionally its public key)
+func (c *Controller) AddLog(w http.ResponseWriter, r *http.Request) {
+
+    vars := mux.Vars(r)
+    ctl_host := vars["ctl"]
+    log_key := r.URL.Query().Get("key")
+    fetch_concurrency := 0
+    if r.URL.Query().Get("fetch_concurrency") != "" {
+        n, err := strconv.Atoi(r.URL.Query().Get("fetch_concurrency"))
+        if err != nil || n < 1 {
+            fmt.Fprintf(w, "Invalid fetch_concurrency: %s\n", r.URL.Query().Get("fetch_concurrency"))
+            return
+        }
+        fetch_concurrency = n
+    }
+
+    _, err := c.addLog(ctl_host, log_key, DEFAULT_MMD, fetch_concurrency)
+    if err != nil {
+        fmt.Fprintf(w, "Could not add %s: %v\n", ctl_host, err)
+        return
+    }
+
+    fmt.Fprintf(w, "Added %s. Now monitoring the following logs:\n", ctl_host)
+    c.ListLogs(w, r)
+
+}
+
+// stop monitoring a log
+func (c *Controller) RemoveLog(w http.ResponseWriter, r *http.Request) {
+
+    vars := mux.Vars(r)
+    ctl_host := vars["ctl"]
+
+    err := c.removeLog(ctl_host)
+    if err != nil {
+        fmt.Fprintf(w, "Could not remove %s: %v\n", ctl_host, err)
+        return
+    }
+
+    fmt.Fprintf(w, "Removed %s. Now monitoring the following logs:\n", ctl_host)
+    c.ListLogs(w, r)
+
+}
+
+// read the log list file again, adding and removing logs to match it
+func (c *Controller) ReloadLogList(w http.ResponseWriter, r *http.Request) {
+
+    if c.log_list == "" {
+        fmt.Fprintf(w, "No log list was given on the command line.\n")
+        return
+    }
+
+    added, removed, restarted, err := c.reloadLogList()
+    if err != nil {
+        fmt.Fprintf(w, "Could not reload %s: %v\n", c.log_list, err)
+        return
+    }
+
+    fmt.Fprintf(w, "Reloaded %s. Added %v, removed %v, restarted %v. Now monitoring the following logs:\n", c.log_list, added, removed, restarted)
+    c.ListLogs(w, r)
+
+}
+
+// list logs
+func (c *Controller) ListLogs(w http.ResponseWriter, r *http.Request) {
+
+    for _, monitor := range c.getMonitors() {
+        fmt.Fprintf(w, "%s\n", monitor.CTL_host())
+    }
 
 }
 
@@ -113,7 +796,13 @@ func NewController(ctl_host string, hostnames []string, verbose bool, no_auto bo
 func (c *Controller) Start(w http.ResponseWriter, r *http.Request) {
 
     fmt.Fprintf(w, "Starting")
-    go c.monitor.Activate(c.monitor.Signal)
+
+    c.lock.Lock()
+    c.auto = true
+    for _, monitor := range c.monitors {
+        c.startMonitor(monitor)
+    }
+    c.lock.Unlock()
 
 }
 
@@ -121,23 +810,51 @@ func (c *Controller) Start(w http.ResponseWriter, r *http.Request) {
 func (c *Controller) Stop(w http.ResponseWriter, r *http.Request) {
 
     fmt.Fprintf(w, "Stopping")
-    c.monitor.Stop(c.monitor.Signal)
+
+    c.lock.Lock()
+    c.auto = false
+    for _, monitor := range c.monitors {
+        c.stopMonitor(monitor)
+    }
+    c.lock.Unlock()
 
 }
 
-// search the entire CT log and build a database
+// search every CT log and build a database
 func (c *Controller) BuildDatabase(w http.ResponseWriter, r *http.Request) {
 
-    fmt.Fprintf(w, "Building a database...")
-    c.monitor.buildDB()
-    fmt.Fprintf(w, "Done.")
+    for _, monitor := range c.getMonitors() {
+        fmt.Fprintf(w, "Building a database from %s...", monitor.CTL_host())
+        err := monitor.buildDB()
+        if err != nil {
+            fmt.Fprintf(w, "Done, but the entries could not be verified against the signed tree head: %v\n", err)
+            continue
+        }
+        fmt.Fprintf(w, "Done.  The entries match the signed tree head.\n")
+    }
 
 }
 
-// check for new certificates
+// check every log for new certificates
 func (c *Controller) Check(w http.ResponseWriter, r *http.Request) {
 
-    fmt.Fprintf(w, "Checking for new certificates.")
-    c.monitor.Check()
+    fmt.Fprintf(w, "Checking for new certificates.\n")
+    for _, monitor := range c.getMonitors() {
+        err := monitor.Check()
+        if err != nil {
+            fmt.Fprintf(w, "Error checking %s: %v\n", monitor.CTL_host(), err)
+        }
+    }
+
+}
+
+// request and verify inclusion proofs for stored certificates that don't have one yet
+func (c *Controller) ProveInclusions(w http.ResponseWriter, r *http.Request) {
+
+    fmt.Fprintf(w, "Requesting inclusion proofs...\n")
+    for _, monitor := range c.getMonitors() {
+        proven, failed := monitor.proveInclusions()
+        fmt.Fprintf(w, "Proved inclusion of %d certificates in %s; %d proofs failed.\n", proven, monitor.CTL_host(), failed)
+    }
 
 }
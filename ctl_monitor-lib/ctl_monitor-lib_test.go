@@ -1,6 +1,35 @@
 package ctl_monitor_lib
 
 import "testing"
+import "bytes"
+import "crypto"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/sha256"
+import "crypto/x509"
+import "encoding/base64"
+import "encoding/binary"
+import "encoding/pem"
+import "database/sql"
+import "crypto/x509/pkix"
+import "encoding/json"
+import "math/big"
+import "net/http"
+import "net/http/httptest"
+import "strconv"
+import "sync"
+import "time"
+import "os"
+import "errors"
+import "net"
+import "net/url"
+import "strings"
+import "encoding/asn1"
+import "encoding/hex"
+import "github.com/gorilla/mux"
+import dto "github.com/prometheus/client_model/go"
 
 // test getEntries
 func Test_getEntries(t *testing.T) {
@@ -12,7 +41,7 @@ func Test_getEntries(t *testing.T) {
     var entries []rawEntry = make([]rawEntry,1)
     entries[0] = raw_entry
 
-    resp := getEntries(ctl_host, 0, 0)
+    resp, _ := getEntries(ctl_host, 0, 0, nil)
 
     if len(resp) != 1 || resp[0] != entries[0] {
         t.Errorf("Response was incorrect; got %v; want %v\n", resp, entries)
@@ -27,7 +56,7 @@ func Test_getSTH_timestamp(t *testing.T) {
 
     sthCorrect := Signed_tree_head{Tree_size: 7842537, Timestamp: 1569238462780, Sha256_root_hash: "9cy+yC0YlzZWZSSo+VsBLW1wrW3VkxvswiClpSwxTYw=", Tree_head_signature: "BAMARzBFAiB2EQwdUDADMlY2Nl+GlFmBhUvXg+bZlwxiCiqs3cNOowIhAKeYK1I3X9AvVWo+J8BBJJkJs5NzBQ4KWrEbkgVXt3Eq",}
 
-    resp, _ := getSTH(ctl_host)
+    resp, _ := getSTH(ctl_host, nil)
 
     if resp.Timestamp != sthCorrect.Timestamp {
         t.Errorf("Response was incorrect; got %v; want %v\n", resp, sthCorrect)
@@ -42,7 +71,7 @@ func Test_getSTH_Tree_size(t *testing.T) {
 
     sthCorrect := Signed_tree_head{Tree_size: 7842537, Timestamp: 1569238462780, Sha256_root_hash: "9cy+yC0YlzZWZSSo+VsBLW1wrW3VkxvswiClpSwxTYw=", Tree_head_signature: "BAMARzBFAiB2EQwdUDADMlY2Nl+GlFmBhUvXg+bZlwxiCiqs3cNOowIhAKeYK1I3X9AvVWo+J8BBJJkJs5NzBQ4KWrEbkgVXt3Eq",}
 
-    resp, _ := getSTH(ctl_host)
+    resp, _ := getSTH(ctl_host, nil)
 
     if resp.Tree_size != sthCorrect.Tree_size {
         t.Errorf("Response was incorrect; got %v; want %v\n", resp, sthCorrect)
@@ -80,3 +109,2594 @@ func Test_getCommonname(t *testing.T) {
 
 }
 
+// sign a tree head with 'signer', the way a log would
+func signTestSTH(t *testing.T, signer crypto.Signer, sth Signed_tree_head) Signed_tree_head {
+
+    data, err := treeHeadSignatureInput(sth)
+    if err != nil {
+        t.Fatal(err)
+    }
+    digest := sha256.Sum256(data)
+    signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ds := []byte{HASH_ALGORITHM_SHA256, SIGNATURE_ALGORITHM_ECDSA, 0, 0}
+    if _, ok := signer.(*rsa.PrivateKey); ok {
+        ds[1] = SIGNATURE_ALGORITHM_RSA
+    }
+    binary.BigEndian.PutUint16(ds[2:4], uint16(len(signature)))
+    sth.Tree_head_signature = base64.StdEncoding.EncodeToString(append(ds, signature...))
+
+    return sth
+
+}
+
+// test verifySTHSignature with ECDSA and RSA keys
+func Test_verifySTHSignature(t *testing.T) {
+
+    ecdsa_key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    rsa_key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+    for _, signer := range []crypto.Signer{ecdsa_key, rsa_key} {
+        der, _ := x509.MarshalPKIXPublicKey(signer.Public())
+        key, err := loadLogKey(base64.StdEncoding.EncodeToString(der))
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        sth := signTestSTH(t, signer, Signed_tree_head{Tree_size: 7842537, Timestamp: 1569238462780, Sha256_root_hash: "9cy+yC0YlzZWZSSo+VsBLW1wrW3VkxvswiClpSwxTYw="})
+        err = verifySTHSignature(sth, key)
+        if err != nil {
+            t.Errorf("Valid signature was refused: %v\n", err)
+        }
+
+        sth.Tree_size += 1
+        err = verifySTHSignature(sth, key)
+        if err == nil {
+            t.Errorf("Signature over a modified tree head was accepted\n")
+        }
+    }
+
+}
+
+// test loadLogKey with a PEM key and a key file, and refuse keys on other curves
+func Test_loadLogKey(t *testing.T) {
+
+    p256_key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    der, _ := x509.MarshalPKIXPublicKey(p256_key.Public())
+    key, err := loadLogKey(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if key.log_id != sha256.Sum256(der) {
+        t.Errorf("Log id was incorrect; got %x; want %x\n", key.log_id, sha256.Sum256(der))
+    }
+
+    p384_key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+    der, _ = x509.MarshalPKIXPublicKey(p384_key.Public())
+    _, err = loadLogKey(base64.StdEncoding.EncodeToString(der))
+    if err == nil {
+        t.Errorf("P-384 key was accepted\n")
+    }
+
+// a file whose name is also valid base64
+    t.Chdir(t.TempDir())
+    der, _ = x509.MarshalPKIXPublicKey(p256_key.Public())
+    err = os.WriteFile("logkey12", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+    key, err = loadLogKey("logkey12")
+    if err != nil || key.log_id != sha256.Sum256(der) {
+        t.Errorf("Key file logkey12 was not read; got %v\n", err)
+    }
+
+}
+
+// reference Merkle tree hash from RFC 6962, section 2.1
+func referenceMTH(leaves [][]byte) []byte {
+
+    n := uint64(len(leaves))
+    if n == 0 {
+        empty := sha256.Sum256(nil)
+        return empty[:]
+    }
+    if n == 1 {
+        return leafHash(leaves[0])
+    }
+    k := uint64(1)
+    for k*2 < n {
+        k *= 2
+    }
+    return nodeHash(referenceMTH(leaves[:k]), referenceMTH(leaves[k:]))
+
+}
+
+// reference consistency proof from RFC 6962, section 2.1.2
+func referenceSubproof(m uint64, leaves [][]byte, complete bool) [][]byte {
+
+    n := uint64(len(leaves))
+    if m == n {
+        if complete {
+            return nil
+        }
+        return [][]byte{referenceMTH(leaves)}
+    }
+    k := uint64(1)
+    for k*2 < n {
+        k *= 2
+    }
+    if m <= k {
+        return append(referenceSubproof(m, leaves[:k], complete), referenceMTH(leaves[k:]))
+    }
+    return append(referenceSubproof(m-k, leaves[k:], false), referenceMTH(leaves[:k]))
+
+}
+
+func testLeaves(n int) [][]byte {
+
+    leaves := make([][]byte, n)
+    for i := range leaves {
+        leaves[i] = []byte{byte(i), byte(i >> 8)}
+    }
+    return leaves
+
+}
+
+// test verifyConsistencyProof against proofs for every pair of tree sizes up to 40
+func Test_verifyConsistencyProof(t *testing.T) {
+
+    leaves := testLeaves(40)
+
+    for second := uint64(1); second <= 40; second++ {
+        second_root := referenceMTH(leaves[:second])
+        for first := uint64(1); first <= second; first++ {
+            first_root := referenceMTH(leaves[:first])
+            var proof [][]byte
+            if first < second {
+                proof = referenceSubproof(first, leaves[:second], true)
+            }
+
+            err := verifyConsistencyProof(first, second, first_root, second_root, proof)
+            if err != nil {
+                t.Errorf("Valid proof from %d to %d was refused: %v\n", first, second, err)
+            }
+
+            if len(proof) > 0 {
+                err = verifyConsistencyProof(first, second, first_root, second_root, proof[1:])
+                if err == nil {
+                    t.Errorf("Truncated proof from %d to %d was accepted\n", first, second)
+                }
+            }
+            err = verifyConsistencyProof(first, second, leafHash([]byte("fork")), second_root, proof)
+            if err == nil {
+                t.Errorf("Proof from %d to %d was accepted for the wrong old root\n", first, second)
+            }
+        }
+    }
+
+    err := verifyConsistencyProof(10, 9, referenceMTH(leaves[:10]), referenceMTH(leaves[:9]), nil)
+    if err == nil {
+        t.Errorf("Shrinking tree was accepted\n")
+    }
+
+}
+
+// test compactRange.root against the reference Merkle tree hash for every tree size up to 70
+func Test_compactRange(t *testing.T) {
+
+    leaves := testLeaves(70)
+
+    var merkle_range compactRange
+    for i, leaf := range leaves {
+        merkle_range.appendLeafHash(leafHash(leaf))
+
+        root := merkle_range.root()
+        rootCorrect := referenceMTH(leaves[:i+1])
+        if string(root) != string(rootCorrect) {
+            t.Errorf("Root of tree of size %d was incorrect; got %x; want %x\n", i+1, root, rootCorrect)
+        }
+    }
+
+}
+
+// reference audit path from RFC 6962, section 2.1.1
+func referencePath(m uint64, leaves [][]byte) [][]byte {
+
+    n := uint64(len(leaves))
+    if n <= 1 {
+        return nil
+    }
+    k := uint64(1)
+    for k*2 < n {
+        k *= 2
+    }
+    if m < k {
+        return append(referencePath(m, leaves[:k]), referenceMTH(leaves[k:]))
+    }
+    return append(referencePath(m-k, leaves[k:]), referenceMTH(leaves[:k]))
+
+}
+
+// test verifyInclusionProof against audit paths for every leaf in trees of size up to 40
+func Test_verifyInclusionProof(t *testing.T) {
+
+    leaves := testLeaves(40)
+
+    for size := uint64(1); size <= 40; size++ {
+        root := referenceMTH(leaves[:size])
+        for index := uint64(0); index < size; index++ {
+            proof := referencePath(index, leaves[:size])
+
+            err := verifyInclusionProof(index, size, leafHash(leaves[index]), root, proof)
+            if err != nil {
+                t.Errorf("Valid proof for leaf %d in tree of size %d was refused: %v\n", index, size, err)
+            }
+
+            err = verifyInclusionProof(index, size, leafHash([]byte("not in the tree")), root, proof)
+            if err == nil {
+                t.Errorf("Proof for leaf %d in tree of size %d was accepted for the wrong leaf\n", index, size)
+            }
+            if len(proof) > 0 {
+                err = verifyInclusionProof(index, size, leafHash(leaves[index]), root, proof[:len(proof)-1])
+                if err == nil {
+                    t.Errorf("Truncated proof for leaf %d in tree of size %d was accepted\n", index, size)
+                }
+            }
+        }
+    }
+
+}
+
+// test that prepareDatabase adds new columns to a 'certificates' table kept from an older version
+func Test_prepareDatabase_addColumns(t *testing.T) {
+
+    database_name := t.TempDir() + "/old.db"
+    db, err := sql.Open("sqlite3", database_name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.Exec("CREATE TABLE certificates (timestamp INTEGER, commonname TEXT, certificate TEXT, logentrytype TEXT, PRIMARY KEY (timestamp, commonname, certificate, logentrytype) )")
+    db.Exec("INSERT INTO certificates VALUES (1364256598992, 'ttmail.npp.co.th', 'AAUJ', 'X509')")
+    db.Close()
+
+    db, err = prepareDatabase(database_name, false, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+
+    var common_name string
+    err = db.QueryRow("SELECT commonname FROM certificates WHERE leaf_hash IS NULL AND proof_tree_size IS NULL").Scan(&common_name)
+    if err != nil || common_name != "ttmail.npp.co.th" {
+        t.Errorf("Existing row was not kept with the new columns; got %s, %v\n", common_name, err)
+    }
+
+// the old primary key didn't include the hostname, so the table was copied, with the commonname as the hostname
+    var hostname string
+    err = db.QueryRow("SELECT hostname FROM certificates WHERE matched_name = 'ttmail.npp.co.th'").Scan(&hostname)
+    if err != nil || hostname != "ttmail.npp.co.th" {
+        t.Errorf("Existing row was not migrated; got %s, %v\n", hostname, err)
+    }
+
+}
+
+// make a self-signed certificate for 'common_name' and 'dns_names'
+func makeTestCertificate(t *testing.T, common_name string, dns_names []string) []byte {
+
+    key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    template := x509.Certificate{
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject: pkix.Name{CommonName: common_name},
+        DNSNames: dns_names,
+        NotBefore: time.Now(),
+        NotAfter: time.Now().Add(90 * 24 * time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return der
+
+}
+
+// make the leaf_input of an X509 entry: version, leaf type, timestamp, entry type, the length-prefixed certificate, and empty extensions
+func makeTestX509Leaf(timestamp uint64, cert []byte) []byte {
+
+    leaf := make([]byte, 12)
+    binary.BigEndian.PutUint64(leaf[2:10], timestamp)
+    leaf = append(leaf, byte(len(cert)>>16), byte(len(cert)>>8), byte(len(cert)))
+    leaf = append(leaf, cert...)
+    leaf = append(leaf, 0, 0)
+
+    return leaf
+
+}
+
+// make a precertificate for 'common_name' and 'dns_names', issued by a new test CA.  returns the leaf_input of its PreCert entry (the issuer key hash and the TBSCertificate without the poison extension), its extra_data (the poisoned precertificate and the CA), and the issuer key hash
+func makeTestPrecert(t *testing.T, timestamp uint64, common_name string, dns_names []string) ([]byte, []byte, []byte) {
+
+    issuance := makeTestIssuance(t, timestamp, common_name, dns_names)
+    return issuance.precert_leaf, issuance.precert_extra_data, issuance.issuer_key_hash
+
+}
+
+// a precertificate and the certificate issued from it, as the entries a log would have for them
+type testIssuance struct {
+    precert_leaf []byte
+    precert_extra_data []byte
+    issuer_key_hash []byte
+    cert []byte
+    cert_leaf []byte
+    cert_extra_data []byte
+}
+
+// make a precertificate for 'common_name' and 'dns_names', issued by a new test CA, and the certificate issued from it, with an SCT list extension holding an SCT from each of 'sct_logs'.  both entries, and the SCTs, have the timestamp 'timestamp'
+func makeTestIssuance(t *testing.T, timestamp uint64, common_name string, dns_names []string, sct_logs ...*fakeLog) testIssuance {
+
+    ca_key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    ca_template := x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: "Test CA"},
+        NotBefore: time.Now(),
+        NotAfter: time.Now().Add(365 * 24 * time.Hour),
+        IsCA: true,
+        BasicConstraintsValid: true,
+    }
+    ca, err := x509.CreateCertificate(rand.Reader, &ca_template, &ca_template, ca_key.Public(), ca_key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ca_cert, _ := x509.ParseCertificate(ca)
+
+    key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    template := x509.Certificate{
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject: pkix.Name{CommonName: common_name},
+        DNSNames: dns_names,
+        NotBefore: time.Unix(1700000000, 0),
+        NotAfter: time.Unix(1700000000, 0).Add(90 * 24 * time.Hour),
+    }
+// the log commits to the TBSCertificate without the poison, which is the same as the TBSCertificate of a certificate that never had it
+    tbs_cert, err := x509.CreateCertificate(rand.Reader, &template, ca_cert, key.Public(), ca_key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    parsed, _ := x509.ParseCertificate(tbs_cert)
+    template.ExtraExtensions = []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}, Critical: true, Value: []byte{5, 0}}}
+    precert, err := x509.CreateCertificate(rand.Reader, &template, ca_cert, key.Public(), ca_key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    issuer_key_hash := sha256.Sum256(ca_cert.RawSubjectPublicKeyInfo)
+    tbs := parsed.RawTBSCertificate
+
+// each SCT signs the precertificate's TBSCertificate
+    var scts []byte
+    for _, sct_log := range sct_logs {
+        sct := sct_log.signSCT(timestamp, issuer_key_hash[:], tbs)
+        scts = append(scts, byte(len(sct)>>8), byte(len(sct)))
+        scts = append(scts, sct...)
+    }
+    sct_list, _ := asn1.Marshal(append([]byte{byte(len(scts)>>8), byte(len(scts))}, scts...))
+    template.ExtraExtensions = []pkix.Extension{{Id: SCT_LIST_OID, Value: sct_list}}
+    cert, err := x509.CreateCertificate(rand.Reader, &template, ca_cert, key.Public(), ca_key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    leaf := make([]byte, 12)
+    binary.BigEndian.PutUint64(leaf[2:10], timestamp)
+    binary.BigEndian.PutUint16(leaf[10:12], 1)
+    leaf = append(leaf, issuer_key_hash[:]...)
+    leaf = append(leaf, byte(len(tbs)>>16), byte(len(tbs)>>8), byte(len(tbs)))
+    leaf = append(leaf, tbs...)
+    leaf = append(leaf, 0, 0)
+
+// PrecertChainEntry: the precertificate, then the chain, each length-prefixed
+    extra_data := []byte{byte(len(precert)>>16), byte(len(precert)>>8), byte(len(precert))}
+    extra_data = append(extra_data, precert...)
+    chain_length := len(ca) + 3
+    extra_data = append(extra_data, byte(chain_length>>16), byte(chain_length>>8), byte(chain_length))
+    extra_data = append(extra_data, byte(len(ca)>>16), byte(len(ca)>>8), byte(len(ca)))
+    extra_data = append(extra_data, ca...)
+
+// an X509ChainEntry has just the chain
+    cert_extra_data := extra_data[3+len(precert):]
+
+    return testIssuance{precert_leaf: leaf, precert_extra_data: extra_data, issuer_key_hash: issuer_key_hash[:], cert: cert, cert_leaf: makeTestX509Leaf(timestamp, cert), cert_extra_data: cert_extra_data}
+
+}
+
+// the number of certificates stored for 'hostname'
+func countCerts(t *testing.T, shared *sharedState, hostname string) int {
+
+    rows, err := shared.listCerts(hostname, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return len(rows)
+
+}
+
+// an in-process CT log serving get-sth, get-entries, get-sth-consistency and get-proof-by-hash over HTTP
+type fakeLog struct {
+    server *httptest.Server
+    key *ecdsa.PrivateKey
+    lock sync.Mutex
+    leaves [][]byte
+    extra_data [][]byte
+// only the first 'tree_size' leaves are published
+    tree_size uint64
+// if set, get-entries returns at most this many entries
+    max_entries uint64
+// if set, get-sth-consistency returns hashes that aren't base64
+    garbled_proofs bool
+// if set, get-sth and get-entries take this long to answer
+    delay time.Duration
+// if set, get-sth answers 503 Service Unavailable
+    unavailable bool
+// if set, get-proof-by-hash answers 503 Service Unavailable
+    proofs_unavailable bool
+}
+
+func newFakeLog(t *testing.T) *fakeLog {
+
+    var f fakeLog
+    f.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/ct/v1/get-sth", f.getSTH)
+    mux.HandleFunc("/ct/v1/get-entries", f.getEntries)
+    mux.HandleFunc("/ct/v1/get-sth-consistency", f.getSTHConsistency)
+    mux.HandleFunc("/ct/v1/get-proof-by-hash", f.getProofByHash)
+    f.server = httptest.NewServer(mux)
+    t.Cleanup(f.server.Close)
+
+    return &f
+
+}
+
+func (f *fakeLog) url() string {
+
+    return f.server.URL + "/"
+
+}
+
+func (f *fakeLog) publicKey() string {
+
+    der, _ := x509.MarshalPKIXPublicKey(f.key.Public())
+    return base64.StdEncoding.EncodeToString(der)
+
+}
+
+// add an X509 entry for a new certificate.  it isn't visible until publish is called
+func (f *fakeLog) addCertificate(t *testing.T, common_name string, dns_names ...string) {
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.leaves = append(f.leaves, makeTestX509Leaf(uint64(time.Now().UnixNano()/1e6), makeTestCertificate(t, common_name, dns_names)))
+    f.extra_data = append(f.extra_data, []byte{0, 0, 0})
+
+}
+
+// add a PreCert entry for a new precertificate.  it isn't visible until publish is called
+func (f *fakeLog) addPrecertificate(t *testing.T, common_name string, dns_names ...string) {
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    leaf, extra_data, _ := makeTestPrecert(t, uint64(time.Now().UnixNano()/1e6), common_name, dns_names)
+    f.leaves = append(f.leaves, leaf)
+    f.extra_data = append(f.extra_data, extra_data)
+
+}
+
+// sign an SCT for a precertificate, and serialize it as it is in an SCT list
+func (f *fakeLog) signSCT(timestamp uint64, issuer_key_hash []byte, tbs []byte) []byte {
+
+    der, _ := x509.MarshalPKIXPublicKey(f.key.Public())
+    sct := signedCertificateTimestamp{Log_id: sha256.Sum256(der), Timestamp: timestamp}
+    digest := sha256.Sum256(precertSCTInput(sct, issuer_key_hash, tbs))
+    signature, _ := ecdsa.SignASN1(rand.Reader, f.key, digest[:])
+
+    serialized := make([]byte, 41)
+    copy(serialized[1:33], sct.Log_id[:])
+    binary.BigEndian.PutUint64(serialized[33:41], timestamp)
+// no extensions
+    serialized = append(serialized, 0, 0)
+    serialized = append(serialized, HASH_ALGORITHM_SHA256, SIGNATURE_ALGORITHM_ECDSA, byte(len(signature)>>8), byte(len(signature)))
+
+    return append(serialized, signature...)
+
+}
+
+// add an entry that has already been made.  it isn't visible until publish is called
+func (f *fakeLog) addEntry(leaf []byte, extra_data []byte) {
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.leaves = append(f.leaves, leaf)
+    f.extra_data = append(f.extra_data, extra_data)
+
+}
+
+// publish every entry added so far
+func (f *fakeLog) publish() {
+
+    f.lock.Lock()
+    f.tree_size = uint64(len(f.leaves))
+    f.lock.Unlock()
+
+}
+
+func (f *fakeLog) signedTreeHead() Signed_tree_head {
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    sth := Signed_tree_head{Tree_size: f.tree_size, Timestamp: uint64(time.Now().UnixNano()/1e6)}
+    sth.Sha256_root_hash = base64.StdEncoding.EncodeToString(referenceMTH(f.leaves[:f.tree_size]))
+
+    data, _ := treeHeadSignatureInput(sth)
+    digest := sha256.Sum256(data)
+    signature, _ := ecdsa.SignASN1(rand.Reader, f.key, digest[:])
+    ds := []byte{HASH_ALGORITHM_SHA256, SIGNATURE_ALGORITHM_ECDSA, byte(len(signature)>>8), byte(len(signature))}
+    sth.Tree_head_signature = base64.StdEncoding.EncodeToString(append(ds, signature...))
+
+    return sth
+
+}
+
+func encodeTestHashes(hashes [][]byte) []string {
+
+    encoded := []string{}
+    for _, hash := range hashes {
+        encoded = append(encoded, base64.StdEncoding.EncodeToString(hash))
+    }
+    return encoded
+
+}
+
+// wait as long as the log is set to take to answer
+func (f *fakeLog) wait() {
+
+    f.lock.Lock()
+    delay := f.delay
+    f.lock.Unlock()
+    time.Sleep(delay)
+
+}
+
+func (f *fakeLog) getSTH(w http.ResponseWriter, r *http.Request) {
+
+    f.wait()
+    f.lock.Lock()
+    unavailable := f.unavailable
+    f.lock.Unlock()
+    if unavailable {
+        http.Error(w, "unavailable", http.StatusServiceUnavailable)
+        return
+    }
+    json.NewEncoder(w).Encode(f.signedTreeHead())
+
+}
+
+func (f *fakeLog) getEntries(w http.ResponseWriter, r *http.Request) {
+
+    f.wait()
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    start, _ := strconv.ParseUint(r.URL.Query().Get("start"), 10, 64)
+    end, _ := strconv.ParseUint(r.URL.Query().Get("end"), 10, 64)
+    if start >= f.tree_size || end < start {
+        http.Error(w, "bad range", http.StatusBadRequest)
+        return
+    }
+    if end >= f.tree_size {
+        end = f.tree_size - 1
+    }
+    if f.max_entries != 0 && end-start+1 > f.max_entries {
+        end = start + f.max_entries - 1
+    }
+
+    var response getEntriesResponse
+    for i := start; i <= end; i++ {
+        response.Entries = append(response.Entries, rawEntry{Leaf_input: base64.StdEncoding.EncodeToString(f.leaves[i]), Extra_data: base64.StdEncoding.EncodeToString(f.extra_data[i])})
+    }
+    json.NewEncoder(w).Encode(response)
+
+}
+
+func (f *fakeLog) getSTHConsistency(w http.ResponseWriter, r *http.Request) {
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    first, _ := strconv.ParseUint(r.URL.Query().Get("first"), 10, 64)
+    second, _ := strconv.ParseUint(r.URL.Query().Get("second"), 10, 64)
+    if first > second || second > f.tree_size {
+        http.Error(w, "bad range", http.StatusBadRequest)
+        return
+    }
+    if f.garbled_proofs {
+        json.NewEncoder(w).Encode(getSTHConsistencyResponse{Consistency: []string{"not base64!"}})
+        return
+    }
+
+    json.NewEncoder(w).Encode(getSTHConsistencyResponse{Consistency: encodeTestHashes(referenceSubproof(first, f.leaves[:second], true))})
+
+}
+
+func (f *fakeLog) getProofByHash(w http.ResponseWriter, r *http.Request) {
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    if f.proofs_unavailable {
+        http.Error(w, "unavailable", http.StatusServiceUnavailable)
+        return
+    }
+    hash, _ := base64.StdEncoding.DecodeString(r.URL.Query().Get("hash"))
+    tree_size, _ := strconv.ParseUint(r.URL.Query().Get("tree_size"), 10, 64)
+    for i := uint64(0); i < tree_size && i < uint64(len(f.leaves)); i++ {
+        if string(leafHash(f.leaves[i])) == string(hash) {
+            json.NewEncoder(w).Encode(getProofByHashResponse{Leaf_index: i, Audit_path: encodeTestHashes(referencePath(i, f.leaves[:tree_size]))})
+            return
+        }
+    }
+    http.Error(w, "not found", http.StatusNotFound)
+
+}
+
+// test a controller monitoring two logs that share a hostname list and database
+func Test_Controller_multipleLogs(t *testing.T) {
+
+    log_a := newFakeLog(t)
+    log_a.addCertificate(t, "a.example.com")
+    log_a.publish()
+    log_b := newFakeLog(t)
+    log_b.addCertificate(t, "a.example.com")
+    log_b.addCertificate(t, "b.example.com")
+    log_b.publish()
+
+    c, err := NewController([]string{log_a.url()}, []string{log_a.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"a.example.com", "b.example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor_b, err := c.addLog(log_b.url(), log_b.publicKey(), DEFAULT_MMD, 8)
+    if err != nil {
+        t.Fatal(err)
+    }
+// log_b asked for its own fetch concurrency; log_a gets the default
+    for _, monitor := range c.getMonitors() {
+        want := FETCH_CONCURRENCY
+        if monitor == monitor_b {
+            want = 8
+        }
+        if monitor.fetch_concurrency != want {
+            t.Errorf("Fetch concurrency for %s was incorrect; got %d; want %d\n", monitor.ctl_host, monitor.fetch_concurrency, want)
+        }
+    }
+    _, err = c.addLog(log_b.url(), log_b.publicKey(), DEFAULT_MMD, 0)
+    if err == nil {
+        t.Errorf("The same log was added twice\n")
+    }
+
+    for _, monitor := range c.getMonitors() {
+        err = monitor.buildDB()
+        if err != nil {
+            t.Errorf("Building from %s failed: %v\n", monitor.CTL_host(), err)
+        }
+    }
+
+    rows, err := c.shared.listCerts("a.example.com", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(rows) != 2 || rows[0].ctl == rows[1].ctl {
+        t.Errorf("Expected a.example.com from both logs; got %v\n", rows)
+    }
+
+    for _, monitor := range c.getMonitors() {
+        proven, failed := monitor.proveInclusions()
+        if proven == 0 || failed != 0 {
+            t.Errorf("Inclusion proofs from %s: %d proven, %d failed\n", monitor.CTL_host(), proven, failed)
+        }
+    }
+
+    err = c.removeLog(log_a.url())
+    if err != nil || len(c.getMonitors()) != 1 {
+        t.Errorf("Log was not removed; %v\n", err)
+    }
+
+}
+
+// test that a failed inclusion proof is recorded, and alerted on once for each tree head, and that a proof for another index than the one a leaf was fetched from fails
+func Test_proveInclusions_failures(t *testing.T) {
+
+    f := newFakeLog(t)
+    f.addCertificate(t, "a.example.com")
+    f.addCertificate(t, "b.example.com")
+    f.publish()
+
+    c, err := NewController([]string{f.url()}, []string{f.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"suffix:example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor := c.monitors[f.url()]
+    monitor.buildDB()
+    c.shared.database.Exec("UPDATE certificates SET leaf_index = 7 WHERE commonname = 'b.example.com'")
+
+    proven, failed := monitor.proveInclusions()
+    if proven != 1 || failed != 1 {
+        t.Errorf("Inclusion proofs were incorrect; got %d proven, %d failed; want 1 and 1\n", proven, failed)
+    }
+    var proof_error string
+    var failed_tree_size uint64
+    c.shared.database.QueryRow("SELECT proof_error, proof_failed_tree_size FROM certificates WHERE commonname = 'b.example.com'").Scan(&proof_error, &failed_tree_size)
+    if !strings.Contains(proof_error, "index 7") || failed_tree_size != 2 {
+        t.Errorf("Failed proof was incorrect; got %q against size %d\n", proof_error, failed_tree_size)
+    }
+
+// not again against the same tree head
+    proven, failed = monitor.proveInclusions()
+    var metric dto.Metric
+    c.shared.inclusion_failure_metrics.WithLabelValues(f.url()).Write(&metric)
+    if proven != 0 || failed != 0 || metric.GetCounter().GetValue() != 1 {
+        t.Errorf("Failed proof was retried; got %d proven, %d failed, metric %v\n", proven, failed, metric.GetCounter().GetValue())
+    }
+
+// but again against a new one
+    f.addCertificate(t, "c.example.com")
+    f.publish()
+    monitor.Check()
+    proven, failed = monitor.proveInclusions()
+    if proven != 1 || failed != 1 {
+        t.Errorf("Inclusion proofs against a new tree head were incorrect; got %d proven, %d failed; want 1 and 1\n", proven, failed)
+    }
+
+}
+
+// test that a slow log holds up neither the other logs while it's added, nor its removal while it's being searched
+func Test_Controller_slowLog(t *testing.T) {
+
+    fast_log := newFakeLog(t)
+    fast_log.publish()
+    slow_log := newFakeLog(t)
+    slow_log.publish()
+
+    c, err := NewController([]string{fast_log.url()}, []string{fast_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+
+    slow_log.lock.Lock()
+    slow_log.delay = 500 * time.Millisecond
+    slow_log.lock.Unlock()
+    added := make(chan error)
+    go func() {
+        _, err := c.addLog(slow_log.url(), slow_log.publicKey(), DEFAULT_MMD, 0)
+        added <- err
+    }()
+    time.Sleep(50 * time.Millisecond)
+    start := time.Now()
+    c.lock.Lock()
+    c.lock.Unlock()
+    if time.Since(start) > 100 * time.Millisecond {
+        t.Errorf("Adding a slow log held the controller's lock for %v\n", time.Since(start))
+    }
+    err = <- added
+    if err != nil {
+        t.Fatal(err)
+    }
+
+// a backfill of one entry at a time, half a second each
+    slow_log.lock.Lock()
+    slow_log.max_entries = 1
+    slow_log.lock.Unlock()
+    for i := 0; i < 10; i++ {
+        slow_log.addCertificate(t, "a.example.com")
+    }
+    slow_log.publish()
+    c.lock.Lock()
+    c.startMonitor(c.monitors[slow_log.url()])
+    c.lock.Unlock()
+    time.Sleep(700 * time.Millisecond)
+
+    start = time.Now()
+    err = c.removeLog(slow_log.url())
+    if err != nil || time.Since(start) > 100 * time.Millisecond {
+        t.Errorf("Removing a log being searched took %v; %v\n", time.Since(start), err)
+    }
+
+}
+
+// write a v3 log list containing 'logs' to a temporary file
+func writeTestLogList(t *testing.T, file_name string, logs []logListEntry) {
+
+    list := map[string]interface{}{"version": "3.0", "operators": []interface{}{map[string]interface{}{"name": "Test operator", "logs": logs}}}
+    contents, _ := json.Marshal(list)
+    err := os.WriteFile(file_name, contents, 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+}
+
+func testLogListEntry(description string, url string, key string, state string) logListEntry {
+
+    return logListEntry{Description: description, Url: url, Key: key, Mmd: 86400, State: map[string]json.RawMessage{state: json.RawMessage(`{"timestamp": "2019-01-01T00:00:00Z"}`)}}
+
+}
+
+// test loadLogList: only logs in the chosen states, no expired temporal shards, and no entries missing their key
+func Test_loadLogList(t *testing.T) {
+
+    file_name := t.TempDir() + "/log_list.json"
+
+    expired := testLogListEntry("Google 'Argon2017' log", "https://ct.googleapis.com/logs/argon2017/", "a2V5", "usable")
+    expired.Temporal_interval = &temporalInterval{Start_inclusive: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), End_exclusive: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+    current := testLogListEntry("Current shard", "https://ct.example.com/2026h2/", "a2V5", "usable")
+    current.Temporal_interval = &temporalInterval{Start_inclusive: time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC), End_exclusive: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)}
+    retired := testLogListEntry("Retired log", "https://ct.example.com/retired/", "a2V5", "retired")
+    readonly := testLogListEntry("Read-only log", "https://ct.example.com/readonly/", "a2V5", "readonly")
+    no_key := testLogListEntry("Log with no key", "https://ct.example.com/nokey/", "", "usable")
+    writeTestLogList(t, file_name, []logListEntry{expired, current, retired, no_key, readonly})
+
+    logs, err := loadLogList(file_name, LOG_LIST_STATES, time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(logs) != 2 || logs[0].Url != current.Url || logs[1].Url != readonly.Url {
+        t.Errorf("Response was incorrect; got %v; want %v\n", logs, []logListEntry{current, readonly})
+    }
+    if logs[0].mmd() != 24*time.Hour {
+        t.Errorf("MMD was incorrect; got %v; want %v\n", logs[0].mmd(), 24*time.Hour)
+    }
+
+}
+
+// test that a log given on the command line that's down at start-up doesn't stop the controller, and is added once it's back
+func Test_Controller_retryAddLog(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.publish()
+    fake_log.unavailable = true
+
+    max_retries := MAX_RETRIES
+    MAX_RETRIES = 0
+    defer func() { MAX_RETRIES = max_retries }()
+    sleep := SLEEP
+    SLEEP = 10 * time.Millisecond
+    defer func() { SLEEP = sleep }()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", nil, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    if len(c.getMonitors()) != 0 {
+        t.Errorf("Expected no logs; got %d\n", len(c.getMonitors()))
+    }
+    var metric dto.Metric
+    c.shared.request_failure_metrics.WithLabelValues(fake_log.url(), "http_status").Write(&metric)
+    if metric.Counter.GetValue() != 1 {
+        t.Errorf("Request failure metric was incorrect; got %v; want 1\n", metric.Counter.GetValue())
+    }
+
+    fake_log.lock.Lock()
+    fake_log.unavailable = false
+    fake_log.lock.Unlock()
+    for i := 0; i < 100 && len(c.getMonitors()) == 0; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if len(c.getMonitors()) != 1 {
+        t.Errorf("The log was not added once it was back\n")
+    }
+
+}
+
+// test that reloading the log list adds and removes monitors, restarts the ones whose key, MMD or fetch concurrency changed, and leaves logs added by hand alone
+func Test_Controller_reloadLogList(t *testing.T) {
+
+    log_a := newFakeLog(t)
+    log_a.publish()
+    log_b := newFakeLog(t)
+    log_b.publish()
+    log_c := newFakeLog(t)
+    log_c.publish()
+
+    file_name := t.TempDir() + "/log_list.json"
+    writeTestLogList(t, file_name, []logListEntry{testLogListEntry("a", log_a.url(), log_a.publicKey(), "usable"), testLogListEntry("b", log_b.url(), log_b.publicKey(), "qualified")})
+
+    c, err := NewController([]string{log_c.url()}, nil, file_name, LOG_LIST_STATES, t.TempDir() + "/test.db", nil, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    if len(c.getMonitors()) != 3 {
+        t.Errorf("Expected 3 logs; got %d\n", len(c.getMonitors()))
+    }
+
+    writeTestLogList(t, file_name, []logListEntry{testLogListEntry("a", log_a.url(), log_a.publicKey(), "usable"), testLogListEntry("b", log_b.url(), log_b.publicKey(), "retired")})
+    added, removed, restarted, err := c.reloadLogList()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(added) != 0 || len(removed) != 1 || removed[0] != log_b.url() || len(restarted) != 0 {
+        t.Errorf("Reload was incorrect; added %v, removed %v, restarted %v\n", added, removed, restarted)
+    }
+    if len(c.getMonitors()) != 2 {
+        t.Errorf("Expected 2 logs; got %d\n", len(c.getMonitors()))
+    }
+// a removed log's key no longer verifies anything
+    key_b, _ := loadLogKey(log_b.publicKey())
+    if c.shared.getKnownLog(key_b.log_id) != nil {
+        t.Errorf("Removed log's key is still known\n")
+    }
+
+// the log rotates its key, and the list changes its MMD
+    old_key, _ := loadLogKey(log_a.publicKey())
+    log_a.addCertificate(t, "rotated.example.com")
+    log_a.lock.Lock()
+    log_a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    log_a.lock.Unlock()
+    log_a.publish()
+    entry := testLogListEntry("a", log_a.url(), log_a.publicKey(), "usable")
+    entry.Mmd = 3600
+    entry.Fetch_concurrency = 2
+    writeTestLogList(t, file_name, []logListEntry{entry})
+    added, removed, restarted, err = c.reloadLogList()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(added) != 0 || len(removed) != 0 || len(restarted) != 1 || restarted[0] != log_a.url() {
+        t.Errorf("Reload was incorrect; added %v, removed %v, restarted %v\n", added, removed, restarted)
+    }
+    var monitor *Monitor
+    for _, m := range c.getMonitors() {
+        if m.ctl_host == log_a.url() {
+            monitor = m
+        }
+    }
+    if monitor == nil || monitor.mmd != time.Hour || monitor.fetch_concurrency != 2 || monitor.verifySTH(monitor.getTreeHead()) != nil {
+        t.Fatalf("Monitor was not restarted with the new key, MMD and fetch concurrency\n")
+    }
+// the old tree head doesn't verify under the new key, but the entries logged since it still have to be searched
+    if !monitor.resumed {
+        t.Errorf("Restarted monitor did not resume from the checkpoint\n")
+    }
+// a rotation isn't a rejected tree head, and the old key is forgotten
+    var metric dto.Metric
+    c.shared.sth_failure_metrics.WithLabelValues(log_a.url()).Write(&metric)
+    if metric.GetCounter().GetValue() != 0 {
+        t.Errorf("STH failure metric was incorrect; got %v; want 0\n", metric.GetCounter().GetValue())
+    }
+    if c.shared.getKnownLog(old_key.log_id) != nil || c.shared.getKnownLog(monitor.log_key.log_id) == nil {
+        t.Errorf("Known logs were not updated for the new key\n")
+    }
+
+}
+
+// test that new entries are found by Check, and that a restarted controller resumes from its checkpoint and backfills entries logged while it was down
+func Test_Monitor_checkpoint(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.addCertificate(t, "old.example.com")
+    fake_log.publish()
+    database_name := t.TempDir() + "/test.db"
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, database_name, []string{"old.example.com", "new.example.com", "down.example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor := c.getMonitors()[0]
+
+    fake_log.addCertificate(t, "new.example.com")
+    fake_log.publish()
+    monitor.Check()
+    if countCerts(t, c.shared, "old.example.com") != 0 || countCerts(t, c.shared, "new.example.com") != 1 {
+        t.Errorf("Check should only find entries logged after start-up\n")
+    }
+    c.shared.database.Close()
+
+// entries logged while no monitor is running
+    fake_log.addCertificate(t, "down.example.com")
+    fake_log.publish()
+
+    c, err = NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, database_name, []string{"old.example.com", "new.example.com", "down.example.com"}, false, true, false, true, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor = c.getMonitors()[0]
+    if !monitor.resumed || monitor.getNextIndex() != 2 {
+        t.Errorf("Monitor did not resume from the checkpoint; resumed %v, next index %d\n", monitor.resumed, monitor.getNextIndex())
+    }
+
+    monitor.Check()
+    if countCerts(t, c.shared, "down.example.com") != 1 {
+        t.Errorf("Entries logged while the monitor was down were not backfilled\n")
+    }
+    if monitor.getNextIndex() != 3 {
+        t.Errorf("Next index was incorrect; got %d; want 3\n", monitor.getNextIndex())
+    }
+
+}
+
+// test that a batch that can't be written in full isn't written at all, and is searched again
+func Test_addEntries_rollback(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.publish()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"rollback.example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor := c.getMonitors()[0]
+    fake_log.addCertificate(t, "rollback.example.com")
+    fake_log.publish()
+
+// the certificate is written, but the first certificate for its registrable domain can't be
+    _, err = c.shared.database.Exec("ALTER TABLE registrable_domains RENAME TO registrable_domains_moved")
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = monitor.Check()
+    if err == nil {
+        t.Errorf("Check should fail when a batch can't be written\n")
+    }
+    _, next_index, _, _ := monitor.loadCheckpoint()
+    if next_index != 0 || monitor.getNextIndex() != 0 || countCerts(t, c.shared, "rollback.example.com") != 0 {
+        t.Errorf("Partly written batch was kept; checkpoint %d (%d in memory), %d certificates\n", next_index, monitor.getNextIndex(), countCerts(t, c.shared, "rollback.example.com"))
+    }
+
+    _, err = c.shared.database.Exec("ALTER TABLE registrable_domains_moved RENAME TO registrable_domains")
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = monitor.Check()
+    if err != nil || monitor.getNextIndex() != 1 || countCerts(t, c.shared, "rollback.example.com") != 1 {
+        t.Errorf("Batch was not written when it was searched again; got %v\n", err)
+    }
+
+}
+
+// test that addEntries advances the stored checkpoint batch by batch
+func Test_addEntries_checkpoint(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.publish()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"batch.example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor := c.getMonitors()[0]
+
+    for i := 0; i < 7; i++ {
+        fake_log.addCertificate(t, "batch.example.com")
+    }
+    fake_log.publish()
+    monitor.setTreeHead(fake_log.signedTreeHead())
+
+    request_size := REQUEST_SIZE
+    REQUEST_SIZE = 2
+    defer func() { REQUEST_SIZE = request_size }()
+
+// stop partway through the third batch
+    err = monitor.addEntries(0, 4, nil, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, next_index, found, err := monitor.loadCheckpoint()
+    if err != nil || !found || next_index != 5 || monitor.getNextIndex() != 5 {
+        t.Errorf("Checkpoint was incorrect; got %d (%d in memory), %v; want 5\n", next_index, monitor.getNextIndex(), err)
+    }
+    if countCerts(t, c.shared, "batch.example.com") != 5 {
+        t.Errorf("Expected 5 certificates; got %d\n", countCerts(t, c.shared, "batch.example.com"))
+    }
+
+}
+
+// test that a full build with several requests in flight writes every batch in order, and adapts to a log that returns fewer entries than requested
+func Test_addEntries_parallel(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.publish()
+
+    fetch_concurrency := FETCH_CONCURRENCY
+    FETCH_CONCURRENCY = 4
+    defer func() { FETCH_CONCURRENCY = fetch_concurrency }()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"parallel.example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor := c.getMonitors()[0]
+
+    for i := 0; i < 50; i++ {
+        if i%3 == 0 {
+            fake_log.addCertificate(t, "parallel.example.com")
+        } else {
+            fake_log.addCertificate(t, "other.example.com")
+        }
+    }
+    fake_log.publish()
+    fake_log.max_entries = 3
+    monitor.setTreeHead(fake_log.signedTreeHead())
+
+    request_size := REQUEST_SIZE
+    REQUEST_SIZE = 8
+    defer func() { REQUEST_SIZE = request_size }()
+
+// buildDB only succeeds if the leaf hashes were appended in order
+    err = monitor.buildDB()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if countCerts(t, c.shared, "parallel.example.com") != 17 {
+        t.Errorf("Expected 17 certificates; got %d\n", countCerts(t, c.shared, "parallel.example.com"))
+    }
+    if monitor.batchSize() != 3 {
+        t.Errorf("Batch size did not adapt to the log; got %d; want 3\n", monitor.batchSize())
+    }
+
+// the checkpoint moves past every batch, in order
+    err = monitor.addEntries(0, 49, nil, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if monitor.getNextIndex() != 50 {
+        t.Errorf("next_index was incorrect; got %d; want 50\n", monitor.getNextIndex())
+    }
+
+}
+
+// test that getJSON retries errors that may go away, honors Retry-After, and returns typed errors
+func Test_getJSON(t *testing.T) {
+
+    retry_base := RETRY_BASE
+    RETRY_BASE = time.Millisecond
+    defer func() { RETRY_BASE = retry_base }()
+
+    var lock sync.Mutex
+    requests := make(map[string]int)
+    mux := http.NewServeMux()
+// fails twice with a 503, then succeeds
+    mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+        lock.Lock()
+        defer lock.Unlock()
+        requests["/flaky"] += 1
+        if requests["/flaky"] <= 2 {
+            http.Error(w, "unavailable", http.StatusServiceUnavailable)
+            return
+        }
+        w.Write([]byte(`{"Tree_size": 7}`))
+    })
+// rate limits the first request, asking for a one second wait
+    mux.HandleFunc("/limited", func(w http.ResponseWriter, r *http.Request) {
+        lock.Lock()
+        defer lock.Unlock()
+        requests["/limited"] += 1
+        if requests["/limited"] == 1 {
+            w.Header().Set("Retry-After", "1")
+            http.Error(w, "slow down", http.StatusTooManyRequests)
+            return
+        }
+        w.Write([]byte(`{"Tree_size": 8}`))
+    })
+    mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+        lock.Lock()
+        defer lock.Unlock()
+        requests["/missing"] += 1
+        http.NotFound(w, r)
+    })
+    mux.HandleFunc("/garbage", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("<html>"))
+    })
+// always asks for a day's wait
+    mux.HandleFunc("/stalled", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Retry-After", "86400")
+        http.Error(w, "come back tomorrow", http.StatusTooManyRequests)
+    })
+    server := httptest.NewServer(mux)
+    defer server.Close()
+
+    var sth Signed_tree_head
+    err := getJSON(server.URL + "/flaky", &sth, nil)
+    if err != nil || sth.Tree_size != 7 || requests["/flaky"] != 3 {
+        t.Errorf("Retrying a 503 failed; got %v after %d requests; want 7 after 3\n", err, requests["/flaky"])
+    }
+
+    begin := time.Now()
+    err = getJSON(server.URL + "/limited", &sth, nil)
+    if err != nil || sth.Tree_size != 8 || time.Since(begin) < time.Second {
+        t.Errorf("Retry-After was not honored; got %v after %v\n", err, time.Since(begin))
+    }
+
+    var status_error *HTTPStatusError
+    err = getJSON(server.URL + "/missing", &sth, nil)
+    if !errors.As(err, &status_error) || status_error.Status != http.StatusNotFound || requests["/missing"] != 1 {
+        t.Errorf("A 404 should fail without retrying; got %v after %d requests\n", err, requests["/missing"])
+    }
+
+    err = getJSON(server.URL + "/garbage", &sth, nil)
+    if errorKind(err) != "decode" {
+        t.Errorf("Expected a decode error; got %v\n", err)
+    }
+
+// the wait is capped at RETRY_MAX, however long the log asks for
+    retry_max := RETRY_MAX
+    RETRY_MAX = 10 * time.Millisecond
+    begin = time.Now()
+    err = getJSON(server.URL + "/stalled", &sth, nil)
+    RETRY_MAX = retry_max
+    if errorKind(err) != "rate_limited" || time.Since(begin) > 5 * time.Second {
+        t.Errorf("Retry-After was not capped; got %v after %v\n", err, time.Since(begin))
+    }
+
+// and closing 'done' gives up without waiting it out
+    done := make(chan struct{})
+    time.AfterFunc(50 * time.Millisecond, func() { close(done) })
+    begin = time.Now()
+    err = getJSON(server.URL + "/stalled", &sth, done)
+    if errorKind(err) != "rate_limited" || time.Since(begin) > 5 * time.Second {
+        t.Errorf("Closing done did not stop retrying; got %v after %v\n", err, time.Since(begin))
+    }
+
+    server.Close()
+    max_retries := MAX_RETRIES
+    MAX_RETRIES = 1
+    defer func() { MAX_RETRIES = max_retries }()
+    err = getJSON(server.URL + "/flaky", &sth, nil)
+    if errorKind(err) != "network" {
+        t.Errorf("Expected a network error; got %v\n", err)
+    }
+
+}
+
+// test parseRetryAfter
+func Test_parseRetryAfter(t *testing.T) {
+
+    now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+    cases := map[string]time.Duration{
+        "": 0,
+        "120": 2 * time.Minute,
+        "-1": 0,
+        "Wed, 01 Jan 2020 00:00:30 GMT": 30 * time.Second,
+        "Tue, 31 Dec 2019 23:00:00 GMT": 0,
+        "soon": 0,
+    }
+    for header, want := range cases {
+        got := parseRetryAfter(header, now)
+        if got != want {
+            t.Errorf("parseRetryAfter(%q) was incorrect; got %v; want %v\n", header, got, want)
+        }
+    }
+
+}
+
+// test getNames
+func Test_getNames(t *testing.T) {
+
+    uri, _ := url.Parse("https://login.example.com/sso")
+    cert := x509.Certificate{
+        Subject: pkix.Name{CommonName: "www.example.com"},
+        DNSNames: []string{"www.example.com", "api.example.com"},
+        IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+        EmailAddresses: []string{"admin@example.com"},
+        URIs: []*url.URL{uri},
+    }
+
+    names := getNames(&cert)
+    names_correct := []string{"www.example.com", "api.example.com", "192.0.2.1", "admin@example.com", "https://login.example.com/sso"}
+    if strings.Join(names, " ") != strings.Join(names_correct, " ") {
+        t.Errorf("Response was incorrect; got %v; want %v\n", names, names_correct)
+    }
+
+}
+
+// test that certificates are matched on their subject alternative names, with one row for each hostname they match
+func Test_addEntries_subjectAltNames(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.addCertificate(t, "", "a.example.com", "b.example.com", "unwatched.example.com")
+    fake_log.addCertificate(t, "c.example.com")
+    fake_log.publish()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"a.example.com", "b.example.com", "c.example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor := c.getMonitors()[0]
+
+    err = monitor.buildDB()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, hostname := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+        rows, err := c.shared.listCerts(hostname, nil)
+        if err != nil || len(rows) != 1 || rows[0].matched_name != hostname {
+            t.Errorf("Expected one row matching %s; got %v, %v\n", hostname, rows, err)
+        }
+    }
+
+}
+
+// test matchName
+func Test_matchName(t *testing.T) {
+
+    cases := []struct {
+        hostname string
+        name string
+        subdomains bool
+        want bool
+    }{
+        {"example.com", "example.com", false, true},
+        {"example.com", "EXAMPLE.com.", false, true},
+        {"Example.COM.", "example.com", false, true},
+        {"example.com", "www.example.com", false, false},
+        {"example.com", "www.example.com", true, true},
+        {"example.com", "notexample.com", true, false},
+        {"example.com", "notexample.com.evil.net", true, false},
+        {"example.com", "example.com.evil.net", true, false},
+        {"*.example.com", "a.b.example.com", false, true},
+        {".example.com", "api.example.com", false, true},
+        {"*.example.com", "example.com", false, false},
+        {".example.com", "badexample.com", false, false},
+        {"api.example.com", "*.example.com", false, true},
+        {"API.example.com", "*.EXAMPLE.com", false, true},
+        {"a.b.example.com", "*.example.com", false, false},
+        {"example.com", "*.example.com", false, false},
+        {"*.example.com", "*.example.com", false, true},
+        {"", "example.com", true, false},
+        {"münchen.example", "xn--mnchen-3ya.example", false, true},
+        {"xn--mnchen-3ya.example", "MÜNCHEN.example", false, true},
+        {"*.bücher.example", "www.XN--BCHER-KVA.example", false, true},
+        {"www.bücher.example", "*.xn--bcher-kva.example", false, true},
+        {"münchen.example", "munchen.example", false, false},
+    }
+
+    for _, c := range cases {
+        got := matchName(c.hostname, c.name, c.subdomains)
+        if got != c.want {
+            t.Errorf("matchName(%q, %q, %v) was incorrect; got %v; want %v\n", c.hostname, c.name, c.subdomains, got, c.want)
+        }
+    }
+
+}
+
+// test parseRule and watchRule.match
+func Test_parseRule(t *testing.T) {
+
+    cases := []struct {
+        rule string
+        kind string
+        matches []string
+        misses []string
+    }{
+        {"www.example.com", "exact", []string{"WWW.example.com."}, []string{"example.com", "a.www.example.com"}},
+        {"*.example.com", "suffix", []string{"a.example.com"}, []string{"example.com"}},
+        {"suffix:example.co.uk", "suffix", []string{"example.co.uk", "a.b.example.co.uk"}, []string{"badexample.co.uk"}},
+        {"glob:*paypa1*", "glob", []string{"www.paypa1-login.com", "PAYPA1.net"}, []string{"paypal.com"}},
+        {"glob:login?.example.com", "glob", []string{"login1.example.com"}, []string{"login.example.com", "login12.example.com"}},
+        {`regex:^(login|sso|auth)[-.].*\.example\.(com|net)$`, "regex", []string{"sso.corp.example.net", "auth-1.example.com"}, []string{"www.example.com", "sso.example.org"}},
+        {"münchen.example", "exact", []string{"xn--mnchen-3ya.example", "MÜNCHEN.example."}, []string{"munchen.example"}},
+        {"suffix:xn--bcher-kva.example", "suffix", []string{"shop.bücher.example"}, []string{"bucher.example"}},
+        {"glob:*bücher*", "glob", []string{"www.xn--bcher-kva.example", "bücher.example"}, []string{"bucher.example"}},
+        {"regex:^xn--", "regex", []string{"bücher.example"}, []string{"bucher.example"}},
+        {"registrable:example.co.uk", "registrable", []string{"example.co.uk", "a.b.example.co.uk", "*.example.co.uk"}, []string{"co.uk", "badexample.co.uk"}},
+        {"keyword:paypal", "keyword", []string{"paypal.com", "login.paypal-secure.co.uk", "www.mypaypal.net"}, []string{"paypal.com.evil.net", "paypa1.com"}},
+    }
+    for _, c := range cases {
+        rule, err := parseRule(c.rule)
+        if err != nil || rule.kind != c.kind {
+            t.Errorf("parseRule(%q) was incorrect; got %v, %v; want kind %s\n", c.rule, rule, err, c.kind)
+            continue
+        }
+        for _, name := range c.matches {
+            if !rule.match(name, false) {
+                t.Errorf("%q should match %q\n", c.rule, name)
+            }
+        }
+        for _, name := range c.misses {
+            if rule.match(name, false) {
+                t.Errorf("%q should not match %q\n", c.rule, name)
+            }
+        }
+    }
+
+    for _, invalid := range []string{"", "regex:", "regex:(unclosed", "suffix:a..example.com", "exact:has space", "suffix:*.", "exact:a\u200db.example", "suffix:xn--bcher-kva.\u0301a", "registrable:co.uk", "registrable:www.example.co.uk", "keyword:pay.pal", "keyword:"} {
+        _, err := parseRule(invalid)
+        if err == nil {
+            t.Errorf("parseRule(%q) should have failed\n", invalid)
+        }
+    }
+
+    a_label, _ := parseRule("exact:xn--mnchen-3ya.example")
+    u_label, _ := parseRule("MÜNCHEN.example.")
+    if a_label.key() != u_label.key() {
+        t.Errorf("Rules for the same name had different keys; got %s, %s\n", a_label.key(), u_label.key())
+    }
+
+    if strings.Join(splitRules("a.com,b.com"), " ") != "a.com b.com" || len(splitRules("regex:^a{1,2}$")) != 1 {
+        t.Errorf("splitRules was incorrect\n")
+    }
+
+}
+
+// test that rows are labeled with the rule that matched, that rules keep their ids, and that invalid rules are refused
+func Test_addEntries_rules(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.addCertificate(t, "sso.corp.example.net")
+    fake_log.addCertificate(t, "", "www.paypa1-secure.com")
+    fake_log.addCertificate(t, "other.org")
+    fake_log.publish()
+
+    database_name := t.TempDir() + "/test.db"
+    rules := []string{`regex:^(login|sso|auth)[-.].*\.example\.(com|net)$`, "glob:*paypa1*"}
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, database_name, rules, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor := c.getMonitors()[0]
+
+    err = monitor.buildDB()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for i, rule := range c.shared.getRules() {
+        var matched_name string
+        var rule_id int64
+        err = c.shared.database.QueryRow("SELECT matched_name, rule_id FROM certificates WHERE hostname = ?", rule.text).Scan(&matched_name, &rule_id)
+        if err != nil || rule_id != rule.id || rule.id != int64(i+1) {
+            t.Errorf("Row for %s was incorrect; got %s, rule %d, %v; want rule %d\n", rule.text, matched_name, rule_id, err, rule.id)
+        }
+    }
+
+    err = c.shared.addHostnames([]string{"good.example.com", "regex:(unclosed"})
+    if err == nil || len(c.shared.getRules()) != 2 {
+        t.Errorf("Invalid rule was not refused; got %v, %v\n", err, c.shared.getHostnames())
+    }
+
+// rules keep their ids across restarts with --no-delete, and can be removed by id
+    c, err = NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, database_name, []string{"glob:*paypa1*"}, false, true, false, true, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    if c.shared.getRules()[0].id != 2 {
+        t.Errorf("Rule id was not kept; got %d; want 2\n", c.shared.getRules()[0].id)
+    }
+    if c.shared.removeHostname("2") == nil || len(c.shared.getRules()) != 0 {
+        t.Errorf("Could not remove rule by id\n")
+    }
+
+}
+
+// test that internationalized names match rules given in either form, and are stored in both
+func Test_addEntries_IDN(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.addCertificate(t, "", "xn--mnchen-3ya.example")
+    fake_log.addCertificate(t, "shop.xn--bcher-kva.example")
+    fake_log.addCertificate(t, "munchen.example")
+    fake_log.publish()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"münchen.example"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+
+// the same rule in the other form isn't added twice
+    for _, hostname := range []string{"suffix:xn--bcher-kva.example", "xn--mnchen-3ya.example"} {
+        recorder := httptest.NewRecorder()
+        c.AddHostname(recorder, httptest.NewRequest("GET", "/Add?hostname=" + url.QueryEscape(hostname), nil))
+        if recorder.Code != http.StatusOK {
+            t.Fatalf("Adding %s failed; got %d, %s\n", hostname, recorder.Code, recorder.Body.String())
+        }
+    }
+    if len(c.shared.getRules()) != 2 {
+        t.Errorf("Hostname list was incorrect; got %v; want 2 rules\n", c.shared.getHostnames())
+    }
+
+    err = c.getMonitors()[0].buildDB()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+// certificates can be listed by either form of the rule
+    for _, hostname := range []string{"münchen.example", "xn--mnchen-3ya.example", "suffix:bücher.example"} {
+        if countCerts(t, c.shared, hostname) != 1 {
+            t.Errorf("Certificates for %s were incorrect; got %d; want 1\n", hostname, countCerts(t, c.shared, hostname))
+        }
+    }
+
+    var ascii, unicode_name string
+    err = c.shared.database.QueryRow("SELECT matched_name_ascii, matched_name_unicode FROM certificates WHERE hostname = ?", "suffix:xn--bcher-kva.example").Scan(&ascii, &unicode_name)
+    if err != nil || ascii != "shop.xn--bcher-kva.example" || unicode_name != "shop.bücher.example" {
+        t.Errorf("Stored names were incorrect; got %q, %q, %v; want %q, %q\n", ascii, unicode_name, err, "shop.xn--bcher-kva.example", "shop.bücher.example")
+    }
+
+}
+
+// test splitting names into registrable domains, with the built-in public suffix list and with one read from a file
+func Test_registrableDomain(t *testing.T) {
+
+    defer public_suffixes.Store((*publicSuffixList)(nil))
+    defer func() { PSL_FILE, PSL_RELOAD = "", 24 * time.Hour }()
+
+    cases := map[string]string{
+        "ttmail.npp.co.th": "npp.co.th",
+        "www.example.co.uk": "example.co.uk",
+        "*.Example.com.": "example.com",
+        "co.uk": "",
+        "192.0.2.1": "",
+        "admin@example.com": "",
+    }
+    for name, want := range cases {
+        got := registrableDomain(name)
+        if got != want {
+            t.Errorf("registrableDomain(%q) with the built-in list was incorrect; got %q; want %q\n", name, got, want)
+        }
+    }
+
+    PSL_FILE = t.TempDir() + "/public_suffix_list.dat"
+    PSL_RELOAD = 0
+    os.WriteFile(PSL_FILE, []byte("// a comment\nth\nco.th\n\n*.ck\n!www.ck\nmünchen.example\n"), 0644)
+    err := LoadPublicSuffixList()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cases = map[string]string{
+        "ttmail.npp.co.th": "npp.co.th",
+        "a.b.ck": "a.b.ck",
+        "x.www.ck": "www.ck",
+        "a.b.xn--mnchen-3ya.example": "b.xn--mnchen-3ya.example",
+        "www.example.co.uk": "co.uk",
+    }
+    for name, want := range cases {
+        got := registrableDomain(name)
+        if got != want {
+            t.Errorf("registrableDomain(%q) with %s was incorrect; got %q; want %q\n", name, PSL_FILE, got, want)
+        }
+    }
+
+// a reloaded list is used from then on
+    os.WriteFile(PSL_FILE, []byte("th\nco.th\nnpp.co.th\n"), 0644)
+    err = reloadPublicSuffixList()
+    if err != nil || registrableDomain("ttmail.npp.co.th") != "ttmail.npp.co.th" {
+        t.Errorf("Reloaded list was not used; got %q, %v\n", registrableDomain("ttmail.npp.co.th"), err)
+    }
+
+// an empty file isn't a list, and leaves the old one in place
+    os.WriteFile(PSL_FILE, []byte("// nothing\n"), 0644)
+    if reloadPublicSuffixList() == nil || registrableDomain("ttmail.npp.co.th") != "ttmail.npp.co.th" {
+        t.Errorf("Empty list was not refused\n")
+    }
+
+}
+
+// test registrable and keyword rules, and the record of the registrable domains they match
+func Test_addEntries_registrable(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.addCertificate(t, "ttmail.npp.co.th")
+    fake_log.addCertificate(t, "", "mail.npp.co.th", "npp.co.th")
+    fake_log.addCertificate(t, "login.paypal-secure.com")
+    fake_log.addCertificate(t, "paypal-secure.com")
+    fake_log.addCertificate(t, "paypal.com.evil.net")
+    fake_log.addPrecertificate(t, "", "shop.paypal-secure.com")
+    fake_log.publish()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"registrable:npp.co.th", "keyword:paypal"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    err = c.getMonitors()[0].buildDB()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for hostname, want := range map[string][2]int{"registrable:npp.co.th": {2, 1}, "keyword:paypal": {3, 1}} {
+        domains, err := c.shared.listRegistrableDomains(hostname)
+        if err != nil || countCerts(t, c.shared, hostname) != want[0] || len(domains) != want[1] {
+            t.Errorf("Results for %s were incorrect; got %d certificates, domains %v, %v; want %d, %d\n", hostname, countCerts(t, c.shared, hostname), domains, err, want[0], want[1])
+        }
+    }
+
+    var registrable_domain string
+    c.shared.database.QueryRow("SELECT registrable_domain FROM certificates WHERE matched_name = ?", "login.paypal-secure.com").Scan(&registrable_domain)
+    if registrable_domain != "paypal-secure.com" {
+        t.Errorf("Stored registrable domain was incorrect; got %q; want paypal-secure.com\n", registrable_domain)
+    }
+
+// a precertificate's row has its issuer key hash and validity
+    var issuer_key_hash string
+    var not_before int64
+    err = c.shared.database.QueryRow("SELECT issuer_key_hash, not_before FROM certificates WHERE logentrytype = 'PreCert'").Scan(&issuer_key_hash, &not_before)
+    if err != nil || len(issuer_key_hash) != 44 || not_before != 1700000000000 {
+        t.Errorf("PreCert row was incorrect; got %q, %d, %v\n", issuer_key_hash, not_before, err)
+    }
+
+}
+
+// test that PreCert entries are parsed from the leaf: the issuer key hash and the TBSCertificate, not the precertificate in extra_data
+func Test_getCertificate_precert(t *testing.T) {
+
+    leaf_input, extra_data, issuer_key_hash := makeTestPrecert(t, 1700000000000, "precert.example.com", []string{"www.precert.example.com"})
+    leaf, err := parseLeafInput(rawEntry{Leaf_input: base64.StdEncoding.EncodeToString(leaf_input), Extra_data: base64.StdEncoding.EncodeToString(extra_data)})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    precert, err := parsePrecertEntry(leaf)
+    if err != nil || string(precert.Issuer_key_hash) != string(issuer_key_hash) {
+        t.Errorf("Issuer key hash was incorrect; got %x, %v; want %x\n", precert.Issuer_key_hash, err, issuer_key_hash)
+    }
+
+    cert, err := getCertificate(leaf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    names := getNames(cert)
+    if strings.Join(names, " ") != "precert.example.com www.precert.example.com" || cert.NotBefore.Unix() != 1700000000 || cert.Issuer.CommonName != "Test CA" {
+        t.Errorf("Parsed TBSCertificate was incorrect; got %v, %v, %s\n", names, cert.NotBefore, cert.Issuer.CommonName)
+    }
+
+// the leaf is what counts, whatever extra_data says
+    leaf.Extra_data = ""
+    _, err = getCertificate(leaf)
+    if err != nil {
+        t.Errorf("PreCert entry without extra_data was not parsed; got %v\n", err)
+    }
+
+    leaf.Entry = base64.StdEncoding.EncodeToString(make([]byte, 40))
+    _, err = getCertificate(leaf)
+    if err == nil {
+        t.Errorf("Truncated PreCert entry was not refused\n")
+    }
+
+}
+
+// test parsing the chain in extra_data
+func Test_parseChain(t *testing.T) {
+
+    leaf_input, extra_data, _ := makeTestPrecert(t, 1700000000000, "precert.example.com", nil)
+    leaf, _ := parseLeafInput(rawEntry{Leaf_input: base64.StdEncoding.EncodeToString(leaf_input), Extra_data: base64.StdEncoding.EncodeToString(extra_data)})
+    precert, chain, err := parseChain(leaf)
+    if err != nil || len(chain) != 1 {
+        t.Fatalf("PreCert chain was incorrect; got %d certificates, %v; want 1\n", len(chain), err)
+    }
+    parsed, err := x509.ParseCertificate(precert)
+    if err != nil || parsed.Subject.CommonName != "precert.example.com" {
+        t.Errorf("Precertificate was incorrect; got %v\n", err)
+    }
+    issuers := getIssuers(leaf)
+    fingerprint := sha256.Sum256(chain[0])
+    if len(issuers) != 1 || issuers[0].subject != "CN=Test CA" || issuers[0].fingerprint != hex.EncodeToString(fingerprint[:]) {
+        t.Errorf("Issuers were incorrect; got %v\n", issuers)
+    }
+
+// an X509 entry's extra_data is just the chain
+    chain_length := 2*3 + len(chain[0]) + 2
+    x509_chain := []byte{byte(chain_length>>16), byte(chain_length>>8), byte(chain_length)}
+    for _, cert := range [][]byte{chain[0], {1, 2}} {
+        x509_chain = append(x509_chain, byte(len(cert)>>16), byte(len(cert)>>8), byte(len(cert)))
+        x509_chain = append(x509_chain, cert...)
+    }
+    leaf.LogEntryType = 0
+    leaf.Extra_data = base64.StdEncoding.EncodeToString(x509_chain)
+    precert, chain, err = parseChain(leaf)
+    if err != nil || precert != nil || len(chain) != 2 || len(getIssuers(leaf)) != 2 {
+        t.Errorf("X509 chain was incorrect; got %d certificates, %v\n", len(chain), err)
+    }
+
+    for _, invalid := range [][]byte{{}, {0, 0, 5, 0, 0}, {0, 0, 4, 0, 0, 9, 1}} {
+        leaf.Extra_data = base64.StdEncoding.EncodeToString(invalid)
+        _, _, err = parseChain(leaf)
+        if err == nil {
+            t.Errorf("Invalid chain %v was not refused\n", invalid)
+        }
+    }
+
+}
+
+// the extra_data of an X509 entry whose chain is 'certs'
+func makeTestChain(certs ...[]byte) []byte {
+
+    var chain []byte
+    for _, cert := range certs {
+        chain = append(chain, byte(len(cert)>>16), byte(len(cert)>>8), byte(len(cert)))
+        chain = append(chain, cert...)
+    }
+
+    return append([]byte{byte(len(chain)>>16), byte(len(chain)>>8), byte(len(chain))}, chain...)
+
+}
+
+// test that a malformed precertificate entry is skipped, and the entries after it are still searched
+func Test_addEntries_malformedPrecert(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+// a precertificate cut off partway through its TBSCertificate
+    leaf, extra_data, _ := makeTestPrecert(t, 1700000000000, "a.example.com", nil)
+    fake_log.addEntry(leaf[:12+32+3+16], extra_data)
+    fake_log.addPrecertificate(t, "b.example.com")
+    fake_log.publish()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"suffix:example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    err = c.getMonitors()[0].buildDB()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    certs, err := c.shared.listCerts("suffix:example.com", nil)
+    if err != nil || len(certs) != 1 || certs[0].common_name != "b.example.com" {
+        t.Errorf("Malformed precertificate was not skipped; got %v, %v\n", certs, err)
+    }
+
+}
+
+// test that each issuer is stored once, and linked to every certificate it's in the chain of
+func Test_addEntries_issuers(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.addPrecertificate(t, "a.example.com")
+    fake_log.addPrecertificate(t, "b.example.com")
+    fake_log.addCertificate(t, "c.example.com")
+// two certificates from different intermediates under the same root
+    root := makeTestIssuance(t, 1700000000000, "root", nil).cert_extra_data[6:]
+    for _, name := range []string{"d.example.com", "e.example.com"} {
+        issuance := makeTestIssuance(t, 1700000000000, name, nil)
+        fake_log.addEntry(issuance.cert_leaf, makeTestChain(issuance.cert_extra_data[6:], root))
+    }
+    fake_log.publish()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"suffix:example.com", "a.example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    err = c.getMonitors()[0].buildDB()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var count int
+    c.shared.database.QueryRow("SELECT COUNT(*) FROM issuers").Scan(&count)
+    issuers, err := c.shared.listIssuers("suffix:example.com")
+    root_fingerprint := sha256.Sum256(root)
+    if count != 5 || err != nil || len(issuers) != 5 {
+        t.Fatalf("Issuers were incorrect; got %d stored, %v, %v; want 5\n", count, issuers, err)
+    }
+    if issuers[0].fingerprint != hex.EncodeToString(root_fingerprint[:]) || issuers[0].position != 1 || issuers[0].certificates != 2 {
+        t.Errorf("Root was incorrect; got %v; want position 1 in 2 chains\n", issuers[0])
+    }
+    if issuers[1].position != 0 || issuers[1].certificates != 1 || issuers[1].subject != "CN=Test CA" {
+        t.Errorf("Issuer was incorrect; got %v; want position 0 in 1 chain\n", issuers[1])
+    }
+
+    var chain, issuer_sha256 string
+    c.shared.database.QueryRow("SELECT certificate_chains.sha256, certificates.issuer_sha256 FROM certificates JOIN certificate_chains ON certificate_chains.leaf_hash = certificates.leaf_hash AND certificate_chains.ctl = certificates.ctl WHERE hostname = 'a.example.com' AND position = 0").Scan(&chain, &issuer_sha256)
+    c.shared.database.QueryRow("SELECT COUNT(*) FROM issuers WHERE sha256 = ?", chain).Scan(&count)
+    if chain == "" || chain != issuer_sha256 || count != 1 {
+        t.Errorf("Certificate was not linked to its chain; got %q, %q\n", chain, issuer_sha256)
+    }
+
+}
+
+// test that a certificate's metadata is read from it
+func Test_getMetadata(t *testing.T) {
+
+    key, _ := rsa.GenerateKey(rand.Reader, 2048)
+    template := x509.Certificate{
+        SerialNumber: big.NewInt(0xabcdef),
+        Subject: pkix.Name{CommonName: "www.example.com", Organization: []string{"Example"}},
+        DNSNames: []string{"www.example.com", "example.com"},
+        IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+        NotBefore: time.Now(),
+        NotAfter: time.Now().Add(90 * 24 * time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        UnknownExtKeyUsage: []asn1.ObjectIdentifier{{1, 2, 3, 4}},
+        BasicConstraintsValid: true,
+        SubjectKeyId: []byte{1, 2, 3},
+        AuthorityKeyId: []byte{4, 5, 6},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, _ := x509.ParseCertificate(der)
+    fingerprint := sha256.Sum256(der)
+
+    got := getMetadata(cert, MerkleTreeLeaf{LogEntryType: 0})
+    want := certMetadata{sha256: hex.EncodeToString(fingerprint[:]), serial: "abcdef", issuer_dn: "CN=www.example.com,O=Example", subject_dn: "CN=www.example.com,O=Example", sans: "www.example.com,example.com,192.0.2.1", not_before: cert.NotBefore.UnixMilli(), not_after: cert.NotAfter.UnixMilli(), key_algorithm: "RSA", key_size: 2048, signature_algorithm: "SHA256-RSA", key_usage: "digitalSignature,keyEncipherment", ext_key_usage: "serverAuth,clientAuth,1.2.3.4", basic_constraints: "CA:FALSE", subject_key_id: "010203", authority_key_id: "040506"}
+    if got != want {
+        t.Errorf("Metadata was incorrect; got %+v; want %+v\n", got, want)
+    }
+
+// a CA with a path length constraint
+    template.IsCA = true
+    template.MaxPathLenZero = true
+    der, _ = x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+    cert, _ = x509.ParseCertificate(der)
+    if got := getMetadata(cert, MerkleTreeLeaf{LogEntryType: 0}).basic_constraints; got != "CA:TRUE,pathlen:0" {
+        t.Errorf("Basic constraints were incorrect; got %q; want CA:TRUE,pathlen:0\n", got)
+    }
+
+}
+
+// test that the metadata of matched certificates is stored, and that certificates can be listed by it
+func Test_listCerts_metadata(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.addCertificate(t, "a.example.com", "a.example.com", "www.a.example.com")
+    fake_log.addPrecertificate(t, "b.example.com")
+    fake_log.publish()
+
+    c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"suffix:example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    err = c.getMonitors()[0].buildDB()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rows, err := c.shared.listCerts("suffix:example.com", nil)
+    if err != nil || len(rows) != 2 {
+        t.Fatalf("Certificates were incorrect; got %v, %v; want 2\n", rows, err)
+    }
+    for _, row := range rows {
+        if len(row.metadata.sha256) != 64 || row.metadata.key_algorithm != "ECDSA" || row.metadata.not_after - row.metadata.not_before != (90 * 24 * time.Hour).Milliseconds() || row.metadata.key_size != 256 || row.leaf_index < 0 || row.leaf_index > 1 {
+            t.Errorf("Metadata was incorrect; got %+v, leaf index %d\n", row.metadata, row.leaf_index)
+        }
+    }
+
+    precert := rows[0]
+    if precert.logentrytype != "PreCert" {
+        precert = rows[1]
+    }
+    rows, err = c.shared.listCerts("suffix:example.com", map[string]string{"serial": precert.metadata.serial, "subject_dn": "CN=b.example.com"})
+    if err != nil || len(rows) != 1 || rows[0].common_name != "b.example.com" || rows[0].leaf_index != 1 {
+        t.Errorf("Certificates by serial were incorrect; got %v, %v; want b.example.com\n", rows, err)
+    }
+
+// both certificates may have been made in the same second, so only the precertificate's expiry is checked
+    rows, err = c.shared.listCerts("suffix:example.com", map[string]string{"not_after": strconv.FormatInt(precert.metadata.not_after, 10)})
+    found := false
+    for _, row := range rows {
+        found = found || row.common_name == "b.example.com"
+        if row.metadata.not_after != precert.metadata.not_after {
+            t.Errorf("Certificate listed by not_after has the wrong expiry; got %d; want %d\n", row.metadata.not_after, precert.metadata.not_after)
+        }
+    }
+    if err != nil || !found {
+        t.Errorf("Certificates by not_after were incorrect; got %v, %v; want b.example.com\n", rows, err)
+    }
+
+    _, err = c.shared.listCerts("suffix:example.com", map[string]string{"certificate": "x"})
+    if err == nil {
+        t.Errorf("Listing by a field that isn't metadata was allowed\n")
+    }
+
+    recorder := httptest.NewRecorder()
+    c.ListCertificates(recorder, mux.SetURLVars(httptest.NewRequest("GET", "/ListCertificates?hostname=suffix:example.com&sans=a.example.com,www.a.example.com", nil), map[string]string{"hostname": "suffix:example.com"}))
+    if body := recorder.Body.String(); !strings.Contains(body, "CN=a.example.com") || strings.Contains(body, "CN=b.example.com") {
+        t.Errorf("ListCertificates by SANs was incorrect; got %q\n", body)
+    }
+
+}
+
+// test that a precertificate and the certificate issued from it have the same canonical TBSCertificate
+func Test_canonicalTBS(t *testing.T) {
+
+    issuance := makeTestIssuance(t, 1700000000000, "a.example.com", []string{"a.example.com"})
+    leaf, _ := parseLeafInput(rawEntry{Leaf_input: base64.StdEncoding.EncodeToString(issuance.precert_leaf)})
+    precert, err := getCertificate(leaf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    leaf, _ = parseLeafInput(rawEntry{Leaf_input: base64.StdEncoding.EncodeToString(issuance.cert_leaf)})
+    cert, err := getCertificate(leaf)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if bytes.Equal(precert.RawTBSCertificate, cert.RawTBSCertificate) || tbsHash(precert) == "" || tbsHash(precert) != tbsHash(cert) {
+        t.Errorf("TBS hashes were incorrect; got %s and %s; want them equal\n", tbsHash(precert), tbsHash(cert))
+    }
+
+// a TBSCertificate without the two extensions is left as it is
+    tbs, err := canonicalTBS(precert.RawTBSCertificate)
+    if err != nil || !bytes.Equal(tbs, precert.RawTBSCertificate) {
+        t.Errorf("Canonical TBSCertificate was changed; got %v\n", err)
+    }
+
+// a different certificate for the same names doesn't match
+    other := makeTestIssuance(t, 1700000000000, "a.example.com", []string{"a.example.com"})
+    leaf, _ = parseLeafInput(rawEntry{Leaf_input: base64.StdEncoding.EncodeToString(other.cert_leaf)})
+    cert, _ = getCertificate(leaf)
+    if tbsHash(cert) == tbsHash(precert) {
+        t.Errorf("Different certificates had the same TBS hash\n")
+    }
+
+}
+
+// test that precertificates are linked to the certificates issued from them, across logs
+func Test_listIssuances(t *testing.T) {
+
+    issued := makeTestIssuance(t, 1700000000000, "a.example.com", nil)
+    unissued := makeTestIssuance(t, 1700000000000, "b.example.com", nil)
+    precert_log := newFakeLog(t)
+    precert_log.addEntry(issued.precert_leaf, issued.precert_extra_data)
+    precert_log.addEntry(unissued.precert_leaf, unissued.precert_extra_data)
+    precert_log.publish()
+    cert_log := newFakeLog(t)
+    cert_log.addEntry(makeTestX509Leaf(1700000090000, issued.cert), issued.cert_extra_data)
+    cert_log.publish()
+
+    c, err := NewController([]string{precert_log.url(), cert_log.url()}, []string{precert_log.publicKey(), cert_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"suffix:example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    for _, monitor := range c.getMonitors() {
+        err = monitor.buildDB()
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    rows, err := c.shared.listIssuances("suffix:example.com")
+    if err != nil || len(rows) != 2 {
+        t.Fatalf("Precertificates were incorrect; got %v, %v; want 2\n", rows, err)
+    }
+    if rows[0].common_name != "b.example.com" || rows[0].cert_timestamp != -1 {
+        t.Errorf("Unissued precertificate was incorrect; got %+v\n", rows[0])
+    }
+    if rows[1].common_name != "a.example.com" || rows[1].cert_timestamp != 1700000090000 || rows[1].cert_ctl == rows[1].precert_ctl {
+        t.Errorf("Issued precertificate was incorrect; got %+v\n", rows[1])
+    }
+
+    recorder := httptest.NewRecorder()
+    c.ListPrecertificates(recorder, mux.SetURLVars(httptest.NewRequest("GET", "/ListPrecertificates?hostname=suffix:example.com", nil), map[string]string{"hostname": "suffix:example.com"}))
+    if body := recorder.Body.String(); !strings.Contains(body, "b.example.com\tnot issued") || !strings.Contains(body, "a.example.com\tissued after 1m30s") {
+        t.Errorf("ListPrecertificates was incorrect; got %q\n", body)
+    }
+
+}
+
+// test that SCTs embedded in certificates are parsed and checked against the keys of the logs that issued them
+func Test_checkEmbeddedSCTs(t *testing.T) {
+
+    known := newFakeLog(t)
+    unknown := newFakeLog(t)
+    forger := newFakeLog(t)
+    shared := &sharedState{}
+    known_key, _ := loadLogKey(known.publicKey())
+    shared.addKnownLog("known/", known_key, time.Hour)
+// the forger's SCT claims to be from a log whose key it doesn't have
+    forged_key, _ := loadLogKey(forger.publicKey())
+    forged_key.public_key = known_key.public_key
+    shared.addKnownLog("forged/", forged_key, time.Hour)
+
+    issuance := makeTestIssuance(t, 1700000000000, "a.example.com", nil, known, unknown, forger)
+    cert, _ := x509.ParseCertificate(issuance.cert)
+    issuer_key_hash := base64.StdEncoding.EncodeToString(issuance.issuer_key_hash)
+
+    scts := shared.checkEmbeddedSCTs(cert, issuer_key_hash)
+    if len(scts) != 3 {
+        t.Fatalf("SCTs were incorrect; got %d; want 3\n", len(scts))
+    }
+    want := []string{SCT_VERIFIED, SCT_UNKNOWN_LOG, SCT_INVALID}
+    for i, sct := range scts {
+        if sct.status != want[i] || sct.Timestamp != 1700000000000 {
+            t.Errorf("SCT %d was incorrect; got %s at %d; want %s\n", i, sct.status, sct.Timestamp, want[i])
+        }
+    }
+    if scts[0].sct_ctl != "known/" || scts[1].sct_ctl != "" {
+        t.Errorf("SCT logs were incorrect; got %q and %q\n", scts[0].sct_ctl, scts[1].sct_ctl)
+    }
+
+// the leaf the log promised to add is the precertificate's
+    if !bytes.Equal(scts[0].entry_leaf_hash, leafHash(issuance.precert_leaf)) {
+        t.Errorf("SCT entry leaf hash was incorrect; got %x; want %x\n", scts[0].entry_leaf_hash, leafHash(issuance.precert_leaf))
+    }
+
+// without the issuer, nothing can be checked
+    scts = shared.checkEmbeddedSCTs(cert, "")
+    if len(scts) != 3 || scts[0].status != SCT_NO_ISSUER {
+        t.Errorf("SCTs without an issuer were incorrect; got %v\n", scts)
+    }
+
+    _, err := parseSCTList([]byte{4, 3, 0, 5, 1})
+    if err == nil {
+        t.Errorf("Truncated SCT list was parsed\n")
+    }
+
+}
+
+// test that the SCTs in matched certificates are stored, with the logs that issued them
+func Test_listSCTs(t *testing.T) {
+
+    cert_log := newFakeLog(t)
+    other_log := newFakeLog(t)
+    unknown_log := newFakeLog(t)
+    issuance := makeTestIssuance(t, 1700000000000, "a.example.com", nil, cert_log, other_log, unknown_log)
+    cert_log.addEntry(makeTestX509Leaf(1700000000000, issuance.cert), issuance.cert_extra_data)
+    cert_log.publish()
+
+    c, err := NewController([]string{cert_log.url(), other_log.url()}, []string{cert_log.publicKey(), other_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"suffix:example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    for _, monitor := range c.getMonitors() {
+        err = monitor.buildDB()
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    rows, err := c.shared.listSCTs("suffix:example.com")
+    if err != nil || len(rows) != 3 {
+        t.Fatalf("SCTs were incorrect; got %v, %v; want 3\n", rows, err)
+    }
+    statuses := make(map[string]int)
+    for _, row := range rows {
+        statuses[row.status] += 1
+        if row.common_name != "a.example.com" || row.timestamp != 1700000000000 {
+            t.Errorf("SCT was incorrect; got %+v\n", row)
+        }
+    }
+    if statuses[SCT_VERIFIED] != 2 || statuses[SCT_UNKNOWN_LOG] != 1 {
+        t.Errorf("SCT statuses were incorrect; got %v\n", statuses)
+    }
+
+    recorder := httptest.NewRecorder()
+    c.ListSCTs(recorder, mux.SetURLVars(httptest.NewRequest("GET", "/ListSCTs?hostname=suffix:example.com", nil), map[string]string{"hostname": "suffix:example.com"}))
+    if body := recorder.Body.String(); strings.Count(body, "\tverified\t") != 2 || !strings.Contains(body, "\tunknown_log\t") {
+        t.Errorf("ListSCTs was incorrect; got %q\n", body)
+    }
+
+}
+
+// test that SCTs are audited once their logs' maximum merge delay has passed, and that the ones a log hasn't included are overdue until it does
+func Test_auditSCTs(t *testing.T) {
+
+    cert_log := newFakeLog(t)
+    kept_log := newFakeLog(t)
+    broken_log := newFakeLog(t)
+    issuance := makeTestIssuance(t, 1700000000000, "a.example.com", nil, kept_log, broken_log)
+    cert_log.addEntry(makeTestX509Leaf(1700000000000, issuance.cert), issuance.cert_extra_data)
+    cert_log.publish()
+    kept_log.addEntry(issuance.precert_leaf, issuance.precert_extra_data)
+    kept_log.publish()
+    broken_log.addCertificate(t, "unrelated.example.org")
+    broken_log.publish()
+
+    max_retries := MAX_RETRIES
+    MAX_RETRIES = 0
+    defer func() { MAX_RETRIES = max_retries }()
+
+    c, err := NewController([]string{cert_log.url(), kept_log.url(), broken_log.url()}, []string{cert_log.publicKey(), kept_log.publicKey(), broken_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"a.example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    var broken *Monitor
+    for _, monitor := range c.getMonitors() {
+        if monitor.ctl_host == broken_log.url() {
+            broken = monitor
+        }
+    }
+    c.monitors[cert_log.url()].buildDB()
+
+// nothing is due until the maximum merge delay has passed
+    included, overdue := c.auditSCTs(time.UnixMilli(1700000000000))
+    if included != 0 || overdue != 0 {
+        t.Errorf("SCTs were audited early; got %d included, %d overdue\n", included, overdue)
+    }
+
+// a log that's failing to serve proofs hasn't said it doesn't have the leaf
+    broken_log.lock.Lock()
+    broken_log.proofs_unavailable = true
+    broken_log.lock.Unlock()
+    included, overdue = c.auditSCTs(time.Now())
+    if included != 1 || overdue != 0 {
+        t.Errorf("SCT audit was incorrect; got %d included, %d overdue; want 1 and 0\n", included, overdue)
+    }
+    var status string
+    c.shared.database.QueryRow("SELECT status FROM sct_audits WHERE sct_ctl = ?", kept_log.url()).Scan(&status)
+    if status != AUDIT_INCLUDED {
+        t.Errorf("Kept promise was incorrect; got %q; want included\n", status)
+    }
+    c.shared.database.QueryRow("SELECT status FROM sct_audits WHERE sct_ctl = ?", broken_log.url()).Scan(&status)
+    var metric dto.Metric
+    c.shared.request_failure_metrics.WithLabelValues(broken_log.url(), "http_status").Write(&metric)
+    if status != AUDIT_PENDING || metric.Counter.GetValue() != 1 {
+        t.Errorf("SCT from a log answering 503 was incorrect; got %q, %v request failures; want pending, 1\n", status, metric.Counter.GetValue())
+    }
+
+    broken_log.lock.Lock()
+    broken_log.proofs_unavailable = false
+    broken_log.lock.Unlock()
+    included, overdue = c.auditSCTs(time.Now())
+    if included != 0 || overdue != 1 {
+        t.Errorf("SCT audit was incorrect; got %d included, %d overdue; want 0 and 1\n", included, overdue)
+    }
+    c.shared.overdue_sct_metrics.WithLabelValues(broken_log.url()).Write(&metric)
+    if metric.GetGauge().GetValue() != 1 {
+        t.Errorf("Overdue SCT gauge was incorrect; got %v; want 1\n", metric.GetGauge().GetValue())
+    }
+
+// an SCT that's still overdue isn't new
+    included, overdue = c.auditSCTs(time.Now())
+    if included != 0 || overdue != 0 {
+        t.Errorf("SCT audit was repeated; got %d included, %d overdue\n", included, overdue)
+    }
+    rows, _ := c.shared.listOverdueSCTs()
+    if len(rows) != 1 || rows[0].sct_ctl != broken_log.url() || rows[0].due != 1700000000000 + uint64(DEFAULT_MMD / time.Millisecond) {
+        t.Errorf("Overdue SCTs were incorrect; got %v\n", rows)
+    }
+
+// the log includes it late
+    broken_log.addEntry(issuance.precert_leaf, issuance.precert_extra_data)
+    broken_log.publish()
+    broken.Check()
+    included, _ = c.auditSCTs(time.Now())
+    c.shared.overdue_sct_metrics.WithLabelValues(broken_log.url()).Write(&metric)
+    if included != 1 || metric.GetGauge().GetValue() != 0 {
+        t.Errorf("Late inclusion was incorrect; got %d included, gauge %v\n", included, metric.GetGauge().GetValue())
+    }
+
+// an SCT submitted by hand is audited the same way
+    recorder := httptest.NewRecorder()
+    c.SubmitSCT(recorder, httptest.NewRequest("GET", "/SubmitSCT?ctl=" + url.QueryEscape(kept_log.url()) + "&leaf_hash=" + url.QueryEscape(base64.StdEncoding.EncodeToString(make([]byte, 32))) + "&timestamp=1700000000000", nil))
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("SubmitSCT failed; got %d, %q\n", recorder.Code, recorder.Body.String())
+    }
+    _, overdue = c.auditSCTs(time.Now())
+    if overdue != 1 {
+        t.Errorf("Submitted SCT audit was incorrect; got %d overdue; want 1\n", overdue)
+    }
+
+    recorder = httptest.NewRecorder()
+    c.SubmitSCT(recorder, httptest.NewRequest("GET", "/SubmitSCT?ctl=https://unknown.example.com/&leaf_hash=&timestamp=1", nil))
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("SCT from a log that isn't monitored was accepted\n")
+    }
+
+}
+
+// serve a controller's GetSTHs over HTTP, so other controllers can gossip with it.  returns its URL
+func servePeer(t *testing.T, c *Controller) string {
+
+    router := mux.NewRouter()
+    router.HandleFunc("/GetSTHs", c.GetSTHs)
+    server := httptest.NewServer(router)
+    t.Cleanup(server.Close)
+
+    return server.URL + "/"
+
+}
+
+// test that tree heads from gossip peers are checked against the ones this instance was shown, and that a log showing a peer a different tree is caught
+func Test_gossip(t *testing.T) {
+
+    honest_log := newFakeLog(t)
+    honest_log.addCertificate(t, "a.example.com")
+    honest_log.addCertificate(t, "b.example.com")
+    honest_log.publish()
+// the same log, with the same key, showing another tree
+    forked_log := newFakeLog(t)
+    forked_log.key = honest_log.key
+    forked_log.addCertificate(t, "a.example.com")
+    forked_log.addCertificate(t, "evil.example.com")
+    forked_log.publish()
+
+    var controllers []*Controller
+    for _, ctl_host := range []string{honest_log.url(), honest_log.url(), forked_log.url()} {
+        c, err := NewController([]string{ctl_host}, []string{honest_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"example.com"}, false, true, false, false, false)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer c.shutdown()
+        controllers = append(controllers, c)
+    }
+    c, honest_peer, forked_peer := controllers[0], controllers[1], controllers[2]
+    c.gossip_peers = []string{servePeer(t, honest_peer), servePeer(t, forked_peer)}
+
+// each instance publishes the tree head it started from.  the same size must have the same root
+    checked, inconsistent := c.gossip()
+    if checked != 2 || inconsistent != 1 {
+        t.Errorf("Gossip of the same size was incorrect; got %d checked, %d inconsistent; want 2 and 1\n", checked, inconsistent)
+    }
+    rows, _ := c.shared.listPeerSTHs(GOSSIP_INCONSISTENT)
+    if len(rows) != 1 || rows[0].sth.Ctl != forked_log.url() || rows[0].peer != c.gossip_peers[1] {
+        t.Errorf("Inconsistent tree heads were incorrect; got %v\n", rows)
+    }
+
+// otherwise the log has to prove consistency, which it can't for the forked tree.  only the new tree heads are checked
+    honest_log.addCertificate(t, "c.example.com")
+    honest_log.publish()
+    forked_log.addCertificate(t, "c.example.com")
+    forked_log.publish()
+    for _, peer := range controllers[1:] {
+        peer.monitors[peer.getMonitors()[0].ctl_host].Check()
+    }
+    checked, inconsistent = c.gossip()
+    if checked != 2 || inconsistent != 1 {
+        t.Errorf("Gossip of a larger tree was incorrect; got %d checked, %d inconsistent; want 2 and 1\n", checked, inconsistent)
+    }
+    rows, _ = c.shared.listPeerSTHs(GOSSIP_CONSISTENT)
+    if len(rows) != 2 || rows[1].sth.Tree_size != 3 {
+        t.Errorf("Consistent tree heads were incorrect; got %v\n", rows)
+    }
+    var metric dto.Metric
+    c.shared.split_view_metrics.WithLabelValues(honest_log.url()).Write(&metric)
+    if metric.GetCounter().GetValue() != 2 {
+        t.Errorf("Split view metric was incorrect; got %v; want 2\n", metric.GetCounter().GetValue())
+    }
+
+// a tree head whose signature doesn't verify proves nothing about the log
+    sth := gossipSTH{Ctl: honest_log.url(), Signed_tree_head: honest_log.signedTreeHead()}
+    sth.Sha256_root_hash = base64.StdEncoding.EncodeToString(make([]byte, 32))
+    _, status, _ := c.checkPeerSTH(sth)
+    if status != GOSSIP_INVALID_SIGNATURE {
+        t.Errorf("Tree head with a bad signature was incorrect; got %q; want invalid_signature\n", status)
+    }
+
+// without the log's key, tree heads are neither published nor compared
+    keyless, err := NewController([]string{honest_log.url()}, nil, "", nil, t.TempDir() + "/test.db", []string{"example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer keyless.shutdown()
+    published, _ := keyless.shared.listVerifiedSTHs(0)
+    if len(published) != 0 {
+        t.Errorf("Unverified tree heads were published; got %v\n", published)
+    }
+    monitor, status, _ := keyless.checkPeerSTH(sth)
+    if status != GOSSIP_UNCHECKED || monitor == nil || monitor.ctl_host != honest_log.url() {
+        t.Errorf("Tree head for a log with no key was incorrect; got %q; want unchecked\n", status)
+    }
+
+}
+
+// test that every signed tree head fetched is kept, with what checking it found, whether it was adopted or not
+func Test_listSTHHistory(t *testing.T) {
+
+    f := newFakeLog(t)
+    f.addCertificate(t, "a.example.com")
+    f.publish()
+
+    c, err := NewController([]string{f.url()}, []string{f.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor := c.monitors[f.url()]
+
+// the log grows
+    f.addCertificate(t, "b.example.com")
+    f.addCertificate(t, "c.example.com")
+    f.publish()
+    time.Sleep(2 * time.Millisecond)
+    monitor.Check()
+
+// then signs with another key
+    key := f.key
+    f.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    monitor.Check()
+    f.key = key
+
+// then rewrites its history
+    f.lock.Lock()
+    f.leaves[0] = makeTestX509Leaf(1700000000000, makeTestCertificate(t, "evil.example.com", nil))
+    f.lock.Unlock()
+    f.addCertificate(t, "d.example.com")
+    f.publish()
+    monitor.Check()
+
+    rows, err := c.shared.listSTHHistory(f.url(), 0, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := [][2]string{{STH_VERIFIED, STH_INCONSISTENT}, {STH_INVALID, STH_UNCHECKED}, {STH_VERIFIED, STH_CONSISTENT}, {STH_VERIFIED, STH_UNCHECKED}}
+    if len(rows) != len(want) {
+        t.Fatalf("History was incorrect; got %v\n", rows)
+    }
+    for i, row := range rows {
+        if row.verification != want[i][0] || row.consistency != want[i][1] || (row.err == "") != (i >= 2) {
+            t.Errorf("History entry %d was incorrect; got %v; want %v\n", i, row, want[i])
+        }
+    }
+    if rows[2].sth.Tree_size != 3 || rows[3].sth.Tree_size != 1 {
+        t.Errorf("History tree sizes were incorrect; got %d and %d; want 3 and 1\n", rows[2].sth.Tree_size, rows[3].sth.Tree_size)
+    }
+
+// only the tree heads that were adopted are published to gossip peers
+    published, _ := c.shared.listVerifiedSTHs(0)
+    if len(published) != 2 {
+        t.Errorf("Published tree heads were incorrect; got %v\n", published)
+    }
+
+    var metric dto.Metric
+    c.shared.sth_growth_rate_metrics.WithLabelValues(f.url()).Write(&metric)
+    if metric.GetGauge().GetValue() <= 0 {
+        t.Errorf("Growth rate was incorrect; got %v\n", metric.GetGauge().GetValue())
+    }
+    c.shared.sth_age_metrics.WithLabelValues(f.url()).Write(&metric)
+    if metric.GetGauge().GetValue() <= 0 {
+        t.Errorf("Tree head age was incorrect; got %v\n", metric.GetGauge().GetValue())
+    }
+
+    recorder := httptest.NewRecorder()
+    c.ListSTHHistory(recorder, mux.SetURLVars(httptest.NewRequest("GET", "/ListSTHHistory?until=0", nil), map[string]string{"ctl": f.url()}))
+    if strings.Count(recorder.Body.String(), "\n") != 5 || !strings.Contains(recorder.Body.String(), STH_INCONSISTENT) {
+        t.Errorf("ListSTHHistory was incorrect; got %q\n", recorder.Body.String())
+    }
+    recorder = httptest.NewRecorder()
+    c.ListSTHHistory(recorder, mux.SetURLVars(httptest.NewRequest("GET", "/ListSTHHistory?since=yesterday", nil), map[string]string{"ctl": f.url()}))
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("Invalid since was accepted\n")
+    }
+
+}
+
+// test that a consistency proof the log garbles is a failed request, not an inconsistent log
+func Test_Check_garbledProof(t *testing.T) {
+
+    f := newFakeLog(t)
+    f.addCertificate(t, "a.example.com")
+    f.publish()
+
+    c, err := NewController([]string{f.url()}, []string{f.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"example.com"}, false, true, false, false, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.shutdown()
+    monitor := c.monitors[f.url()]
+
+    f.addCertificate(t, "b.example.com")
+    f.publish()
+    f.garbled_proofs = true
+    err = monitor.Check()
+    if errorKind(err) != "decode" {
+        t.Errorf("Garbled proof error was incorrect; got %v (%s); want a decode error\n", err, errorKind(err))
+    }
+    rows, _ := c.shared.listSTHHistory(f.url(), 0, 0)
+    if len(rows) != 2 || rows[0].consistency != STH_UNCHECKED {
+        t.Errorf("History was incorrect; got %v\n", rows)
+    }
+    var metric dto.Metric
+    c.shared.consistency_failure_metrics.WithLabelValues(f.url()).Write(&metric)
+    if metric.GetCounter().GetValue() != 0 {
+        t.Errorf("Garbled proof was counted as a consistency failure\n")
+    }
+    c.shared.request_failure_metrics.WithLabelValues(f.url(), "decode").Write(&metric)
+    if metric.GetCounter().GetValue() != 1 {
+        t.Errorf("Garbled proof was not counted as a failed request; got %v\n", metric.GetCounter().GetValue())
+    }
+
+}
+
+// test that the compiled matcher agrees with trying every rule
+func Test_compileRules(t *testing.T) {
+
+    var rules []*watchRule
+    for _, text := range []string{"www.example.com", "api.example.com", "*.example.net", ".corp.example.org", "suffix:example.co.uk", "exact:admin@example.com", "exact:*.wild.example.com", "glob:*paypa1*", "glob:login?.*", "glob:*", `regex:^(login|sso|auth)[-.].*\.example\.(com|net)$`, "regex:paypal-[0-9]+", "regex:(?i)BANK", "example.com", "münchen.example", "glob:*bücher*", "registrable:npp.co.th", "keyword:paypal"} {
+        rule, err := parseRule(text)
+        if err != nil {
+            t.Fatal(err)
+        }
+        rule.id = int64(len(rules) + 1)
+        rules = append(rules, rule)
+    }
+
+    names := [][]string{
+        {"www.example.com"},
+        {"WWW.Example.com."},
+        {"*.example.com"},
+        {"a.b.example.net", "example.net"},
+        {"corp.example.org", "x.corp.example.org"},
+        {"example.co.uk", "www.example.co.uk", "badexample.co.uk"},
+        {"admin@example.com", "192.0.2.1"},
+        {"a.wild.example.com", "*.wild.example.com"},
+        {"secure-paypa1.com", "login1.example.com", "sso.x.example.com"},
+        {"paypal-123.net", "mybank.com"},
+        {"example.com", "sub.example.com"},
+        {"unrelated.org"},
+        {"xn--mnchen-3ya.example", "www.xn--bcher-kva.example"},
+        {"*.MÜNCHEN.example", "bücher.example"},
+        {"ttmail.npp.co.th", "paypal-login.co.uk"},
+        {},
+    }
+
+    for _, subdomains := range []bool{false, true} {
+        matcher := compileRules(rules, subdomains)
+        for _, list := range names {
+            want := matchRules(rules, list, subdomains)
+            got := matcher.match(list)
+            if len(got) != len(want) {
+                t.Errorf("Matching %v (subdomains %v) was incorrect; got %v; want %v\n", list, subdomains, got, want)
+                continue
+            }
+            for i := range got {
+                if got[i] != want[i] {
+                    t.Errorf("Matching %v (subdomains %v) was incorrect; got %v; want %v\n", list, subdomains, got, want)
+                }
+            }
+        }
+    }
+
+}
+
+// test finding names that look like a watched domain
+func Test_detectLookalike(t *testing.T) {
+
+    var rules []*watchRule
+    for _, text := range []string{"paypal.com", "www.example.org", "suffix:bank.co", "glob:*secure*"} {
+        rule, err := parseRule(text)
+        if err != nil {
+            t.Fatal(err)
+        }
+        rules = append(rules, rule)
+    }
+    brands := lookalikeBrands(rules)
+
+    tests := []struct {
+        name string
+        brand string
+        reason string
+    }{
+        {"xn--pypal-4ve.com", "paypal.com", "homoglyph"},
+        {"paypa1.com", "paypal.com", "homoglyph"},
+        {"login.paypa1.com", "paypal.com", "homoglyph"},
+        {"xn--pypal-4ve.net", "paypal.com", "homoglyph+tld_swap"},
+        {"paypal.net", "paypal.com", "tld_swap"},
+        {"*.paypal.co.uk", "paypal.com", "tld_swap"},
+        {"paypa1.co.uk", "paypal.com", "homoglyph+tld_swap"},
+        {"paypla.com", "paypal.com", "swapped_characters"},
+        {"payypal.com", "paypal.com", "duplicated_character"},
+        {"paypak.com", "paypal.com", "keyboard_typo"},
+        {"paypl.com", "paypal.com", "omitted_character"},
+        {"paypal1.com", "paypal.com", "inserted_character"},
+        {"www.exaqple.org", "www.example.org", "substituted_character"},
+        {"ww.exampel.org", "www.example.org", "edit_distance_2"},
+        {"bamk.co", "bank.co", "keyboard_typo"},
+        {"bank.co", "", ""},
+        {"paypal.com", "", ""},
+        {"api.example.org", "", ""},
+        {"paypal.com.evil.net", "", ""},
+        {"paypal-secure.com", "", ""},
+        {"192.0.2.1", "", ""},
+        {"admin@paypa1.com", "", ""},
+    }
+
+    for _, test := range tests {
+        found, ok := detectLookalike(test.name, brands)
+        if !ok {
+            if test.brand != "" {
+                t.Errorf("detectLookalike(%s) found nothing; want %s, %s\n", test.name, test.brand, test.reason)
+            }
+            continue
+        }
+        if found.brand.domain != test.brand || found.reason != test.reason || found.score <= 0 || found.score > 1 {
+            t.Errorf("detectLookalike(%s) was incorrect; got %s, %s, score %v; want %s, %s\n", test.name, found.brand.domain, found.reason, found.score, test.brand, test.reason)
+        }
+    }
+
+}
+
+// test that addEntries stores lookalikes in their own table, and only when asked to
+func Test_addEntries_lookalikes(t *testing.T) {
+
+    fake_log := newFakeLog(t)
+    fake_log.addCertificate(t, "paypal.com")
+    fake_log.addCertificate(t, "xn--pypal-4ve.com")
+    fake_log.addCertificate(t, "", "www.paypa1.com", "paypa1.com")
+    fake_log.addCertificate(t, "other.org")
+    fake_log.publish()
+
+    for _, detect := range []bool{false, true} {
+        DETECT_LOOKALIKES = detect
+        c, err := NewController([]string{fake_log.url()}, []string{fake_log.publicKey()}, "", nil, t.TempDir() + "/test.db", []string{"paypal.com"}, false, true, false, false, false)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer c.shutdown()
+        err = c.getMonitors()[0].buildDB()
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        want := 0
+        if detect {
+            want = 3
+        }
+        var count int
+        c.shared.database.QueryRow("SELECT COUNT(*) FROM lookalikes").Scan(&count)
+        if count != want || countCerts(t, c.shared, "paypal.com") != 1 {
+            t.Errorf("Lookalikes with detection %v were incorrect; got %d lookalikes, %d certificates; want %d, 1\n", detect, count, countCerts(t, c.shared, "paypal.com"), want)
+        }
+
+        if detect {
+            var unicode_name, reason string
+            c.shared.database.QueryRow("SELECT unicode_name, reason FROM lookalikes WHERE name = ?", "xn--pypal-4ve.com").Scan(&unicode_name, &reason)
+            if unicode_name != "p\u0430ypal.com" || reason != "homoglyph" {
+                t.Errorf("Lookalike row was incorrect; got %q, %s; want %q, homoglyph\n", unicode_name, reason, "p\u0430ypal.com")
+            }
+        }
+    }
+    DETECT_LOOKALIKES = false
+
+}
+
+// benchmark matching a certificate's names against hostname lists of increasing size.  the time per entry should stay about the same
+func Benchmark_ruleMatcher(b *testing.B) {
+
+    names := []string{"www.shop-example.org", "mail.shop-example.org", "*.cdn.shop-example.org"}
+
+    for _, size := range []int{10, 1000, 40000} {
+        var rules []*watchRule
+        for i := 0; i < size; i++ {
+            var text string
+            switch i % 4 {
+            case 0:
+                text = "brand" + strconv.Itoa(i) + ".com"
+            case 1:
+                text = "suffix:brand" + strconv.Itoa(i) + ".co.uk"
+            case 2:
+                text = "glob:*brand" + strconv.Itoa(i) + "-login*"
+            case 3:
+                text = "regex:brand" + strconv.Itoa(i) + "[0-9]+\\.net$"
+            }
+            rule, _ := parseRule(text)
+            rule.id = int64(i)
+            rules = append(rules, rule)
+        }
+        matcher := compileRules(rules, false)
+
+        b.Run(strconv.Itoa(size), func(b *testing.B) {
+            for i := 0; i < b.N; i++ {
+                matcher.match(names)
+            }
+        })
+    }
+
+}
@@ -4,15 +4,17 @@ package ctl_monitor_lib
 import "crypto/x509"
 import "net/http"
 import "log"
-import "io/ioutil"
-import "encoding/json"
+import "fmt"
 import "strconv"
 import "encoding/base64"
 import "encoding/binary"
+import "encoding/asn1"
 import "errors"
 
 var GET_STH string = "ct/v1/get-sth"
 var GET_ENTRIES string = "ct/v1/get-entries"
+var GET_STH_CONSISTENCY string = "ct/v1/get-sth-consistency"
+var GET_PROOF_BY_HASH string = "ct/v1/get-proof-by-hash"
 var LOG_ENTRY_TYPE_MAP map[uint16]string = map[uint16]string{0: "X509", 1: "PreCert"}
 
 type Signed_tree_head struct {
@@ -31,6 +33,15 @@ type getEntriesResponse struct {
     Entries []rawEntry
 }
 
+type getSTHConsistencyResponse struct {
+    Consistency []string
+}
+
+type getProofByHashResponse struct {
+    Leaf_index uint64
+    Audit_path []string
+}
+
 type MerkleTreeLeaf struct {
     Version uint8
     MerkleLeafType uint8
@@ -45,6 +56,13 @@ type certificate struct {
     CertData []byte
 }
 
+// the entry of a PreCert leaf (RFC 6962 section 3.2): the SHA-256 hash of the issuer's public key, then the length-prefixed TBSCertificate of the precertificate, with the poison extension removed.  this is what the log committed to
+type precertificate struct {
+    Issuer_key_hash []byte
+    Length uint32
+    TBSCertificate []byte
+}
+
 // parse the first three bytes of a byte array as a uint32
 func threeByteToUint32(bytes []byte) uint32 {
     padded_length := make([]byte,4)
@@ -53,19 +71,11 @@ func threeByteToUint32(bytes []byte) uint32 {
 
 }
 
-// get entries from ctl_host between start and end (inclusive).  throws a fatal error if called with an invalid CT log url, or for an invalid range, or if there is a network problem
-func getEntries(ctl_host string, start uint64, end uint64) []rawEntry {
+// get entries from ctl_host between start and end (inclusive).  returns an error if called with an invalid range, or if a request still fails after retrying (see getJSON)
+func getEntries(ctl_host string, start uint64, end uint64, done <-chan struct{}) ([]rawEntry, error) {
 
-    if start < 0 || end < 0 {
-        log.Fatalln("Invalid range: start and end must be at least 0")
-    }
     if start > end {
-        log.Fatalln("Invalid range: start must be at most end")
-    }
-
-    req, err := http.NewRequest("GET", ctl_host + GET_ENTRIES, nil)
-    if err != nil {
-	log.Fatalln(err)
+        return nil, errors.New("Invalid range: start must be at most end")
     }
 
 // initialize an empty list of entries retrieved
@@ -74,59 +84,66 @@ func getEntries(ctl_host string, start uint64, end uint64) []rawEntry {
 // the RFC allows CT logs to only return a few entries at a time, so we keep making requests
     for start <= end {
 
-// the url to request entries between START and END (inclusive) is https://<log server>/ct/v1/get-entries?start=START&end=END, so we build it with req.URL.Query()
-        q := req.URL.Query()
-        q.Add("start", strconv.FormatUint(start,10))
-        q.Add("end", strconv.FormatUint(end,10))
-        req.URL.RawQuery = q.Encode()
-
-        resp, err := http.Get(req.URL.String())
+        entries, err := getEntriesOnce(ctl_host, start, end, done)
         if err != nil {
-            log.Fatalln(err)
+            return all_entries_received, err
         }
-        defer resp.Body.Close()
-
-        body, err := ioutil.ReadAll(resp.Body)
-        if err != nil {
-	    log.Fatalln(err)
-        }
-
-// for some reason, go won't unmarshal data into an array of structs, but will unmarshal data into an auxiliary struct whose data is an array of structs
-        var entry_array getEntriesResponse
-        err = json.Unmarshal(body, &entry_array)
-        if err != nil {
-            log.Fatalln("getEntries", start, end, err)
+        if len(entries) == 0 {
+            return all_entries_received, &DecodeError{Url: ctl_host + GET_ENTRIES, Err: fmt.Errorf("no entries returned between %d and %d", start, end)}
         }
 
 // append entries received to our list
-        all_entries_received = append(all_entries_received, entry_array.Entries...)
+        all_entries_received = append(all_entries_received, entries...)
 
-        start += uint64(len(entry_array.Entries))
+        start += uint64(len(entries))
     }
 
-    return all_entries_received
+    return all_entries_received, nil
 
 }
 
+// make a single get-entries request for the entries between start and end (inclusive).  the log may return fewer entries than requested, but never more
+func getEntriesOnce(ctl_host string, start uint64, end uint64, done <-chan struct{}) ([]rawEntry, error) {
 
-// get the signed tree head.  throws a fatal error if the CT log url is invalid, or there is a network issue
-func getSTH(ctl_host string) (Signed_tree_head, error) {
-    
-    var sth Signed_tree_head
+    if start > end {
+        return nil, errors.New("Invalid range: start must be at most end")
+    }
 
-    resp, err := http.Get(ctl_host + GET_STH)
+    req, err := http.NewRequest("GET", ctl_host + GET_ENTRIES, nil)
     if err != nil {
-	return sth, err
+	return nil, err
     }
-    defer resp.Body.Close()
 
-    body, err := ioutil.ReadAll(resp.Body)
+// the url to request entries between START and END (inclusive) is https://<log server>/ct/v1/get-entries?start=START&end=END, so we build it with req.URL.Query()
+    q := req.URL.Query()
+    q.Add("start", strconv.FormatUint(start,10))
+    q.Add("end", strconv.FormatUint(end,10))
+    req.URL.RawQuery = q.Encode()
+
+// for some reason, go won't unmarshal data into an array of structs, but will unmarshal data into an auxiliary struct whose data is an array of structs
+    var entry_array getEntriesResponse
+    err = getJSON(req.URL.String(), &entry_array, done)
     if err != nil {
-	return sth, err
+	return nil, err
     }
 
+// a log that ignores 'end' and returns too much is only trusted for what we asked for
+    if uint64(len(entry_array.Entries)) > end-start+1 {
+        entry_array.Entries = entry_array.Entries[:end-start+1]
+    }
+
+    return entry_array.Entries, nil
+
+}
+
+
+// get the signed tree head.  returns an error if the CT log url is invalid, or the request still fails after retrying
+func getSTH(ctl_host string, done <-chan struct{}) (Signed_tree_head, error) {
+    
+    var sth Signed_tree_head
+
 // use json to unmarshal the response into the appropriate form
-    err = json.Unmarshal(body, &sth)
+    err := getJSON(ctl_host + GET_STH, &sth, done)
     if err != nil {
 	return sth, err
     }
@@ -135,6 +152,60 @@ func getSTH(ctl_host string) (Signed_tree_head, error) {
 
 }
 
+// get a consistency proof between the trees of size 'first' and 'second'.  returns the decoded list of node hashes.  a hash that can't be decoded is the log's fault, like any other response that can't be, so it's a *DecodeError
+func getSTHConsistency(ctl_host string, first uint64, second uint64, done <-chan struct{}) ([][]byte, error) {
+
+    req, err := http.NewRequest("GET", ctl_host + GET_STH_CONSISTENCY, nil)
+    if err != nil {
+	return nil, err
+    }
+    q := req.URL.Query()
+    q.Add("first", strconv.FormatUint(first,10))
+    q.Add("second", strconv.FormatUint(second,10))
+    req.URL.RawQuery = q.Encode()
+
+    var proof getSTHConsistencyResponse
+    err = getJSON(req.URL.String(), &proof, done)
+    if err != nil {
+	return nil, err
+    }
+
+    hashes, err := decodeHashes(proof.Consistency)
+    if err != nil {
+	return nil, &DecodeError{Url: req.URL.String(), Err: err}
+    }
+
+    return hashes, nil
+
+}
+
+// get an inclusion proof for the leaf with hash 'leaf_hash' in the tree of size 'tree_size'.  returns the index of the leaf and the decoded audit path
+func getProofByHash(ctl_host string, leaf_hash []byte, tree_size uint64, done <-chan struct{}) (uint64, [][]byte, error) {
+
+    req, err := http.NewRequest("GET", ctl_host + GET_PROOF_BY_HASH, nil)
+    if err != nil {
+	return 0, nil, err
+    }
+    q := req.URL.Query()
+    q.Add("hash", base64.StdEncoding.EncodeToString(leaf_hash))
+    q.Add("tree_size", strconv.FormatUint(tree_size,10))
+    req.URL.RawQuery = q.Encode()
+
+    var proof getProofByHashResponse
+    err = getJSON(req.URL.String(), &proof, done)
+    if err != nil {
+	return 0, nil, err
+    }
+
+    audit_path, err := decodeHashes(proof.Audit_path)
+    if err != nil {
+	return 0, nil, &DecodeError{Url: req.URL.String(), Err: err}
+    }
+
+    return proof.Leaf_index, audit_path, nil
+
+}
+
 // take an entry and parse it as a MerkleTreeLeaf.  it's base64-encoded, so decode and parse "by hand".  the MerkleTreeLeaf.Entry field will require further processing
 func parseLeafInput(entry rawEntry) (MerkleTreeLeaf, error) {
 
@@ -193,7 +264,7 @@ func parseCertEntry(leaf MerkleTreeLeaf) (certificate, error) {
         cert_bytes = binary_decode
         
     case 1:
-// we have a precert entry; there are 32 bytes at the start of the extra_data field giving the length
+// we have a precert entry.  the precertificate the log was given (poisoned, and signed by the issuer) is the first certificate in the extra_data field, with 3 bytes at the start giving the length.  what the log committed to is in the entry itself; see parsePrecertEntry
         binary_decode, err := base64.StdEncoding.DecodeString(leaf.Extra_data)
         if err != nil {
 	    log.Println(err)
@@ -223,21 +294,189 @@ func parseCertEntry(leaf MerkleTreeLeaf) (certificate, error) {
 
 }
 
-// parse the DER-encoded byte sequence, and extract the commonname field.  returns the error of either parsing the leaf.Entry/leaf.Extra_data field, or of parsing the DER-encoded bytes
+// parse the MerkleTreeLeaf.Entry field of a PreCert leaf: 32 bytes of issuer key hash, then 3 bytes giving the length of the TBSCertificate, then the TBSCertificate itself, then the extensions
+func parsePrecertEntry(leaf MerkleTreeLeaf) (precertificate, error) {
+
+    var precert precertificate
+
+    if leaf.LogEntryType != 1 {
+        return precert, errors.New("Not a PreCert entry")
+    }
+    binary_decode, err := base64.StdEncoding.DecodeString(leaf.Entry)
+    if err != nil {
+        return precert, err
+    }
+    if len(binary_decode) < 32+3 {
+        return precert, errors.New("Invalid precertificate entry: too short")
+    }
+
+    precert.Issuer_key_hash = binary_decode[:32]
+    precert.Length = threeByteToUint32(binary_decode[32:35])
+    if uint32(len(binary_decode)) < precert.Length+35 {
+        return precert, errors.New("Invalid precertificate entry: too short")
+    }
+    precert.TBSCertificate = binary_decode[35:precert.Length+35]
+
+    return precert, nil
+
+}
+
+// parse the extra_data field of an entry: for an X509 entry, the chain of certificates from the one that issued it up to a root; for a PreCert entry, the precertificate the log was given, then that chain.  every certificate, and the chain as a whole, is prefixed with its length in 3 bytes.  returns the precertificate (nil for an X509 entry) and the DER-encoded certificates of the chain
+func parseChain(leaf MerkleTreeLeaf) ([]byte, [][]byte, error) {
+
+    binary_decode, err := base64.StdEncoding.DecodeString(leaf.Extra_data)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var precert []byte
+    if leaf.LogEntryType == 1 {
+        precert, binary_decode, err = readLengthPrefixed(binary_decode)
+        if err != nil {
+            return nil, nil, fmt.Errorf("Invalid precertificate chain: %v", err)
+        }
+    }
+
+    chain_bytes, _, err := readLengthPrefixed(binary_decode)
+    if err != nil {
+        return nil, nil, fmt.Errorf("Invalid certificate chain: %v", err)
+    }
+    var chain [][]byte
+    for len(chain_bytes) > 0 {
+        var cert []byte
+        cert, chain_bytes, err = readLengthPrefixed(chain_bytes)
+        if err != nil {
+            return nil, nil, fmt.Errorf("Invalid certificate chain: %v", err)
+        }
+        chain = append(chain, cert)
+    }
+
+    return precert, chain, nil
+
+}
+
+// split off a value prefixed with its length in 3 bytes.  returns the value and what follows it
+func readLengthPrefixed(data []byte) ([]byte, []byte, error) {
+
+    if len(data) < 3 {
+        return nil, nil, errors.New("too short")
+    }
+    length := threeByteToUint32(data[0:3])
+    if uint32(len(data)) < length+3 {
+        return nil, nil, errors.New("too short")
+    }
+
+    return data[3:length+3], data[length+3:], nil
+
+}
+
+// parse a DER-encoded TBSCertificate.  the x509 package only parses whole certificates, so the TBSCertificate is wrapped in one, with the signature algorithm it names (the two have to agree) and an empty signature
+func parseTBSCertificate(tbs []byte) (*x509.Certificate, error) {
+
+    var sequence asn1.RawValue
+    rest, err := asn1.Unmarshal(tbs, &sequence)
+    if err != nil {
+        return nil, err
+    }
+    if len(rest) > 0 || sequence.Class != asn1.ClassUniversal || sequence.Tag != asn1.TagSequence {
+        return nil, errors.New("Invalid TBSCertificate")
+    }
+
+// the version is optional, and tagged [0] if it's there.  then come the serial number and the signature algorithm
+    var field asn1.RawValue
+    fields, err := asn1.Unmarshal(sequence.Bytes, &field)
+    if err == nil && field.Class == asn1.ClassContextSpecific && field.Tag == 0 {
+        fields, err = asn1.Unmarshal(fields, &field)
+    }
+    var algorithm asn1.RawValue
+    if err == nil {
+        _, err = asn1.Unmarshal(fields, &algorithm)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("Invalid TBSCertificate: %v", err)
+    }
+
+    wrapped, err := asn1.Marshal(struct {
+        TBSCertificate asn1.RawValue
+        SignatureAlgorithm asn1.RawValue
+        Signature asn1.BitString
+    }{asn1.RawValue{FullBytes: tbs}, asn1.RawValue{FullBytes: algorithm.FullBytes}, asn1.BitString{}})
+    if err != nil {
+        return nil, err
+    }
+
+    return x509.ParseCertificate(wrapped)
+
+}
+
+// parse the DER-encoded byte sequence, and extract the commonname field.  returns the error of either parsing the leaf.Entry field, or of parsing the DER-encoded bytes
 func getCommonname(leaf_input MerkleTreeLeaf) (string, error) {
 
+    decoded_cert, err := getCertificate(leaf_input)
+    if err != nil {
+        return "", err
+    }
+
+    return decoded_cert.Subject.CommonName, nil
+
+}
+
+// parse the certificate in a leaf.  for a PreCert entry, this is the TBSCertificate the log committed to, so it has no signature.  returns the error of either parsing the leaf.Entry field, or of parsing the DER-encoded bytes
+func getCertificate(leaf_input MerkleTreeLeaf) (*x509.Certificate, error) {
+
+    if leaf_input.LogEntryType == 1 {
+        precert, err := parsePrecertEntry(leaf_input)
+        if err != nil {
+            log.Println(err)
+            return nil, err
+        }
+        decoded_cert, err := parseTBSCertificate(precert.TBSCertificate)
+        if err != nil {
+            log.Println(err)
+            return nil, err
+        }
+        return decoded_cert, nil
+    }
+
     cert, err := parseCertEntry(leaf_input)
     if err != nil {
         log.Println(err)
-        return "", err
+        return nil, err
     }
-    asn_der := cert.CertData
-    decoded_cert, err2 := x509.ParseCertificate(asn_der)
+    decoded_cert, err := x509.ParseCertificate(cert.CertData)
     if err != nil {
         log.Println(err)
-        return "", err2
+        return nil, err
     }
 
-    return decoded_cert.Subject.CommonName, nil
+    return decoded_cert, nil
+
+}
+
+// every name a certificate covers: the subject commonname (if there is one), then the DNS names, IP addresses, email addresses and URIs from the Subject Alternative Name extension.  each name appears once
+func getNames(cert *x509.Certificate) []string {
+
+    var names []string
+    add := func(name string) {
+        if name != "" && index(names, name) == -1 {
+            names = append(names, name)
+        }
+    }
+
+    add(cert.Subject.CommonName)
+    for _, name := range cert.DNSNames {
+        add(name)
+    }
+    for _, ip := range cert.IPAddresses {
+        add(ip.String())
+    }
+    for _, email := range cert.EmailAddresses {
+        add(email)
+    }
+    for _, uri := range cert.URIs {
+        add(uri.String())
+    }
+
+    return names
 
 }
@@ -0,0 +1,230 @@
+package ctl_monitor_lib
+
+import "fmt"
+import "runtime"
+import "sync"
+
+// how many get-entries requests each monitor keeps in flight at once, unless it's set for the log.  set from the command line; each monitor is held to at most MAX_FETCH_CONCURRENCY, whatever this says
+var FETCH_CONCURRENCY int = 4
+const MAX_FETCH_CONCURRENCY int = 32
+
+// the number of get-entries requests to keep in flight for a log that asked for 'n' (0 for the default)
+func fetchConcurrency(n int) int {
+
+    if n == 0 {
+        n = FETCH_CONCURRENCY
+    }
+
+    if n < 1 {
+        return 1
+    }
+    if n > MAX_FETCH_CONCURRENCY {
+        return MAX_FETCH_CONCURRENCY
+    }
+
+    return n
+
+}
+
+// a batch of consecutive entries moving through the pipeline: fetched from the log, then parsed, then written
+type entryBatch struct {
+// the index of the first and last entry (inclusive)
+    start uint64
+    end uint64
+    entries []rawEntry
+// the leaf hash of each entry, or nil if the entry couldn't be decoded
+    leaf_hashes [][]byte
+// the entries that matched a hostname, ready to be inserted
+    matches []matchedCert
+// names that look like a watched domain without matching any rule, if DETECT_LOOKALIKES is set
+    lookalikes []lookalikeCert
+    err error
+}
+
+// a certificate that matched one of the hostnames, waiting to be written to the database
+type matchedCert struct {
+// the rule that matched, by text and id
+    hostname string
+    rule_id int64
+    rule_label string
+    matched_name string
+// the matched name in its A-label and U-label forms
+    matched_ascii string
+    matched_unicode string
+    registrable_domain string
+// the hash of the issuer's public key, from a PreCert entry or the chain
+    issuer_key_hash string
+// the hash of the TBSCertificate without the poison and SCT list extensions, which links a precertificate to the certificate issued from it
+    tbs_hash string
+// the chain from extra_data, from the issuer up
+    chain []issuerCert
+    metadata certMetadata
+// the SCTs embedded in an X509 entry's certificate
+    scts []embeddedSCT
+// the index of the entry in the log
+    leaf_index uint64
+    timestamp uint64
+    common_name string
+    cert string
+    logentrytype string
+    leaf_hash string
+}
+
+// a certificate with a name that looks like one of the watched domains, waiting to be written to 'lookalikes'
+type lookalikeCert struct {
+    lookalike
+    timestamp uint64
+    common_name string
+    cert string
+    logentrytype string
+    leaf_hash string
+}
+
+// fetches and parses the entries of one log concurrently.  batches come out of 'batches' in whatever order they finish, and the caller puts them back in order.  no more than twice the fetch concurrency are outstanding at once, so the caller has to release each batch once it's written
+type entryPipeline struct {
+    batches chan *entryBatch
+    tokens chan struct{}
+    done chan struct{}
+    stop_once sync.Once
+}
+
+// start fetching and parsing the entries of the log between 'start' and 'end' (inclusive), with m.fetch_concurrency get-entries requests in flight and a parser for each CPU
+func (m *Monitor) fetchEntries(start uint64, end uint64) *entryPipeline {
+
+    var p entryPipeline
+    p.batches = make(chan *entryBatch)
+    p.tokens = make(chan struct{}, 2*m.fetch_concurrency)
+    p.done = make(chan struct{})
+
+    ranges := make(chan [2]uint64)
+    fetched := make(chan *entryBatch)
+
+// hand out ranges in order.  a range is only handed out once there's room for it, so the batch the writer is waiting for is always one of the ones in flight
+    go func() {
+        defer close(ranges)
+        for next := start; next <= end; {
+            select {
+                case p.tokens <- struct{}{}:
+                case <- p.done: return
+            }
+            finish := min(next+m.batchSize()-1, end)
+            select {
+                case ranges <- [2]uint64{next, finish}:
+                case <- p.done: return
+            }
+            next = finish + 1
+        }
+    }()
+
+// fetch each range
+    var fetchers sync.WaitGroup
+    for i := 0; i < m.fetch_concurrency; i++ {
+        fetchers.Add(1)
+        go func() {
+            defer fetchers.Done()
+            for r := range ranges {
+                batch := &entryBatch{start: r[0], end: r[1]}
+                batch.entries, batch.err = m.fetchBatch(r[0], r[1])
+                select {
+                    case fetched <- batch:
+                    case <- p.done: return
+                }
+            }
+        }()
+    }
+    go func() {
+        fetchers.Wait()
+        close(fetched)
+    }()
+
+// parse each batch
+    var parsers sync.WaitGroup
+    for i := 0; i < runtime.NumCPU(); i++ {
+        parsers.Add(1)
+        go func() {
+            defer parsers.Done()
+            for batch := range fetched {
+                if batch.err == nil {
+                    m.parseBatch(batch)
+                }
+                select {
+                    case p.batches <- batch:
+                    case <- p.done: return
+                }
+            }
+        }()
+    }
+    go func() {
+        parsers.Wait()
+        close(p.batches)
+    }()
+
+    return &p
+
+}
+
+// make room for another batch, once one has been written
+func (p *entryPipeline) release() {
+
+    <- p.tokens
+
+}
+
+// stop fetching.  batches already in flight are dropped
+func (p *entryPipeline) stop() {
+
+    p.stop_once.Do(func() { close(p.done) })
+
+}
+
+// fetch the entries between 'start' and 'end' (inclusive).  the log may return fewer entries than requested, in which case we keep asking, and size later requests to match
+func (m *Monitor) fetchBatch(start uint64, end uint64) ([]rawEntry, error) {
+
+    var entries []rawEntry
+
+    for next := start; next <= end; {
+        received, err := getEntriesOnce(m.ctl_host, next, end, m.done)
+        if err != nil {
+            return nil, err
+        }
+        if len(received) == 0 {
+            return nil, &DecodeError{Url: m.ctl_host + GET_ENTRIES, Err: fmt.Errorf("no entries returned between %d and %d", next, end)}
+        }
+        m.observeBatchSize(end-next+1, uint64(len(received)))
+
+        entries = append(entries, received...)
+        next += uint64(len(received))
+    }
+
+    return entries, nil
+
+}
+
+// the number of entries to ask for in one request
+func (m *Monitor) batchSize() uint64 {
+
+    m.batch_lock.Lock()
+    defer m.batch_lock.Unlock()
+
+    if m.batch_size == 0 || m.batch_size > REQUEST_SIZE {
+        return REQUEST_SIZE
+    }
+    return m.batch_size
+
+}
+
+// note how many entries the log returned for a request.  a log that returns fewer than were asked for is capping its responses, so later requests ask for the most it has ever returned at once.  (the most, rather than this response's size, since some logs also cut responses short at page boundaries)
+func (m *Monitor) observeBatchSize(requested uint64, received uint64) {
+
+    m.batch_lock.Lock()
+    defer m.batch_lock.Unlock()
+
+    if received > m.max_received {
+        m.max_received = received
+    }
+    if received < requested && m.batch_size != m.max_received {
+        m.batch_size = m.max_received
+        if m.VERBOSE { fmt.Printf("%s returns at most %d entries at a time\n", m.ctl_host, m.batch_size) }
+    }
+
+}
@@ -0,0 +1,257 @@
+package ctl_monitor_lib
+
+import "database/sql"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "log"
+import "strconv"
+import "time"
+
+// other instances of ctl_monitor to exchange signed tree heads with, and how often to ask them for new ones.  set from the command line
+var GOSSIP_PEERS []string
+var GOSSIP_INTERVAL time.Duration = 5 * time.Minute
+
+// the tree heads published by each peer, and whether they're consistent with the ones this instance was shown.  'observed' is when the peer fetched it, by the peer's clock
+const CREATE_PEER_STHS_TABLE string = "CREATE TABLE IF NOT EXISTS peer_sths (peer TEXT, ctl TEXT, log_id TEXT, tree_size INTEGER, timestamp INTEGER, root_hash TEXT, signature TEXT, observed INTEGER, status TEXT, reason TEXT, checked INTEGER, PRIMARY KEY (peer, ctl, tree_size, timestamp, root_hash) )"
+
+// the results of checking a peer's tree head.  a pending one couldn't be checked yet (there's no local tree head, or the log didn't answer), and is checked again the next time the peers are asked.  an unchecked one is for a log whose key isn't known here, so nothing it says can be trusted
+const GOSSIP_PENDING string = "pending"
+const GOSSIP_CONSISTENT string = "consistent"
+const GOSSIP_INCONSISTENT string = "inconsistent"
+const GOSSIP_INVALID_SIGNATURE string = "invalid_signature"
+const GOSSIP_UNKNOWN_LOG string = "unknown_log"
+const GOSSIP_UNCHECKED string = "unchecked"
+
+// a signed tree head as it's published to peers: the log it came from (its URL, and its base64 log id if the key is known), and when it was fetched
+type gossipSTH struct {
+    Ctl string
+    Log_id string
+    Observed uint64
+    Signed_tree_head
+}
+
+// a tree head from a peer, and what checking it found
+type peer_sth_row struct {
+    peer string
+    sth gossipSTH
+    status string
+    reason string
+}
+
+// the tree heads this instance adopted, after checking their signatures with the log's key and their consistency with the ones before, that were fetched after 'since' (in milliseconds).  tree heads from a log whose key isn't known aren't published: a peer couldn't tell them from forgeries.  a tree head fetched more than once is listed once, when it was first fetched
+func (s *sharedState) listVerifiedSTHs(since uint64) ([]gossipSTH, error) {
+
+    rows, err := s.database.Query("SELECT ctl, log_id, MIN(fetched), tree_size, timestamp, root_hash, signature FROM sth_history WHERE verification = ? AND error IS NULL AND fetched > ? GROUP BY ctl, tree_size, timestamp, root_hash ORDER BY MIN(fetched)", STH_VERIFIED, since)
+    if err != nil {
+        log.Println("Error accessing database.")
+        return nil, err
+    }
+    defer rows.Close()
+
+    results := []gossipSTH{}
+    var sth gossipSTH
+    for rows.Next() {
+        err = rows.Scan(&sth.Ctl, &sth.Log_id, &sth.Observed, &sth.Tree_size, &sth.Timestamp, &sth.Sha256_root_hash, &sth.Tree_head_signature)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            return results, err
+        }
+        results = append(results, sth)
+    }
+
+    return results, rows.Err()
+
+}
+
+// ask a peer for the tree heads it adopted after 'since', by its clock
+func getPeerSTHs(peer string, since uint64) ([]gossipSTH, error) {
+
+    var sths []gossipSTH
+    err := getJSON(peer + "GetSTHs?since=" + strconv.FormatUint(since, 10), &sths, nil)
+
+    return sths, err
+
+}
+
+// ask the peers every GOSSIP_INTERVAL, until the controller is shut down
+func (c *Controller) runGossip() {
+
+    ticker := time.NewTicker(GOSSIP_INTERVAL)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- c.done:
+            return
+        case <- ticker.C:
+            c.gossip()
+        }
+    }
+
+}
+
+// ask each peer for the tree heads it has adopted since it was last asked, and check each one, and any that were left pending, against this instance's view of the log.  a tree head that's inconsistent means the log has shown different trees to different monitors: it's written to the log as an ALERT and counted in the metrics.  returns the number of tree heads checked and the number found inconsistent
+func (c *Controller) gossip() (int, int) {
+
+// the background poller and the "Gossip" command shouldn't both check the same tree heads
+    c.gossip_lock.Lock()
+    defer c.gossip_lock.Unlock()
+
+    for _, peer := range c.gossip_peers {
+        var since uint64
+        err := c.shared.database.QueryRow("SELECT IFNULL(MAX(observed), 0) FROM peer_sths WHERE peer = ?", peer).Scan(&since)
+        if err != nil {
+            log.Println("Error accessing database.")
+            log.Println(err)
+            continue
+        }
+        sths, err := getPeerSTHs(peer, since)
+        if err != nil {
+            log.Println("Error getting signed tree heads from peer", peer)
+            log.Println(err)
+            continue
+        }
+        if c.shared.VERBOSE { fmt.Printf("Got %d signed tree heads from %s\n", len(sths), peer) }
+        for _, sth := range sths {
+            _, err = c.shared.database.Exec("INSERT OR IGNORE INTO peer_sths (peer, ctl, log_id, tree_size, timestamp, root_hash, signature, observed, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", peer, sth.Ctl, sth.Log_id, sth.Tree_size, sth.Timestamp, sth.Sha256_root_hash, sth.Tree_head_signature, sth.Observed, GOSSIP_PENDING)
+            if err != nil {
+                log.Println(err)
+            }
+        }
+    }
+
+    pending, err := c.shared.listPeerSTHs(GOSSIP_PENDING)
+    if err != nil {
+        return 0, 0
+    }
+
+    checked := 0
+    inconsistent := 0
+    for _, row := range pending {
+        monitor, status, reason := c.checkPeerSTH(row.sth)
+        if status == GOSSIP_PENDING {
+            if c.shared.VERBOSE { fmt.Printf("Could not check tree head of size %d from %s yet: %v\n", row.sth.Tree_size, row.peer, reason) }
+            continue
+        }
+        checked += 1
+
+        reason_text := ""
+        if reason != nil {
+            reason_text = reason.Error()
+        }
+        switch status {
+        case GOSSIP_INCONSISTENT:
+            log.Printf("ALERT: %s showed peer %s a tree head (size %d, root %s) that is not consistent with the one shown here: %v\n", row.sth.Ctl, row.peer, row.sth.Tree_size, row.sth.Sha256_root_hash, reason)
+            c.shared.split_view_metrics.WithLabelValues(monitor.ctl_host).Inc()
+            inconsistent += 1
+        case GOSSIP_INVALID_SIGNATURE:
+            log.Printf("Peer %s published a tree head for %s whose signature does not verify: %v\n", row.peer, row.sth.Ctl, reason)
+        case GOSSIP_UNCHECKED:
+            if c.shared.VERBOSE { fmt.Printf("Could not check tree head of size %d from %s: %v\n", row.sth.Tree_size, row.peer, reason) }
+        }
+
+        _, err = c.shared.database.Exec("UPDATE peer_sths SET status = ?, reason = ?, checked = ? WHERE peer = ? AND ctl = ? AND tree_size = ? AND timestamp = ? AND root_hash = ?", status, reason_text, time.Now().UnixMilli(), row.peer, row.sth.Ctl, row.sth.Tree_size, row.sth.Timestamp, row.sth.Sha256_root_hash)
+        if err != nil {
+            log.Println(err)
+        }
+    }
+    if c.shared.VERBOSE { fmt.Printf("Checked %d signed tree heads from peers, %d inconsistent\n", checked, inconsistent) }
+
+    return checked, inconsistent
+
+}
+
+// the monitor of the log a peer's tree head came from.  peers may know a log by another URL, so it's found by its log id if it has one
+func (c *Controller) gossipMonitor(sth gossipSTH) *Monitor {
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    log_id, err := base64.StdEncoding.DecodeString(sth.Log_id)
+    if err == nil && len(log_id) == 32 {
+        var id [32]byte
+        copy(id[:], log_id)
+        if known_log := c.shared.getKnownLog(id); known_log != nil && c.monitors[known_log.ctl_host] != nil {
+            return c.monitors[known_log.ctl_host]
+        }
+    }
+
+    return c.monitors[sth.Ctl]
+
+}
+
+// check a peer's tree head against the ones this instance adopted from the same log: one of the same size must have the same root, and otherwise the log has to prove that one of them extends the other.  the proof comes from the log as this instance sees it, so a log that showed the peer a different tree can't give one.  returns the monitor of the log it was checked against, if there is one
+func (c *Controller) checkPeerSTH(sth gossipSTH) (*Monitor, string, error) {
+
+    monitor := c.gossipMonitor(sth)
+    if monitor == nil {
+        return nil, GOSSIP_UNKNOWN_LOG, errors.New("Not monitoring " + sth.Ctl)
+    }
+// without the log's key, a forged or garbled tree head would look like a split view
+    if monitor.log_key == nil {
+        return monitor, GOSSIP_UNCHECKED, errors.New("No public key for " + monitor.ctl_host + "; the signature can't be verified")
+    }
+    err := verifySTHSignature(sth.Signed_tree_head, monitor.log_key)
+    if err != nil {
+        return monitor, GOSSIP_INVALID_SIGNATURE, err
+    }
+
+    var local Signed_tree_head
+    err = c.shared.database.QueryRow("SELECT tree_size, timestamp, root_hash, signature FROM sth_history WHERE ctl = ? AND tree_size = ? AND error IS NULL LIMIT 1", monitor.ctl_host, sth.Tree_size).Scan(&local.Tree_size, &local.Timestamp, &local.Sha256_root_hash, &local.Tree_head_signature)
+    if err != nil && err != sql.ErrNoRows {
+        return monitor, GOSSIP_PENDING, err
+    }
+    if err == sql.ErrNoRows {
+        local = monitor.getTreeHead()
+        if local.Tree_size == 0 {
+            return monitor, GOSSIP_PENDING, errors.New("No verified tree head for " + monitor.ctl_host + " yet")
+        }
+    }
+
+    old_sth, new_sth := local, sth.Signed_tree_head
+    if new_sth.Tree_size < old_sth.Tree_size {
+        old_sth, new_sth = new_sth, old_sth
+    }
+    var proof [][]byte
+    if old_sth.Tree_size > 0 && old_sth.Tree_size < new_sth.Tree_size {
+        proof, err = getSTHConsistency(monitor.ctl_host, old_sth.Tree_size, new_sth.Tree_size, monitor.done)
+        if err != nil {
+            monitor.countRequestFailure(err)
+            return monitor, GOSSIP_PENDING, err
+        }
+    }
+
+    err = verifySTHConsistency(old_sth, new_sth, proof)
+    if err != nil {
+        return monitor, GOSSIP_INCONSISTENT, err
+    }
+
+    return monitor, GOSSIP_CONSISTENT, nil
+
+}
+
+// the tree heads from peers with status 'status', in the order the peers fetched them
+func (s *sharedState) listPeerSTHs(status string) ([]peer_sth_row, error) {
+
+    rows, err := s.database.Query("SELECT peer, ctl, log_id, observed, tree_size, timestamp, root_hash, signature, status, IFNULL(reason, '') FROM peer_sths WHERE status = ? ORDER BY observed", status)
+    if err != nil {
+        log.Println("Error accessing database.")
+        log.Println(err)
+        return nil, err
+    }
+    defer rows.Close()
+
+    var results []peer_sth_row
+    var row peer_sth_row
+    for rows.Next() {
+        err = rows.Scan(&row.peer, &row.sth.Ctl, &row.sth.Log_id, &row.sth.Observed, &row.sth.Tree_size, &row.sth.Timestamp, &row.sth.Sha256_root_hash, &row.sth.Tree_head_signature, &row.status, &row.reason)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            return results, err
+        }
+        results = append(results, row)
+    }
+
+    return results, rows.Err()
+
+}
@@ -0,0 +1,111 @@
+package ctl_monitor_lib
+
+import "fmt"
+import "log"
+import "encoding/base64"
+import "strings"
+
+// request and verify inclusion proofs for every stored certificate that doesn't have one yet, against the current signed tree head.  the proof and the tree size it was checked against are stored with the row.  a proof that fails, or that puts the leaf at another index than the one it was fetched from, raises an alert; the failure is stored with the tree size, so it's tried again, and alerted on again, only once there's a new tree head.  returns the number of certificates proven and the number that failed
+func (m *Monitor) proveInclusions() (int, int) {
+
+    sth := m.getTreeHead()
+    root, err := base64.StdEncoding.DecodeString(sth.Sha256_root_hash)
+    if err != nil {
+        log.Println("Invalid root hash in signed tree head")
+        log.Println(err)
+        return 0, 0
+    }
+
+// collect the leaf hashes, and the index each was fetched from (-1 for rows stored before the index was), first, so the query isn't still open while we update rows
+    rows, err := m.database.Query("SELECT leaf_hash, IFNULL(MIN(leaf_index), -1) FROM certificates WHERE ctl = ? AND leaf_hash IS NOT NULL AND proof_tree_size IS NULL AND IFNULL(proof_failed_tree_size, -1) != ? GROUP BY leaf_hash", m.ctl_host, sth.Tree_size)
+    if err != nil {
+        log.Println("Error accessing database.")
+        log.Println(err)
+        return 0, 0
+    }
+    var leaf_hashes []string
+    var leaf_indexes []int64
+    var leaf_hash string
+    var stored_index int64
+    for rows.Next() {
+        err = rows.Scan(&leaf_hash, &stored_index)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            log.Println(err)
+            continue
+        }
+        leaf_hashes = append(leaf_hashes, leaf_hash)
+        leaf_indexes = append(leaf_indexes, stored_index)
+    }
+    rows.Close()
+
+    if m.VERBOSE { fmt.Printf("Requesting inclusion proofs for %d certificates from %s\n", len(leaf_hashes), m.ctl_host) }
+
+    statement, err := m.database.Prepare("UPDATE certificates SET leaf_index = ?, inclusion_proof = ?, proof_tree_size = ?, proof_failed_tree_size = NULL, proof_error = NULL WHERE ctl = ? AND leaf_hash = ?")
+    if err != nil {
+        log.Println(err)
+        return 0, 0
+    }
+    defer statement.Close()
+    failure_statement, err := m.database.Prepare("UPDATE certificates SET proof_failed_tree_size = ?, proof_error = ? WHERE ctl = ? AND leaf_hash = ?")
+    if err != nil {
+        log.Println(err)
+        return 0, 0
+    }
+    defer failure_statement.Close()
+
+    proven := 0
+    failed := 0
+    for i, entry := range leaf_hashes {
+        if m.removed() {
+            break
+        }
+        hash, err := base64.StdEncoding.DecodeString(entry)
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+
+// a network error isn't the log's fault; try again next time
+        leaf_index, audit_path, err := getProofByHash(m.ctl_host, hash, sth.Tree_size, m.done)
+        if err != nil {
+            log.Println("Error getting an inclusion proof from", m.ctl_host)
+            log.Println(err)
+            m.countRequestFailure(err)
+            continue
+        }
+
+        err = verifyInclusionProof(leaf_index, sth.Tree_size, hash, root, audit_path)
+        if err == nil && leaf_indexes[i] >= 0 && uint64(leaf_indexes[i]) != leaf_index {
+            err = fmt.Errorf("Proof is for index %d, but the leaf was fetched from index %d", leaf_index, leaf_indexes[i])
+        }
+        if err != nil {
+            log.Printf("ALERT: %s could not prove inclusion of leaf %s in the tree of size %d: %v\n", m.ctl_host, entry, sth.Tree_size, err)
+            m.inclusion_failure_metrics.WithLabelValues(m.ctl_host).Inc()
+            failed += 1
+            _, err = failure_statement.Exec(sth.Tree_size, err.Error(), m.ctl_host, entry)
+            if err != nil {
+                log.Println("Database error while recording failed inclusion proof")
+                log.Println(err)
+            }
+            continue
+        }
+
+        encoded_path := make([]string, len(audit_path))
+        for j, node := range audit_path {
+            encoded_path[j] = base64.StdEncoding.EncodeToString(node)
+        }
+        _, err = statement.Exec(leaf_index, strings.Join(encoded_path, ","), sth.Tree_size, m.ctl_host, entry)
+        if err != nil {
+            log.Println("Database error while storing inclusion proof")
+            log.Println(err)
+            continue
+        }
+        proven += 1
+    }
+
+    if m.VERBOSE { fmt.Printf("Proved inclusion of %d certificates in %s; %d failed\n", proven, m.ctl_host, failed) }
+
+    return proven, failed
+
+}
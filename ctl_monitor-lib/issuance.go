@@ -0,0 +1,142 @@
+package ctl_monitor_lib
+
+import "crypto/sha256"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/asn1"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "log"
+
+// the extension that makes a precertificate unusable (RFC 6962 section 3.1), and the one that carries the SCTs in the certificate issued from it (section 3.3)
+var POISON_OID asn1.ObjectIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+var SCT_LIST_OID asn1.ObjectIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// each precertificate and the certificate issued from it, keyed by the hash of the issuer's public key and of their common TBSCertificate.  either may be seen first, in any log; the other's columns are NULL until it is
+const CREATE_ISSUANCES_TABLE string = "CREATE TABLE IF NOT EXISTS issuances (issuer_key_hash TEXT, tbs_hash TEXT, precert_leaf_hash TEXT, precert_timestamp INTEGER, precert_ctl TEXT, cert_leaf_hash TEXT, cert_timestamp INTEGER, cert_ctl TEXT, PRIMARY KEY (issuer_key_hash, tbs_hash) )"
+
+// a precertificate for a rule, and the certificate issued from it, if it has been seen
+type issuance_row struct {
+    common_name string
+    precert_timestamp uint64
+    precert_ctl string
+// -1 if no certificate has been seen
+    cert_timestamp int64
+    cert_ctl string
+}
+
+// a DER-encoded TBSCertificate without the poison and SCT list extensions.  a precertificate and the certificate issued from it have the same one.  if no other extensions are left, the extensions field is dropped
+func canonicalTBS(tbs []byte) ([]byte, error) {
+
+    var sequence asn1.RawValue
+    rest, err := asn1.Unmarshal(tbs, &sequence)
+    if err != nil {
+        return nil, err
+    }
+    if len(rest) > 0 || sequence.Class != asn1.ClassUniversal || sequence.Tag != asn1.TagSequence {
+        return nil, errors.New("Invalid TBSCertificate")
+    }
+
+    var fields []byte
+    for data := sequence.Bytes; len(data) > 0; {
+        var field asn1.RawValue
+        data, err = asn1.Unmarshal(data, &field)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid TBSCertificate: %v", err)
+        }
+        if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+            fields = append(fields, field.FullBytes...)
+            continue
+        }
+
+// the extensions are tagged [3], and each is kept as it was encoded unless it's one of the two
+        var extensions []asn1.RawValue
+        _, err = asn1.Unmarshal(field.Bytes, &extensions)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid extensions in TBSCertificate: %v", err)
+        }
+        var kept []byte
+        for _, raw := range extensions {
+            var extension pkix.Extension
+            _, err = asn1.Unmarshal(raw.FullBytes, &extension)
+            if err != nil {
+                return nil, fmt.Errorf("Invalid extension in TBSCertificate: %v", err)
+            }
+            if extension.Id.Equal(POISON_OID) || extension.Id.Equal(SCT_LIST_OID) {
+                continue
+            }
+            kept = append(kept, raw.FullBytes...)
+        }
+        if len(kept) == 0 {
+            continue
+        }
+        kept, _ = asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: kept})
+        kept, _ = asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: kept})
+        fields = append(fields, kept...)
+    }
+
+    return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: fields})
+
+}
+
+// the hex SHA-256 hash of a certificate's canonical TBSCertificate, or "" if it can't be found
+func tbsHash(cert *x509.Certificate) string {
+
+    tbs, err := canonicalTBS(cert.RawTBSCertificate)
+    if err != nil {
+        log.Println(err)
+        return ""
+    }
+    hash := sha256.Sum256(tbs)
+
+    return hex.EncodeToString(hash[:])
+
+}
+
+// record a precertificate or a certificate in 'issuances', linking it to the other if that's already there.  only the first of each that's seen is kept.  'db' is either the database or a transaction
+func saveIssuance(db execer, match matchedCert, ctl string) error {
+
+    if match.issuer_key_hash == "" || match.tbs_hash == "" {
+        return nil
+    }
+    prefix := "cert"
+    if match.logentrytype == "PreCert" {
+        prefix = "precert"
+    }
+
+    _, err := db.Exec("INSERT OR IGNORE INTO issuances (issuer_key_hash, tbs_hash) VALUES (?, ?)", match.issuer_key_hash, match.tbs_hash)
+    if err != nil {
+        return err
+    }
+    _, err = db.Exec("UPDATE issuances SET " + prefix + "_leaf_hash = ?, " + prefix + "_timestamp = ?, " + prefix + "_ctl = ? WHERE issuer_key_hash = ? AND tbs_hash = ? AND " + prefix + "_leaf_hash IS NULL", match.leaf_hash, match.timestamp, ctl, match.issuer_key_hash, match.tbs_hash)
+
+    return err
+
+}
+
+// the precertificates for the rule 'hostname', with the certificates issued from them.  the ones that haven't been issued come first, then the rest, in the order they were logged
+func (s *sharedState) listIssuances(hostname string) ([]issuance_row, error) {
+
+    hostname = s.ruleText(hostname)
+    rows, err := s.database.Query("SELECT DISTINCT certificates.commonname, issuances.precert_timestamp, issuances.precert_ctl, IFNULL(issuances.cert_timestamp, -1), IFNULL(issuances.cert_ctl, '') FROM certificates JOIN issuances ON certificates.issuer_key_hash = issuances.issuer_key_hash AND certificates.tbs_hash = issuances.tbs_hash WHERE certificates.hostname = ? AND certificates.logentrytype = 'PreCert' ORDER BY issuances.cert_timestamp IS NOT NULL, issuances.precert_timestamp", hostname)
+    if err != nil {
+        log.Println("Error accessing database.")
+        return nil, err
+    }
+    defer rows.Close()
+
+    var results []issuance_row
+    var row issuance_row
+    for rows.Next() {
+        err = rows.Scan(&row.common_name, &row.precert_timestamp, &row.precert_ctl, &row.cert_timestamp, &row.cert_ctl)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            return results, err
+        }
+        results = append(results, row)
+    }
+
+    return results, rows.Err()
+
+}
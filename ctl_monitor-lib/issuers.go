@@ -0,0 +1,119 @@
+package ctl_monitor_lib
+
+import "crypto/sha256"
+import "crypto/x509"
+import "encoding/base64"
+import "encoding/hex"
+import "log"
+
+// every intermediate and root seen in a chain, stored once, by the hex SHA-256 fingerprint of its DER encoding
+const CREATE_ISSUERS_TABLE string = "CREATE TABLE IF NOT EXISTS issuers (sha256 TEXT PRIMARY KEY, subject TEXT, issuer TEXT, serial TEXT, not_before INTEGER, not_after INTEGER, certificate TEXT)"
+
+// the chain of each certificate found, one row per issuer: 'position' is 0 for the certificate that issued it, 1 for the one that issued that, and so on up to the root
+const CREATE_CERTIFICATE_CHAINS_TABLE string = "CREATE TABLE IF NOT EXISTS certificate_chains (leaf_hash TEXT, ctl TEXT, position INTEGER, sha256 TEXT, PRIMARY KEY (leaf_hash, ctl, position) )"
+
+// a certificate from the chain in an entry's extra_data
+type issuerCert struct {
+    fingerprint string
+// the base64 SHA-256 hash of its public key, as in a PreCert entry
+    key_hash string
+    subject string
+    issuer string
+    serial string
+    not_before int64
+    not_after int64
+    der []byte
+}
+
+// an issuer, how many certificates for a rule it's in the chain of, and how far up those chains it is (0 if it issued one of them)
+type issuer_row struct {
+    fingerprint string
+    subject string
+    position int
+    certificates int
+}
+
+// the chain of the entry in 'leaf', from the certificate that issued it to the root.  a certificate in the chain that can't be parsed is still kept, by its fingerprint, with no subject
+func getIssuers(leaf MerkleTreeLeaf) []issuerCert {
+
+    _, chain, err := parseChain(leaf)
+    if err != nil {
+        log.Println(err)
+        return nil
+    }
+
+    issuers := make([]issuerCert, len(chain))
+    for i, der := range chain {
+        fingerprint := sha256.Sum256(der)
+        issuers[i] = issuerCert{fingerprint: hex.EncodeToString(fingerprint[:]), der: der}
+        cert, err := x509.ParseCertificate(der)
+        if err != nil {
+            log.Println("Could not parse certificate", issuers[i].fingerprint, "in chain:", err)
+            continue
+        }
+        key_hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+        issuers[i].key_hash = base64.StdEncoding.EncodeToString(key_hash[:])
+        issuers[i].subject = cert.Subject.String()
+        issuers[i].issuer = cert.Issuer.String()
+        issuers[i].serial = cert.SerialNumber.Text(16)
+        issuers[i].not_before = cert.NotBefore.UnixMilli()
+        issuers[i].not_after = cert.NotAfter.UnixMilli()
+    }
+
+    return issuers
+
+}
+
+// link the certificate with leaf hash 'leaf_hash' in the log 'ctl_host' to each certificate of its chain, in 'certificate_chains'.  'db' is either the database or a transaction
+func saveChain(db execer, leaf_hash string, ctl_host string, issuers []issuerCert) error {
+
+    for i, issuer := range issuers {
+        _, err := db.Exec("INSERT OR IGNORE INTO certificate_chains (leaf_hash, ctl, position, sha256) VALUES (?, ?, ?, ?)", leaf_hash, ctl_host, i, issuer.fingerprint)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+
+}
+
+// store each certificate of a chain in 'issuers', unless it's already there.  'db' is either the database or a transaction
+func saveIssuers(db execer, issuers []issuerCert) error {
+
+    for _, issuer := range issuers {
+        _, err := db.Exec("INSERT OR IGNORE INTO issuers (sha256, subject, issuer, serial, not_before, not_after, certificate) VALUES (?, ?, ?, ?, ?, ?, ?)", issuer.fingerprint, issuer.subject, issuer.issuer, issuer.serial, issuer.not_before, issuer.not_after, base64.StdEncoding.EncodeToString(issuer.der))
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+
+}
+
+// the certificates in the chains of the certificates for the rule 'hostname' (the issuers, and the intermediates and roots above them), with how many certificates each is in the chain of, most first
+func (s *sharedState) listIssuers(hostname string) ([]issuer_row, error) {
+
+    hostname = s.ruleText(hostname)
+    rows, err := s.database.Query("SELECT issuers.sha256, IFNULL(issuers.subject, ''), MIN(certificate_chains.position) AS position, COUNT(DISTINCT certificates.leaf_hash) AS issued FROM certificates JOIN certificate_chains ON certificate_chains.leaf_hash = certificates.leaf_hash AND certificate_chains.ctl = certificates.ctl JOIN issuers ON certificate_chains.sha256 = issuers.sha256 WHERE certificates.hostname = ? GROUP BY issuers.sha256 ORDER BY issued DESC, position", hostname)
+    if err != nil {
+        log.Println("Error accessing database.")
+        return nil, err
+    }
+    defer rows.Close()
+
+    var results []issuer_row
+    var row issuer_row
+    for rows.Next() {
+        err = rows.Scan(&row.fingerprint, &row.subject, &row.position, &row.certificates)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            return results, err
+        }
+        results = append(results, row)
+    }
+
+    return results, rows.Err()
+
+}
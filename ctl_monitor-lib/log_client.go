@@ -0,0 +1,216 @@
+package ctl_monitor_lib
+
+import "fmt"
+import "log"
+import "net/http"
+import "io/ioutil"
+import "encoding/json"
+import "errors"
+import "math/rand"
+import "strconv"
+import "time"
+
+// how many times to retry a failed request to a log, and how long to wait before the first retry.  the wait doubles after each attempt, up to RETRY_MAX
+var MAX_RETRIES int = 5
+var RETRY_BASE time.Duration = 1 * time.Second
+var RETRY_MAX time.Duration = 2 * time.Minute
+
+// every request to a log goes through this client, so a log that stops answering can't hang a monitor forever
+var HTTP_CLIENT *http.Client = &http.Client{Timeout: 60 * time.Second}
+
+// the request never got a response: the log couldn't be reached, the connection dropped, or it timed out
+type NetworkError struct {
+    Url string
+    Err error
+}
+
+func (e *NetworkError) Error() string {
+    return fmt.Sprintf("Network error requesting %s: %v", e.Url, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error {
+    return e.Err
+}
+
+// the log answered with an HTTP status other than 200 OK
+type HTTPStatusError struct {
+    Url string
+    Status int
+    Body string
+}
+
+func (e *HTTPStatusError) Error() string {
+    return fmt.Sprintf("%s returned HTTP status %d: %s", e.Url, e.Status, e.Body)
+}
+
+// the log answered 429 Too Many Requests (or 503 with a Retry-After).  Retry_after is zero if the log didn't say how long to wait
+type RateLimitedError struct {
+    Url string
+    Status int
+    Retry_after time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+    return fmt.Sprintf("%s is rate limiting requests (HTTP status %d, retry after %v)", e.Url, e.Status, e.Retry_after)
+}
+
+// the log's response couldn't be decoded
+type DecodeError struct {
+    Url string
+    Err error
+}
+
+func (e *DecodeError) Error() string {
+    return fmt.Sprintf("Could not decode response from %s: %v", e.Url, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+    return e.Err
+}
+
+// a short name for the kind of error, used to label metrics
+func errorKind(err error) string {
+
+    var network_error *NetworkError
+    var status_error *HTTPStatusError
+    var rate_limited_error *RateLimitedError
+    var decode_error *DecodeError
+
+    switch {
+    case errors.As(err, &rate_limited_error):
+        return "rate_limited"
+    case errors.As(err, &network_error):
+        return "network"
+    case errors.As(err, &status_error):
+        return "http_status"
+    case errors.As(err, &decode_error):
+        return "decode"
+    }
+
+    return "other"
+
+}
+
+// whether a request that failed with 'err' is worth trying again.  network errors, rate limiting and server errors usually go away; a 4xx or a response we can't decode won't
+func retryable(err error) bool {
+
+    var status_error *HTTPStatusError
+
+    switch errorKind(err) {
+    case "network", "rate_limited":
+        return true
+    case "http_status":
+        errors.As(err, &status_error)
+        return status_error.Status >= 500
+    }
+
+    return false
+
+}
+
+// whether the log answered with a 4xx status, turning down the request itself rather than failing to serve it
+func clientError(err error) bool {
+
+    var status_error *HTTPStatusError
+
+    return errors.As(err, &status_error) && status_error.Status >= 400 && status_error.Status < 500
+
+}
+
+// GET 'url' and decode the JSON response into 'response', retrying with exponential backoff and jitter if the error is one that might go away.  a log that asks us to wait with Retry-After gets that long, up to RETRY_MAX.  closing 'done' (the monitor's, when the log is removed) stops waiting and gives up; nil never does
+func getJSON(url string, response interface{}, done <-chan struct{}) error {
+
+    var err error
+    backoff := RETRY_BASE
+
+    for attempt := 0; ; attempt++ {
+        err = getJSONOnce(url, response)
+        if err == nil || !retryable(err) || attempt >= MAX_RETRIES {
+            return err
+        }
+
+// wait somewhere between half and all of the backoff, so monitors that failed together don't retry together
+        wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+        var rate_limited_error *RateLimitedError
+        if errors.As(err, &rate_limited_error) && rate_limited_error.Retry_after > wait {
+            wait = rate_limited_error.Retry_after
+        }
+// a log asking for a day shouldn't stall its monitor for a day
+        if wait > RETRY_MAX {
+            wait = RETRY_MAX
+        }
+        log.Printf("%v; retrying in %v\n", err, wait)
+        timer := time.NewTimer(wait)
+        select {
+        case <- done:
+            timer.Stop()
+            return fmt.Errorf("Stopped retrying %s: %w", url, err)
+        case <- timer.C:
+        }
+
+        backoff *= 2
+        if backoff > RETRY_MAX {
+            backoff = RETRY_MAX
+        }
+    }
+
+}
+
+// GET 'url' once and decode the JSON response into 'response'
+func getJSONOnce(url string, response interface{}) error {
+
+    resp, err := HTTP_CLIENT.Get(url)
+    if err != nil {
+        return &NetworkError{Url: url, Err: err}
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return &NetworkError{Url: url, Err: err}
+    }
+
+    retry_after := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+    if resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode == http.StatusServiceUnavailable && retry_after > 0) {
+        return &RateLimitedError{Url: url, Status: resp.StatusCode, Retry_after: retry_after}
+    }
+    if resp.StatusCode != http.StatusOK {
+// logs explain errors in the body; keep enough of it to be useful
+        if len(body) > 200 {
+            body = body[:200]
+        }
+        return &HTTPStatusError{Url: url, Status: resp.StatusCode, Body: string(body)}
+    }
+
+    err = json.Unmarshal(body, response)
+    if err != nil {
+        return &DecodeError{Url: url, Err: err}
+    }
+
+    return nil
+
+}
+
+// parse a Retry-After header, which is either a number of seconds or an HTTP date.  returns zero if it's missing or invalid
+func parseRetryAfter(header string, now time.Time) time.Duration {
+
+    if header == "" {
+        return 0
+    }
+
+    seconds, err := strconv.Atoi(header)
+    if err == nil {
+        if seconds < 0 {
+            return 0
+        }
+        return time.Duration(seconds) * time.Second
+    }
+
+    date, err := http.ParseTime(header)
+    if err == nil && date.After(now) {
+        return date.Sub(now)
+    }
+
+    return 0
+
+}
@@ -0,0 +1,109 @@
+package ctl_monitor_lib
+
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "log"
+import "time"
+
+// the default set of log states to monitor when reading a log list
+var LOG_LIST_STATES []string = []string{"usable", "qualified", "readonly"}
+
+// a CT log list in the v3 schema (https://www.gstatic.com/ct/log_list/v3/log_list_schema.json).  only the fields the monitor uses are decoded
+type logList struct {
+    Version string
+    Operators []logListOperator
+}
+
+type logListOperator struct {
+    Name string
+    Logs []logListEntry
+}
+
+type logListEntry struct {
+    Description string
+    Log_id string
+    Key string
+    Url string
+    Mmd uint64
+// not part of the schema: how many get-entries requests to keep in flight for the log, if it shouldn't be FETCH_CONCURRENCY
+    Fetch_concurrency int
+// exactly one of pending, qualified, usable, readonly, retired or rejected, each with a timestamp
+    State map[string]json.RawMessage
+    Temporal_interval *temporalInterval
+}
+
+// temporal shards only accept certificates expiring in [start_inclusive, end_exclusive)
+type temporalInterval struct {
+    Start_inclusive time.Time
+    End_exclusive time.Time
+}
+
+// the name of the log's state, or "" if it has none
+func (entry *logListEntry) state() string {
+
+    for state := range entry.State {
+        return state
+    }
+
+    return ""
+
+}
+
+// the log's maximum merge delay
+func (entry *logListEntry) mmd() time.Duration {
+
+    return time.Duration(entry.Mmd) * time.Second
+
+}
+
+// whether the entry differs from how 'monitor' is monitoring the log: the log's key was rotated, or its MMD or fetch concurrency changed
+func (entry *logListEntry) changed(monitor *Monitor) bool {
+
+    if entry.mmd() != monitor.mmd || fetchConcurrency(entry.Fetch_concurrency) != monitor.fetch_concurrency {
+        return true
+    }
+    log_key, err := loadLogKey(entry.Key)
+    if err != nil || monitor.log_key == nil {
+        return true
+    }
+
+    return log_key.log_id != monitor.log_key.log_id
+
+}
+
+// read a log list file and return the logs in one of 'states'.  temporal shards whose interval ended before 'now' are skipped, since they will never contain another certificate that's still valid
+func loadLogList(file_name string, states []string, now time.Time) ([]logListEntry, error) {
+
+    contents, err := ioutil.ReadFile(file_name)
+    if err != nil {
+        return nil, err
+    }
+
+    var list logList
+    err = json.Unmarshal(contents, &list)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid log list %s: %v", file_name, err)
+    }
+
+    var logs []logListEntry
+    for _, operator := range list.Operators {
+        for _, entry := range operator.Logs {
+            if index(states, entry.state()) == -1 {
+                continue
+            }
+            if entry.Temporal_interval != nil && !now.Before(entry.Temporal_interval.End_exclusive) {
+                continue
+            }
+// one bad entry shouldn't keep the rest of the list from being monitored
+            if entry.Url == "" || entry.Key == "" {
+                log.Printf("Skipping log %q in %s: it is missing its url or key\n", entry.Description, file_name)
+                continue
+            }
+            logs = append(logs, entry)
+        }
+    }
+
+    return logs, nil
+
+}
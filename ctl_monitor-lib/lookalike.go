@@ -0,0 +1,302 @@
+package ctl_monitor_lib
+
+import "net"
+import "strings"
+import "unicode"
+import "golang.org/x/net/idna"
+import "golang.org/x/text/unicode/norm"
+
+// look for certificates whose names look like the watched domains (typosquatting and homoglyphs) as well as ones that match them.  set from the command line
+var DETECT_LOOKALIKES bool = false
+
+// brand names shorter than this are only checked for homoglyphs and TLD swaps; at edit distance 1, every short name looks like dozens of others
+const MIN_LOOKALIKE_LENGTH int = 4
+
+// the reasons a name can look like a brand.  they're also metric labels, so there's a fixed set of them; a name that also swaps the brand's TLD gets "+tld_swap" on the end
+var LOOKALIKE_REASONS []string = []string{"homoglyph", "tld_swap", "swapped_characters", "duplicated_character", "keyboard_typo", "omitted_character", "inserted_character", "substituted_character", "edit_distance_2"}
+
+// a domain from an exact, suffix or registrable rule, split so lookalikes can be compared with it
+type lookalikeBrand struct {
+    rule *watchRule
+    domain string
+// everything before the public suffix, the public suffix, and the number of labels in the body
+    body string
+    tld string
+    labels int
+// the domain the brand is in, if it's below its registrable domain.  names in it are assumed to be ours too: www.example.com's sibling api.example.com isn't a typo of it
+    parent string
+}
+
+// a name from a certificate that looks like one of the brands, but isn't it
+type lookalike struct {
+    name string
+// the name with its A-labels decoded, so homoglyphs can be seen
+    unicode_name string
+    brand *lookalikeBrand
+// how alike the name and the brand are, from 0 to 1
+    score float64
+    reason string
+}
+
+// the brands to look for lookalikes of: the domain of each exact, suffix and registrable rule.  keyword, glob and regex rules don't name a single domain, so they have none
+func lookalikeBrands(rules []*watchRule) []*lookalikeBrand {
+
+    var brands []*lookalikeBrand
+    for _, rule := range rules {
+        if rule.kind != "exact" && rule.kind != "suffix" && rule.kind != "registrable" {
+            continue
+        }
+// names are compared as they're displayed, so an internationalized domain is kept in its Unicode form
+        domain := unicodeName(strings.TrimPrefix(strings.TrimPrefix(normalizeName(rule.pattern), "*"), "."))
+        body, tld := splitPublicSuffix(domain)
+        if body == "" {
+            continue
+        }
+        brand := lookalikeBrand{rule: rule, domain: domain, body: body, tld: tld, labels: strings.Count(body, ".") + 1}
+        if brand.labels >= 2 {
+            brand.parent = domain[strings.Index(domain, ".")+1:]
+        }
+        brands = append(brands, &brand)
+    }
+
+    return brands
+
+}
+
+// find the brand that a certificate name looks most like, if any.  IP addresses, email addresses and URIs aren't domains, so they're never lookalikes
+func detectLookalike(name string, brands []*lookalikeBrand) (lookalike, bool) {
+
+    var best lookalike
+    normalized := strings.TrimPrefix(normalizeName(name), "*.")
+    if normalized == "" || strings.ContainsAny(normalized, "@:/") || net.ParseIP(normalized) != nil {
+        return best, false
+    }
+
+// a name in punycode is compared as it's displayed
+    unicode_name, err := idna.Punycode.ToUnicode(normalized)
+    if err != nil {
+        unicode_name = normalized
+    }
+    body, tld := splitPublicSuffix(unicode_name)
+    if body == "" {
+        return best, false
+    }
+    labels := strings.Split(body, ".")
+
+// names in the brands' own domains are ours, however they're spelled
+    for _, brand := range brands {
+        if isOwnName(unicode_name, brand) {
+            return best, false
+        }
+    }
+
+    for _, brand := range brands {
+        if len(labels) < brand.labels {
+            continue
+        }
+// compare the brand with the same number of labels from before the name's public suffix, so login.paypa1.com is compared as paypa1.com, and paypal.co.uk as paypal.co.uk
+        score, reason := compareWithBrand(strings.Join(labels[len(labels)-brand.labels:], "."), tld, brand)
+        if score > best.score {
+            best = lookalike{name: name, unicode_name: unicode_name, brand: brand, score: score, reason: reason}
+        }
+    }
+
+    return best, best.score > 0
+
+}
+
+// split a domain, in its Unicode form, into the labels before its public suffix and the public suffix, so paypal.co.uk is 'paypal' and 'co.uk'.  the body is "" for a domain that is itself a public suffix
+func splitPublicSuffix(domain string) (string, string) {
+
+    registrable := registrableDomain(domain)
+    if registrable == "" {
+        return "", ""
+    }
+    suffix := unicodeName(registrable[strings.Index(registrable, ".")+1:])
+    if !strings.HasSuffix(domain, "." + suffix) {
+        return "", ""
+    }
+
+    return strings.TrimSuffix(domain, "." + suffix), suffix
+
+}
+
+// whether a name, in its Unicode form, is the brand's domain, or in it, or in its parent domain
+func isOwnName(name string, brand *lookalikeBrand) bool {
+
+    if name == brand.domain || isSubdomain(name, "." + brand.domain) {
+        return true
+    }
+
+    return brand.parent != "" && isSubdomain(name, "." + brand.parent)
+
+}
+
+// how much a domain split into 'body' and 'tld' looks like 'brand', and why.  the brand itself scores 0: it's ours
+func compareWithBrand(body string, tld string, brand *lookalikeBrand) (float64, string) {
+
+    if body == brand.body && tld == brand.tld {
+        return 0, ""
+    }
+
+    var score float64
+    var reason string
+    switch {
+    case body == brand.body:
+        return 0.9, "tld_swap"
+// homoglyphs look the same once they're mapped to the letters they imitate
+    case skeleton(body) == skeleton(brand.body):
+        score, reason = 0.95, "homoglyph"
+    default:
+        typo := []rune(body)
+        original := []rune(brand.body)
+        if len(original) < MIN_LOOKALIKE_LENGTH {
+            return 0, ""
+        }
+        distance := editDistance(typo, original)
+        max_distance := 1
+        if len(original) > 2*MIN_LOOKALIKE_LENGTH {
+            max_distance = 2
+        }
+        if distance == 0 || distance > max_distance {
+            return 0, ""
+        }
+        score = 1 - float64(distance)/float64(len(original)+1)
+        reason = classifyEdit(typo, original, distance)
+    }
+
+    if tld != brand.tld {
+        score *= 0.9
+        reason += "+tld_swap"
+    }
+
+    return score, reason
+
+}
+
+// the optimal string alignment distance between 'a' and 'b': the number of characters inserted, deleted or substituted, or pairs of adjacent characters swapped, to turn one into the other
+func editDistance(a []rune, b []rune) int {
+
+    d := make([][]int, len(a)+1)
+    for i := range d {
+        d[i] = make([]int, len(b)+1)
+        d[i][0] = i
+    }
+    for j := range d[0] {
+        d[0][j] = j
+    }
+
+    for i := 1; i <= len(a); i++ {
+        for j := 1; j <= len(b); j++ {
+            cost := 1
+            if a[i-1] == b[j-1] {
+                cost = 0
+            }
+            d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+            if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+                d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+            }
+        }
+    }
+
+    return d[len(a)][len(b)]
+
+}
+
+// the reason for a single edit that turned 'original' into 'typo'
+func classifyEdit(typo []rune, original []rune, distance int) string {
+
+    if distance != 1 {
+        return "edit_distance_2"
+    }
+
+// skip the characters the two have in common at the start
+    i := 0
+    for i < len(typo) && i < len(original) && typo[i] == original[i] {
+        i++
+    }
+
+    switch {
+    case len(typo) == len(original)+1:
+// a character was added: a doubled one, one next to its neighbour on the keyboard, or any other
+        added := typo[i]
+        if (i > 0 && typo[i-1] == added) || (i+1 < len(typo) && typo[i+1] == added) {
+            return "duplicated_character"
+        }
+        if (i > 0 && keyboardAdjacent(typo[i-1], added)) || (i+1 < len(typo) && keyboardAdjacent(typo[i+1], added)) {
+            return "keyboard_typo"
+        }
+        return "inserted_character"
+    case len(typo)+1 == len(original):
+        return "omitted_character"
+    case i+1 < len(typo) && typo[i] == original[i+1] && typo[i+1] == original[i]:
+        return "swapped_characters"
+    case keyboardAdjacent(typo[i], original[i]):
+        return "keyboard_typo"
+    }
+
+    return "substituted_character"
+
+}
+
+// the rows of a QWERTY keyboard, and how far each is shifted to the right
+var KEYBOARD_ROWS []string = []string{"1234567890-", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+var KEYBOARD_OFFSETS []float64 = []float64{0, 0.5, 0.75, 1.25}
+
+// whether two keys are next to each other on a QWERTY keyboard, in the same row or the ones above and below
+func keyboardAdjacent(a rune, b rune) bool {
+
+    if a == b {
+        return false
+    }
+
+    row_a, x_a, found_a := keyPosition(a)
+    row_b, x_b, found_b := keyPosition(b)
+    if !found_a || !found_b {
+        return false
+    }
+
+    return row_a-row_b <= 1 && row_b-row_a <= 1 && x_a-x_b <= 1 && x_b-x_a <= 1
+
+}
+
+// the row and horizontal position of a key
+func keyPosition(key rune) (int, float64, bool) {
+
+    for row, keys := range KEYBOARD_ROWS {
+        if column := strings.IndexRune(keys, key); column != -1 {
+            return row, float64(column) + KEYBOARD_OFFSETS[row], true
+        }
+    }
+
+    return 0, 0, false
+
+}
+
+// characters that look like ASCII letters, and the letters they look like.  not the whole of Unicode's confusables list, just the ones that turn up in phishing domains
+var CONFUSABLES map[rune]rune = map[rune]rune{
+// Cyrillic
+    'а': 'a', 'в': 'b', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k', 'ӏ': 'l', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'г': 'r', 'ѕ': 's', 'т': 't', 'ц': 'u', 'ѵ': 'v', 'ԝ': 'w', 'х': 'x', 'у': 'y',
+// Greek
+    'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y',
+// Latin letters and digits that pass for other letters
+    'ı': 'i', 'ɡ': 'g', 'ł': 'l', 'ø': 'o', 'đ': 'd', 'ħ': 'h', '0': 'o', '1': 'l',
+}
+
+// the ASCII a string looks like: accents are dropped, confusable characters are replaced with the letters they imitate, and 'rn' and 'vv' become the 'm' and 'w' they pass for
+func skeleton(s string) string {
+
+    var ascii strings.Builder
+    for _, c := range norm.NFD.String(strings.ToLower(s)) {
+        if unicode.Is(unicode.Mn, c) {
+            continue
+        }
+        if replacement, ok := CONFUSABLES[c]; ok {
+            c = replacement
+        }
+        ascii.WriteRune(c)
+    }
+
+    return strings.NewReplacer("rn", "m", "vv", "w").Replace(ascii.String())
+
+}
@@ -0,0 +1,275 @@
+package ctl_monitor_lib
+
+import "sort"
+import "strings"
+
+// the hostname list compiled into indexes, so matching a name costs about the same however many rules there are:
+//   - exact rules are kept in a hash set, and by parent domain, for wildcard names in certificates
+//   - suffix and registrable rules (and exact rules, with --non-strict) are kept in a trie of reversed labels
+//   - keyword, glob and regex rules are indexed by a literal substring every match has to contain, found with Aho-Corasick
+// the indexes only pick candidates; each candidate is confirmed with watchRule.match, so a matcher always agrees with matchRules.  a matcher is never changed once it's compiled; the hostname list compiles a new one whenever it changes
+type ruleMatcher struct {
+    rules []*watchRule
+    subdomains bool
+// positions in 'rules', by normalized name and by parent domain
+    exact map[string][]int
+    by_parent map[string][]int
+    suffixes *suffixNode
+    substrings *ahoCorasick
+// keyword, glob and regex rules with no literal substring to index by; these are tried on every name
+    unindexed []int
+// the domains of the exact and suffix rules, for the lookalike detector
+    brands []*lookalikeBrand
+}
+
+// a node of the reversed-label trie.  the root is the empty domain, its children are top-level domains, and so on
+type suffixNode struct {
+    children map[string]*suffixNode
+// positions of the rules for this node's domain
+    rules []int
+}
+
+// compile a list of rules.  'subdomains' makes exact rules match subdomains too
+func compileRules(rules []*watchRule, subdomains bool) *ruleMatcher {
+
+    matcher := ruleMatcher{rules: rules, subdomains: subdomains}
+    matcher.exact = make(map[string][]int)
+    matcher.by_parent = make(map[string][]int)
+    matcher.suffixes = &suffixNode{}
+    var substrings []string
+    var substring_rules []int
+
+    for i, rule := range rules {
+        switch rule.kind {
+        case "exact", "suffix":
+            pattern := normalizeName(rule.pattern)
+            domain := strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+            if rule.kind == "exact" && domain == pattern {
+                matcher.exact[pattern] = append(matcher.exact[pattern], i)
+            }
+            if rule.kind == "suffix" || subdomains || domain != pattern {
+                matcher.suffixes.add(domain, i)
+            }
+// a wildcard certificate for *.example.com covers api.example.com
+            if domain == pattern {
+                if dot := strings.Index(domain, "."); dot != -1 {
+                    matcher.by_parent[domain[dot+1:]] = append(matcher.by_parent[domain[dot+1:]], i)
+                }
+            }
+        case "registrable":
+            matcher.suffixes.add(normalizeName(rule.pattern), i)
+        case "keyword", "glob", "regex":
+            substring := requiredSubstring(rule)
+            if substring == "" {
+                matcher.unindexed = append(matcher.unindexed, i)
+            } else {
+                substrings = append(substrings, substring)
+                substring_rules = append(substring_rules, i)
+            }
+        }
+    }
+
+    matcher.substrings = newAhoCorasick(substrings, substring_rules)
+    matcher.brands = lookalikeBrands(rules)
+
+    return &matcher
+
+}
+
+// find the rules matched by any of a certificate's names.  returns the same as matchRules
+func (matcher *ruleMatcher) match(names []string) []ruleMatch {
+
+    if matcher == nil || len(matcher.rules) == 0 {
+        return nil
+    }
+
+    first_name := make(map[int]string)
+    for _, name := range names {
+        normalized := normalizeName(name)
+        for _, i := range matcher.candidates(normalized) {
+            if _, ok := first_name[i]; ok {
+                continue
+            }
+            if matcher.rules[i].match(name, matcher.subdomains) {
+                first_name[i] = name
+            }
+        }
+    }
+
+    positions := make([]int, 0, len(first_name))
+    for i := range first_name {
+        positions = append(positions, i)
+    }
+    sort.Ints(positions)
+
+    matches := make([]ruleMatch, len(positions))
+    for j, i := range positions {
+        matches[j] = ruleMatch{rule: matcher.rules[i], name: first_name[i]}
+    }
+
+    return matches
+
+}
+
+// the positions of the rules that might match a normalized name
+func (matcher *ruleMatcher) candidates(name string) []int {
+
+    var candidates []int
+    candidates = append(candidates, matcher.exact[name]...)
+    if strings.HasPrefix(name, "*.") {
+        candidates = append(candidates, matcher.by_parent[name[2:]]...)
+    }
+    candidates = matcher.suffixes.collect(name, candidates)
+    candidates = matcher.substrings.search(name, candidates)
+// keyword, glob and regex rules may be written with the Unicode form of a name
+    if unicode_name := unicodeName(name); unicode_name != name {
+        candidates = matcher.substrings.search(unicode_name, candidates)
+    }
+    candidates = append(candidates, matcher.unindexed...)
+
+    return candidates
+
+}
+
+// add the rule at position 'i' to the trie under 'domain'
+func (node *suffixNode) add(domain string, i int) {
+
+    labels := strings.Split(domain, ".")
+    for j := len(labels) - 1; j >= 0; j-- {
+        if node.children == nil {
+            node.children = make(map[string]*suffixNode)
+        }
+        child, ok := node.children[labels[j]]
+        if !ok {
+            child = &suffixNode{}
+            node.children[labels[j]] = child
+        }
+        node = child
+    }
+    node.rules = append(node.rules, i)
+
+}
+
+// append the rules for every domain that 'name' is in, or equal to, to 'candidates'
+func (node *suffixNode) collect(name string, candidates []int) []int {
+
+    labels := strings.Split(name, ".")
+    for j := len(labels) - 1; j >= 0; j-- {
+        child, ok := node.children[labels[j]]
+        if !ok {
+            break
+        }
+        node = child
+        candidates = append(candidates, node.rules...)
+    }
+
+    return candidates
+
+}
+
+// a literal substring of the (lower-case) name that every match of a glob or regex rule contains, or "" if there isn't one.  the longest is best, since it's the least likely to turn up in names that don't match
+func requiredSubstring(rule *watchRule) string {
+
+    switch rule.kind {
+    case "keyword":
+        return strings.ToLower(rule.pattern)
+    case "glob":
+        longest := ""
+        for _, part := range strings.FieldsFunc(strings.ToLower(rule.pattern), func(c rune) bool { return c == '*' || c == '?' }) {
+            if len(part) > len(longest) {
+                longest = part
+            }
+        }
+        return longest
+    case "regex":
+// a case-insensitive expression can match a literal in any case; the name is lower-case, so the literal has to be too
+        prefix, _ := rule.regex.LiteralPrefix()
+        if prefix != strings.ToLower(prefix) {
+            return ""
+        }
+        return prefix
+    }
+
+    return ""
+
+}
+
+// an Aho-Corasick automaton over a set of substrings, each belonging to a rule.  it finds every substring in a name in one pass over the name
+type ahoCorasick struct {
+    next []map[byte]int
+    fail []int
+// the positions of the rules whose substring ends at each state
+    output [][]int
+}
+
+// build the automaton for 'substrings', where substrings[k] belongs to the rule at position rules[k]
+func newAhoCorasick(substrings []string, rules []int) *ahoCorasick {
+
+    automaton := ahoCorasick{next: []map[byte]int{{}}, fail: []int{0}, output: [][]int{nil}}
+
+// build a trie of the substrings
+    for k, substring := range substrings {
+        state := 0
+        for j := 0; j < len(substring); j++ {
+            next, ok := automaton.next[state][substring[j]]
+            if !ok {
+                next = len(automaton.next)
+                automaton.next = append(automaton.next, map[byte]int{})
+                automaton.fail = append(automaton.fail, 0)
+                automaton.output = append(automaton.output, nil)
+                automaton.next[state][substring[j]] = next
+            }
+            state = next
+        }
+        automaton.output[state] = append(automaton.output[state], rules[k])
+    }
+
+// link each state to the longest proper suffix of it that's also in the trie, breadth first, so the suffix's links are ready first
+    var queue []int
+    for _, state := range automaton.next[0] {
+        queue = append(queue, state)
+    }
+    for len(queue) > 0 {
+        state := queue[0]
+        queue = queue[1:]
+        for c, next := range automaton.next[state] {
+            fail := automaton.fail[state]
+            for fail != 0 {
+                if _, ok := automaton.next[fail][c]; ok {
+                    break
+                }
+                fail = automaton.fail[fail]
+            }
+            if target, ok := automaton.next[fail][c]; ok && target != next {
+                automaton.fail[next] = target
+            }
+            automaton.output[next] = append(automaton.output[next], automaton.output[automaton.fail[next]]...)
+            queue = append(queue, next)
+        }
+    }
+
+    return &automaton
+
+}
+
+// append the rules whose substring appears in 'name' to 'candidates'
+func (automaton *ahoCorasick) search(name string, candidates []int) []int {
+
+    state := 0
+    for j := 0; j < len(name); j++ {
+        for {
+            if next, ok := automaton.next[state][name[j]]; ok {
+                state = next
+                break
+            }
+            if state == 0 {
+                break
+            }
+            state = automaton.fail[state]
+        }
+        candidates = append(candidates, automaton.output[state]...)
+    }
+
+    return candidates
+
+}
@@ -0,0 +1,123 @@
+package ctl_monitor_lib
+
+import "strings"
+import "golang.org/x/net/idna"
+
+// a rule that matched, and the name in a certificate that matched it
+type ruleMatch struct {
+    rule *watchRule
+    name string
+}
+
+// find the rules matched by any of a certificate's names.  returns one match per rule, in the order of 'rules', with the first name that matched it.  this tries every rule on every name; monitors use the compiled ruleMatcher instead, which gives the same answer
+func matchRules(rules []*watchRule, names []string, subdomains bool) []ruleMatch {
+
+    var matches []ruleMatch
+    for _, rule := range rules {
+        for _, name := range names {
+            if rule.match(name, subdomains) {
+                matches = append(matches, ruleMatch{rule: rule, name: name})
+                break
+            }
+        }
+    }
+
+    return matches
+
+}
+
+// whether the name 'name' from a certificate matches the hostname 'hostname' we're monitoring for.  names are compared on DNS label boundaries, ignoring case and a trailing dot:
+//   - a hostname like '*.example.com' or '.example.com' matches any subdomain of example.com, however deep
+//   - any other hostname matches itself, and, if 'subdomains' is set, any subdomain of itself
+//   - a wildcard name like '*.example.com' in a certificate covers exactly one label, so it matches 'api.example.com' but not 'example.com' or 'a.b.example.com'
+func matchName(hostname string, name string, subdomains bool) bool {
+
+    hostname = normalizeName(hostname)
+    name = normalizeName(name)
+    if hostname == "" || name == "" {
+        return false
+    }
+
+    if name == hostname {
+        return true
+    }
+
+// the hostname covers a whole domain
+    if strings.HasPrefix(hostname, "*.") || strings.HasPrefix(hostname, ".") {
+        return isSubdomain(name, strings.TrimPrefix(hostname, "*"))
+    }
+    if subdomains && isSubdomain(name, "." + hostname) {
+        return true
+    }
+
+// the certificate covers a whole domain
+    if strings.HasPrefix(name, "*.") {
+        label := strings.TrimSuffix(hostname, name[1:])
+        return label != hostname && label != "" && !strings.Contains(label, ".")
+    }
+
+    return false
+
+}
+
+// whether 'name' is below 'suffix', which starts with a dot
+func isSubdomain(name string, suffix string) bool {
+
+    return len(name) > len(suffix) && strings.HasSuffix(name, suffix)
+
+}
+
+// internationalized names are mapped with UTS-46 and checked against IDNA2008.  certificates often have labels like '_dmarc' that aren't strictly hostnames, so those are allowed
+var IDNA_PROFILE *idna.Profile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.StrictDomainName(false))
+
+// DNS names are case-insensitive, 'example.com.' is the same name as 'example.com', and 'münchen.example' is the same name as 'xn--mnchen-3ya.example'.  names are compared in their ASCII (A-label) form.  a name that isn't a valid internationalized name is only lower-cased
+func normalizeName(name string) string {
+
+    name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+    if isASCII(name) {
+        return name
+    }
+
+// only the domain of an email address is a DNS name.  URIs aren't names at all
+    if strings.ContainsAny(name, ":/") {
+        return name
+    }
+    local, domain := "", name
+    if at := strings.LastIndex(name, "@"); at != -1 {
+        local, domain = name[:at+1], name[at+1:]
+    }
+    ascii, err := IDNA_PROFILE.ToASCII(domain)
+    if err != nil {
+        return name
+    }
+
+    return local + ascii
+
+}
+
+// the Unicode (U-label) form of a normalized name, as it would be displayed.  a name without A-labels is returned as it is
+func unicodeName(name string) string {
+
+    if !strings.Contains(name, "xn--") || strings.ContainsAny(name, "@:/") {
+        return name
+    }
+    unicode_name, err := IDNA_PROFILE.ToUnicode(name)
+    if err != nil {
+        return name
+    }
+
+    return unicode_name
+
+}
+
+func isASCII(s string) bool {
+
+    for i := 0; i < len(s); i++ {
+        if s[i] >= 0x80 {
+            return false
+        }
+    }
+
+    return true
+
+}
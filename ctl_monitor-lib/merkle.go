@@ -0,0 +1,214 @@
+package ctl_monitor_lib
+
+import "bytes"
+import "crypto/sha256"
+import "encoding/base64"
+import "errors"
+import "fmt"
+
+// RFC 6962 hashes leaves and interior nodes with different one-byte prefixes, so that a leaf can't be passed off as a node
+const LEAF_HASH_PREFIX byte = 0x00
+const NODE_HASH_PREFIX byte = 0x01
+
+// hash of a Merkle tree leaf: SHA-256(0x00 || leaf)
+func leafHash(leaf []byte) []byte {
+
+    h := sha256.New()
+    h.Write([]byte{LEAF_HASH_PREFIX})
+    h.Write(leaf)
+    return h.Sum(nil)
+
+}
+
+// hash of an interior node: SHA-256(0x01 || left || right)
+func nodeHash(left []byte, right []byte) []byte {
+
+    h := sha256.New()
+    h.Write([]byte{NODE_HASH_PREFIX})
+    h.Write(left)
+    h.Write(right)
+    return h.Sum(nil)
+
+}
+
+// decode a list of base64-encoded hashes, as returned in proofs by the CT log
+func decodeHashes(encoded []string) ([][]byte, error) {
+
+    hashes := make([][]byte, len(encoded))
+    for i, entry := range encoded {
+        hash, err := base64.StdEncoding.DecodeString(entry)
+        if err != nil {
+            return nil, err
+        }
+        if len(hash) != sha256.Size {
+            return nil, fmt.Errorf("Invalid hash at position %d: must be 32 bytes", i)
+        }
+        hashes[i] = hash
+    }
+
+    return hashes, nil
+
+}
+
+// verify that the tree of size 'second' with root 'second_root' is an append-only extension of the tree of size 'first' with root 'first_root', following the algorithm in RFC 9162, section 2.1.4.2
+func verifyConsistencyProof(first uint64, second uint64, first_root []byte, second_root []byte, proof [][]byte) error {
+
+    if first > second {
+        return fmt.Errorf("Tree shrank from %d to %d entries", first, second)
+    }
+    if first == second {
+        if len(proof) != 0 {
+            return errors.New("Consistency proof between trees of the same size must be empty")
+        }
+        if !bytes.Equal(first_root, second_root) {
+            return errors.New("Trees of the same size have different roots")
+        }
+        return nil
+    }
+// every tree is an extension of the empty tree
+    if first == 0 {
+        return nil
+    }
+    if len(proof) == 0 {
+        return errors.New("Consistency proof is empty")
+    }
+
+// if the old tree is a complete subtree, its root is the first node of the path
+    if first&(first-1) == 0 {
+        proof = append([][]byte{first_root}, proof...)
+    }
+
+    fn := first - 1
+    sn := second - 1
+    for fn&1 == 1 {
+        fn >>= 1
+        sn >>= 1
+    }
+
+    fr := proof[0]
+    sr := proof[0]
+    for _, c := range proof[1:] {
+        if sn == 0 {
+            return errors.New("Consistency proof is too long")
+        }
+        if fn&1 == 1 || fn == sn {
+            fr = nodeHash(c, fr)
+            sr = nodeHash(c, sr)
+            for fn&1 == 0 && fn != 0 {
+                fn >>= 1
+                sn >>= 1
+            }
+        } else {
+            sr = nodeHash(sr, c)
+        }
+        fn >>= 1
+        sn >>= 1
+    }
+
+    if sn != 0 {
+        return errors.New("Consistency proof is too short")
+    }
+    if !bytes.Equal(fr, first_root) {
+        return errors.New("Consistency proof does not match the old root")
+    }
+    if !bytes.Equal(sr, second_root) {
+        return errors.New("Consistency proof does not match the new root")
+    }
+
+    return nil
+
+}
+
+// verify that the leaf with hash 'leaf_hash' is at position 'index' in the tree of size 'tree_size' with root 'root', following the algorithm in RFC 9162, section 2.1.3.2
+func verifyInclusionProof(index uint64, tree_size uint64, leaf_hash []byte, root []byte, proof [][]byte) error {
+
+    if index >= tree_size {
+        return fmt.Errorf("Leaf index %d is outside the tree of size %d", index, tree_size)
+    }
+
+    fn := index
+    sn := tree_size - 1
+    r := leaf_hash
+    for _, p := range proof {
+        if sn == 0 {
+            return errors.New("Inclusion proof is too long")
+        }
+        if fn&1 == 1 || fn == sn {
+            r = nodeHash(p, r)
+            for fn&1 == 0 && fn != 0 {
+                fn >>= 1
+                sn >>= 1
+            }
+        } else {
+            r = nodeHash(r, p)
+        }
+        fn >>= 1
+        sn >>= 1
+    }
+
+    if sn != 0 {
+        return errors.New("Inclusion proof is too short")
+    }
+    if !bytes.Equal(r, root) {
+        return errors.New("Inclusion proof does not match the root")
+    }
+
+    return nil
+
+}
+
+// verify a consistency proof between two signed tree heads
+func verifySTHConsistency(old_sth Signed_tree_head, new_sth Signed_tree_head, proof [][]byte) error {
+
+    old_root, err := base64.StdEncoding.DecodeString(old_sth.Sha256_root_hash)
+    if err != nil {
+        return err
+    }
+    new_root, err := base64.StdEncoding.DecodeString(new_sth.Sha256_root_hash)
+    if err != nil {
+        return err
+    }
+
+    return verifyConsistencyProof(old_sth.Tree_size, new_sth.Tree_size, old_root, new_root, proof)
+
+}
+
+// a compact Merkle range: the roots of the complete subtrees covering leaves [0, size), largest first.  this is enough to compute the root of the tree without keeping every leaf hash
+type compactRange struct {
+    hashes [][]byte
+    sizes []uint64
+    size uint64
+}
+
+// append the hash of the next leaf, merging complete subtrees of equal size
+func (r *compactRange) appendLeafHash(hash []byte) {
+
+    r.hashes = append(r.hashes, hash)
+    r.sizes = append(r.sizes, 1)
+    r.size += 1
+
+    for n := len(r.sizes); n > 1 && r.sizes[n-2] == r.sizes[n-1]; n = len(r.sizes) {
+        r.hashes[n-2] = nodeHash(r.hashes[n-2], r.hashes[n-1])
+        r.sizes[n-2] *= 2
+        r.hashes = r.hashes[:n-1]
+        r.sizes = r.sizes[:n-1]
+    }
+
+}
+
+// the root hash of the tree made of the leaves appended so far
+func (r *compactRange) root() []byte {
+
+    if len(r.hashes) == 0 {
+        empty := sha256.Sum256(nil)
+        return empty[:]
+    }
+
+    root := r.hashes[len(r.hashes)-1]
+    for i := len(r.hashes) - 2; i >= 0; i-- {
+        root = nodeHash(r.hashes[i], root)
+    }
+
+    return root
+
+}
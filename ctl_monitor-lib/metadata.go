@@ -0,0 +1,182 @@
+package ctl_monitor_lib
+
+import "crypto/dsa"
+import "crypto/ecdsa"
+import "crypto/ed25519"
+import "crypto/rsa"
+import "crypto/sha256"
+import "crypto/x509"
+import "encoding/hex"
+import "fmt"
+import "strings"
+
+// the fields of a certificate stored with each row of 'certificates', so it can be searched without parsing the certificate again
+type certMetadata struct {
+// the hex SHA-256 fingerprint of the certificate, or for a PreCert entry, of the precertificate in its extra_data
+    sha256 string
+    serial string
+    issuer_dn string
+    subject_dn string
+// every name in the Subject Alternative Name extension, comma-separated
+    sans string
+// the validity period, in milliseconds like 'timestamp'
+    not_before int64
+    not_after int64
+    key_algorithm string
+    key_size int
+    signature_algorithm string
+// comma-separated, like 'digitalSignature,keyEncipherment' and 'serverAuth,clientAuth'
+    key_usage string
+    ext_key_usage string
+// like 'CA:FALSE', or 'CA:TRUE,pathlen:0'; empty if the certificate has no basic constraints
+    basic_constraints string
+    subject_key_id string
+    authority_key_id string
+}
+
+// the columns of 'certificates' that hold a certificate's metadata, and the types to add them with.  these are also the fields that certificates can be listed by
+var METADATA_COLUMNS [][2]string = [][2]string{
+    {"sha256", "TEXT"},
+    {"serial", "TEXT"},
+    {"issuer_dn", "TEXT"},
+    {"subject_dn", "TEXT"},
+    {"sans", "TEXT"},
+    {"not_before", "INTEGER"},
+    {"not_after", "INTEGER"},
+    {"key_algorithm", "TEXT"},
+    {"key_size", "INTEGER"},
+    {"signature_algorithm", "TEXT"},
+    {"key_usage", "TEXT"},
+    {"ext_key_usage", "TEXT"},
+    {"basic_constraints", "TEXT"},
+    {"subject_key_id", "TEXT"},
+    {"authority_key_id", "TEXT"},
+}
+
+// the names of the key usage bits, in bit order, as RFC 5280 gives them
+var KEY_USAGES []string = []string{"digitalSignature", "contentCommitment", "keyEncipherment", "dataEncipherment", "keyAgreement", "keyCertSign", "cRLSign", "encipherOnly", "decipherOnly"}
+
+var EXT_KEY_USAGES map[x509.ExtKeyUsage]string = map[x509.ExtKeyUsage]string{
+    x509.ExtKeyUsageAny: "any",
+    x509.ExtKeyUsageServerAuth: "serverAuth",
+    x509.ExtKeyUsageClientAuth: "clientAuth",
+    x509.ExtKeyUsageCodeSigning: "codeSigning",
+    x509.ExtKeyUsageEmailProtection: "emailProtection",
+    x509.ExtKeyUsageIPSECEndSystem: "ipsecEndSystem",
+    x509.ExtKeyUsageIPSECTunnel: "ipsecTunnel",
+    x509.ExtKeyUsageIPSECUser: "ipsecUser",
+    x509.ExtKeyUsageTimeStamping: "timeStamping",
+    x509.ExtKeyUsageOCSPSigning: "OCSPSigning",
+    x509.ExtKeyUsageMicrosoftServerGatedCrypto: "msSGC",
+    x509.ExtKeyUsageNetscapeServerGatedCrypto: "nsSGC",
+    x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "msCodeCom",
+    x509.ExtKeyUsageMicrosoftKernelCodeSigning: "msKernelCode",
+}
+
+// the metadata of the certificate parsed from 'leaf'
+func getMetadata(cert *x509.Certificate, leaf MerkleTreeLeaf) certMetadata {
+
+    var metadata certMetadata
+
+// the certificate parsed from a PreCert entry was put together from its TBSCertificate, so it's the precertificate that has a fingerprint
+    if leaf.LogEntryType == 1 {
+        precert, _, err := parseChain(leaf)
+        if err == nil {
+            fingerprint := sha256.Sum256(precert)
+            metadata.sha256 = hex.EncodeToString(fingerprint[:])
+        }
+    } else {
+        fingerprint := sha256.Sum256(cert.Raw)
+        metadata.sha256 = hex.EncodeToString(fingerprint[:])
+    }
+
+    metadata.serial = cert.SerialNumber.Text(16)
+    metadata.issuer_dn = cert.Issuer.String()
+    metadata.subject_dn = cert.Subject.String()
+
+    var sans []string
+    sans = append(sans, cert.DNSNames...)
+    for _, ip := range cert.IPAddresses {
+        sans = append(sans, ip.String())
+    }
+    sans = append(sans, cert.EmailAddresses...)
+    for _, uri := range cert.URIs {
+        sans = append(sans, uri.String())
+    }
+    metadata.sans = strings.Join(sans, ",")
+    metadata.not_before = cert.NotBefore.UnixMilli()
+    metadata.not_after = cert.NotAfter.UnixMilli()
+
+    metadata.key_algorithm = cert.PublicKeyAlgorithm.String()
+    metadata.key_size = keySize(cert.PublicKey)
+    metadata.signature_algorithm = cert.SignatureAlgorithm.String()
+
+    var usages []string
+    for bit, name := range KEY_USAGES {
+        if cert.KeyUsage & (1 << bit) != 0 {
+            usages = append(usages, name)
+        }
+    }
+    metadata.key_usage = strings.Join(usages, ",")
+
+    usages = nil
+    for _, usage := range cert.ExtKeyUsage {
+        name, ok := EXT_KEY_USAGES[usage]
+        if !ok {
+            name = fmt.Sprint(usage)
+        }
+        usages = append(usages, name)
+    }
+// usages Go doesn't know are given by OID
+    for _, oid := range cert.UnknownExtKeyUsage {
+        usages = append(usages, oid.String())
+    }
+    metadata.ext_key_usage = strings.Join(usages, ",")
+
+    if cert.BasicConstraintsValid {
+        metadata.basic_constraints = "CA:FALSE"
+        if cert.IsCA {
+            metadata.basic_constraints = "CA:TRUE"
+            if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+                metadata.basic_constraints += fmt.Sprintf(",pathlen:%d", cert.MaxPathLen)
+            }
+        }
+    }
+
+    metadata.subject_key_id = hex.EncodeToString(cert.SubjectKeyId)
+    metadata.authority_key_id = hex.EncodeToString(cert.AuthorityKeyId)
+
+    return metadata
+
+}
+
+// the size of a public key in bits: the modulus of an RSA or DSA key, or the curve of an ECDSA one.  0 if the key is of a kind Go can't parse
+func keySize(key interface{}) int {
+
+    switch key := key.(type) {
+    case *rsa.PublicKey:
+        return key.N.BitLen()
+    case *ecdsa.PublicKey:
+        return key.Curve.Params().BitSize
+    case ed25519.PublicKey:
+        return 256
+    case *dsa.PublicKey:
+        return key.P.BitLen()
+    }
+
+    return 0
+
+}
+
+// whether 'field' is one of the metadata columns
+func isMetadataColumn(field string) bool {
+
+    for _, column := range METADATA_COLUMNS {
+        if column[0] == field {
+            return true
+        }
+    }
+
+    return false
+
+}
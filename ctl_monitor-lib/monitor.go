@@ -1,73 +1,229 @@
 package ctl_monitor_lib
 
+import "errors"
 import "fmt"
 import "log"
 import "database/sql"
 import _ "github.com/mattn/go-sqlite3"
 import "time"
 import "regexp"
+import "sort"
 import "strings"
+import "encoding/base64"
+import "sync"
+import "sync/atomic"
 import "github.com/prometheus/client_golang/prometheus"
 
 var REQUEST_SIZE uint64 = 1024
 var SLEEP time.Duration = 5 * time.Minute
+// maximum merge delay of logs that don't come from a log list
+var DEFAULT_MMD time.Duration = 24 * time.Hour
+
+// one certificate can match several hostnames, so each gets its own row
+const CREATE_CERTIFICATES_TABLE string = "CREATE TABLE IF NOT EXISTS certificates (timestamp INTEGER, commonname TEXT, certificate TEXT, logentrytype TEXT, ctl TEXT, hostname TEXT, PRIMARY KEY (ctl, timestamp, commonname, certificate, logentrytype, hostname) )"
+
+// one row for each name in a certificate that looks like a watched domain, with the rule it looks like
+const CREATE_LOOKALIKES_TABLE string = "CREATE TABLE IF NOT EXISTS lookalikes (timestamp INTEGER, name TEXT, unicode_name TEXT, hostname TEXT, rule_id INTEGER, score REAL, reason TEXT, commonname TEXT, certificate TEXT, logentrytype TEXT, leaf_hash TEXT, ctl TEXT, PRIMARY KEY (ctl, leaf_hash, name, hostname) )"
 
 type db_row struct {
     timestamp uint64
     common_name string
+    matched_name string
+    matched_name_unicode string
     cert string
     logentrytype string
+    ctl string
+// -1 for rows stored before the index was
+    leaf_index int64
+    metadata certMetadata
 }
 
-type Monitor struct {
-    ctl_host string
-    hostnames []string
-    tree_head Signed_tree_head
+type domain_row struct {
+    registrable_domain string
+    timestamp uint64
+    name string
+    ctl string
+}
+
+// state shared by every Monitor in the process: the hostname list, the database, and the prometheus metrics
+type sharedState struct {
+// the hostname list is a list of watch rules (see parseRule)
+    rules []*watchRule
+    rules_lock sync.RWMutex
+// the rules compiled into a *ruleMatcher.  it's replaced, never changed, whenever the list changes, so monitors can match without holding rules_lock
+    matcher atomic.Value
     database *sql.DB
     certificate_metrics *prometheus.CounterVec
-    Signal chan int
+    sth_failure_metrics *prometheus.CounterVec
+    consistency_failure_metrics *prometheus.CounterVec
+    root_mismatch_metrics *prometheus.CounterVec
+    inclusion_failure_metrics *prometheus.CounterVec
+    request_failure_metrics *prometheus.CounterVec
+    lookalike_metrics *prometheus.CounterVec
+    registrable_domain_metrics *prometheus.CounterVec
+    sct_failure_metrics *prometheus.CounterVec
+    overdue_sct_metrics *prometheus.GaugeVec
+    split_view_metrics *prometheus.CounterVec
+    sth_age_metrics *prometheus.GaugeVec
+    sth_growth_rate_metrics *prometheus.GaugeVec
+// the logs whose keys we have, by log id, to check the SCTs in certificates with
+    known_logs map[[32]byte]*knownLog
+    known_logs_lock sync.RWMutex
     VERBOSE bool
     NON_STRICT bool
 }
 
-func NewMonitor(ctl_host string, hostnames []string, verbose bool, no_delete bool, non_strict bool) (*Monitor, error) {
+// a Monitor watches a single CT log.  it has its own tree head and public key, and shares everything else
+type Monitor struct {
+    *sharedState
+    ctl_host string
+    tree_head Signed_tree_head
+    log_key *logKey
+    mmd time.Duration
+// every entry before next_index has been searched
+    next_index uint64
+// whether the monitor picked up from a checkpoint stored by an earlier run
+    resumed bool
+// Check and buildDB can be called from the monitor's goroutine and from the HTTP API at the same time
+    check_lock sync.Mutex
+// Check replaces the tree head and advances next_index while the SCT auditor, the gossip poller and the HTTP API read them, so they're only read through getTreeHead and getNextIndex
+    tree_head_lock sync.RWMutex
+// how many get-entries requests to keep in flight
+    fetch_concurrency int
+// how many entries to ask the log for at once, once it's shown it returns fewer than REQUEST_SIZE, and the most it has returned
+    batch_size uint64
+    max_received uint64
+    batch_lock sync.Mutex
+// closed by Stop to end the goroutine started by Activate.  a new one is made each time the monitor is started
+    stop chan struct{}
+// closed when the log is removed, so a check or build in progress gives up instead of holding on to it
+    done chan struct{}
+    active bool
+}
+
+// open the database and register the metrics shared by every monitor
+func newSharedState(database_name string, hostnames []string, verbose bool, no_delete bool, non_strict bool) (*sharedState, error) {
+
+    var shared sharedState
+
+    shared.VERBOSE = verbose
+    shared.NON_STRICT = non_strict
+
+// prepare database
+    var err error
+    shared.database, err = prepareDatabase(database_name, shared.VERBOSE, no_delete)
+    if err != nil {
+        log.Println("Error initializing database.")
+        return &shared, err
+    }
+
+// prepare metrics
+    shared.certificate_metrics = registerCounterVec(prepareMetrics())
+    shared.sth_failure_metrics = registerCounterVec(prepareSTHFailureMetrics())
+    shared.consistency_failure_metrics = registerCounterVec(prepareConsistencyFailureMetrics())
+    shared.root_mismatch_metrics = registerCounterVec(prepareRootMismatchMetrics())
+    shared.inclusion_failure_metrics = registerCounterVec(prepareInclusionFailureMetrics())
+    shared.request_failure_metrics = registerCounterVec(prepareRequestFailureMetrics())
+    shared.lookalike_metrics = registerCounterVec(prepareLookalikeMetrics())
+    shared.registrable_domain_metrics = registerCounterVec(prepareRegistrableDomainMetrics())
+    shared.sct_failure_metrics = registerCounterVec(prepareSCTFailureMetrics())
+    shared.overdue_sct_metrics = registerGaugeVec(prepareOverdueSCTMetrics())
+    shared.split_view_metrics = registerCounterVec(prepareSplitViewMetrics())
+    shared.sth_age_metrics = registerGaugeVec(prepareSTHAgeMetrics())
+    shared.sth_growth_rate_metrics = registerGaugeVec(prepareSTHGrowthRateMetrics())
+
+// the rules need the database for their ids and the metrics for their counters
+    err = shared.addHostnames(hostnames)
+    if err != nil {
+        log.Println("Error adding hostnames.")
+        return &shared, err
+    }
+    if shared.VERBOSE { fmt.Printf("Hostnames: \n%v\n", shared.getHostnames()) }
+
+    return &shared, nil
+
+}
+
+func NewMonitor(ctl_host string, log_key string, mmd time.Duration, fetch_concurrency int, shared *sharedState) (*Monitor, error) {
 
     var monitor Monitor
 
-    monitor.VERBOSE = verbose
+    monitor.sharedState = shared
 
     if monitor.VERBOSE { fmt.Printf("Initializing new CTL monitor.\n") }
 
     monitor.ctl_host = ctl_host
     if monitor.VERBOSE { fmt.Printf("Certificate transparency log: %s\n", monitor.ctl_host) }
-    monitor.hostnames = hostnames
-    if monitor.VERBOSE { fmt.Printf("Hostnames: \n%v\n", hostnames) }
+    monitor.mmd = mmd
 
-    monitor.Signal = make(chan int)
+    monitor.fetch_concurrency = fetchConcurrency(fetch_concurrency)
 
-    sth, err := getSTH(ctl_host)
+    monitor.done = make(chan struct{})
+
+// load the log's public key.  without one, signed tree heads can't be verified
+    var err error
+    if log_key != "" {
+        monitor.log_key, err = loadLogKey(log_key)
+        if err != nil {
+            log.Println("Error loading log public key.")
+            return &monitor, err
+        }
+        shared.addKnownLog(ctl_host, monitor.log_key, mmd)
+    } else {
+        log.Printf("No public key given for %s; signed tree heads will not be verified\n", ctl_host)
+    }
+
+// resume from the checkpoint left by an earlier run, if there is one.  the first Check backfills everything logged since then
+    checkpoint, next_index, found, err := monitor.loadCheckpoint()
     if err != nil {
-        log.Println("Error getting signed tree head.")
+        log.Println("Error loading checkpoint.")
         return &monitor, err
     }
-    monitor.tree_head = sth
-    if monitor.VERBOSE { fmt.Printf("Tree head: \n%v\n", monitor.tree_head) }
+    if found {
+        err = monitor.checkCheckpoint(checkpoint)
+        if err == nil {
+            monitor.setTreeHead(checkpoint)
+            monitor.setNextIndex(next_index)
+            monitor.resumed = true
+            monitor.updateSTHMetrics(Signed_tree_head{})
+            if monitor.VERBOSE { fmt.Printf("Resuming %s from entry %d; tree head: \n%v\n", ctl_host, next_index, checkpoint) }
+            return &monitor, nil
+        }
+// the log's key may have changed since the checkpoint was saved.  its tree head can't be trusted, but the entries before it were searched, so start from the current tree head, which is verified like any other, and search from there
+        log.Printf("Checkpointed signed tree head for %s does not verify with its key; starting from the current tree head: %v\n", ctl_host, err)
+    }
 
-// prepare database
-    database_name := makeDBName(ctl_host)
-    monitor.database, err = prepareDatabase(database_name, monitor.VERBOSE, no_delete)
+// otherwise start from the current tree head
+    sth, err := getSTH(ctl_host, monitor.done)
     if err != nil {
-        log.Println("Error initializing database.")
+        log.Println("Error getting signed tree head.")
+        monitor.countRequestFailure(err)
         return &monitor, err
     }
+    fetched := time.Now()
+    err = monitor.verifySTH(sth)
+    if err != nil {
+        log.Println("Signed tree head failed verification.")
+        monitor.recordSTH(sth, fetched, STH_INVALID, STH_UNCHECKED, err)
+        return &monitor, err
+    }
+    monitor.setTreeHead(sth)
+    monitor.setNextIndex(sth.Tree_size)
+    if found && next_index <= sth.Tree_size {
+        monitor.setNextIndex(next_index)
+        monitor.resumed = true
+    }
+    monitor.recordSTH(sth, fetched, monitor.verificationResult(), STH_UNCHECKED, nil)
+    monitor.updateSTHMetrics(Signed_tree_head{})
+    if monitor.VERBOSE { fmt.Printf("Tree head: \n%v\n", sth) }
 
-// prepare metrics
-    monitor.certificate_metrics = prepareMetrics(monitor.hostnames)
-    prometheus.MustRegister(monitor.certificate_metrics)
-
-    monitor.NON_STRICT = non_strict
+    err = monitor.saveCheckpoint(monitor.database, monitor.getNextIndex())
+    if err != nil {
+        log.Println("Error saving checkpoint.")
+        return &monitor, err
+    }
 
-    return &monitor, err
+    return &monitor, nil
 
 }
 
@@ -77,76 +233,198 @@ func (m *Monitor) CTL_host() string {
 
 }
 
-// add hostnames
-func (m *Monitor) addHostnames(new_hostnames []string) {
+// add hostnames, or other watch rules.  every rule is validated before any is added, so an invalid one adds nothing
+func (s *sharedState) addHostnames(new_hostnames []string) error {
 
+    var new_rules []*watchRule
     for _, entry := range new_hostnames {
-// if a new hostname isn't already in the hostname list, append it
-        if index(m.hostnames, entry) == -1 {
-            m.hostnames = append(m.hostnames, entry)
+        rule, err := parseRule(entry)
+        if err != nil {
+            return err
         }
-        
-// create new counters for the new hostname, one for X509 entries, one for PreCert entries
-        m.certificate_metrics.WithLabelValues(entry, "X509")
-        m.certificate_metrics.WithLabelValues(entry, "PreCert")
+        new_rules = append(new_rules, rule)
     }
 
+    s.rules_lock.Lock()
+    defer s.rules_lock.Unlock()
+
+    for _, rule := range new_rules {
+// if a new rule isn't already in the hostname list, append it
+        if s.findRule(rule.text) != -1 {
+            continue
+        }
+        err := s.saveRule(rule)
+        if err != nil {
+            log.Println("Database error while saving rule", rule.text)
+            return err
+        }
+        s.rules = append(s.rules, rule)
 
-    if m.VERBOSE { fmt.Printf("Hostname list:%v\n", m.hostnames) }
+// create new counters for the new rule, one for X509 entries, one for PreCert entries
+        s.certificate_metrics.WithLabelValues(rule.text, rule.label(), "X509")
+        s.certificate_metrics.WithLabelValues(rule.text, rule.label(), "PreCert")
+    }
+    s.matcher.Store(compileRules(append([]*watchRule(nil), s.rules...), s.NON_STRICT))
+
+    if s.VERBOSE {
+        for _, rule := range new_rules {
+            fmt.Printf("Watching for %s (rule %d)\n", rule.text, rule.id)
+        }
+    }
+
+    return nil
 
 }
 
-// remove hostname
-func (m *Monitor) removeHostname(hostname string) {
+// remove hostname, given either the rule or its id.  returns the rule removed, or nil if there wasn't one
+func (s *sharedState) removeHostname(hostname string) *watchRule {
 
-    if m.VERBOSE { fmt.Printf("Removing %s from hostnames\n", hostname) }
+    if s.VERBOSE { fmt.Printf("Removing %s from hostnames\n", hostname) }
 
-    for i, entry := range m.hostnames {
-        if entry == hostname {
-            m.hostnames = append(m.hostnames[:i],m.hostnames[i+1:]...)
-        }
+    s.rules_lock.Lock()
+    var removed *watchRule
+    if i := s.findRule(hostname); i != -1 {
+        removed = s.rules[i]
+        s.rules = append(s.rules[:i], s.rules[i+1:]...)
+        s.matcher.Store(compileRules(append([]*watchRule(nil), s.rules...), s.NON_STRICT))
     }
+    s.rules_lock.Unlock()
     
-    if m.VERBOSE { fmt.Println("Hostname list:\n", m.hostnames) }
+    if s.VERBOSE { fmt.Println("Hostname list:\n", s.getHostnames()) }
+
+    return removed
+
+}
+
+// the position of the rule with text or id 'rule' in the hostname list, or -1.  a rule written another way that matches the same names (see watchRule.key) counts as the same rule.  the caller holds rules_lock
+func (s *sharedState) findRule(rule string) int {
+
+    key := ""
+    if parsed, err := parseRule(rule); err == nil {
+        key = parsed.key()
+    }
+
+    for i, entry := range s.rules {
+        if entry.text == strings.TrimSpace(rule) || entry.label() == rule || entry.key() == key {
+            return i
+        }
+    }
+
+    return -1
+
+}
+
+// list hostnames.  returns a copy, since monitors for other logs may change the list while the caller uses it
+func (s *sharedState) getHostnames() []string {
+
+    s.rules_lock.RLock()
+    defer s.rules_lock.RUnlock()
+
+    hostnames := make([]string, len(s.rules))
+    for i, rule := range s.rules {
+        hostnames[i] = rule.text
+    }
+
+    return hostnames
 
 }
 
-// list hostnames
-func (m *Monitor) getHostnames() []string {
+// the current hostname list, compiled for matching
+func (s *sharedState) getMatcher() *ruleMatcher {
 
-    return m.hostnames
+    matcher, _ := s.matcher.Load().(*ruleMatcher)
+    return matcher
+
+}
+
+// list the watch rules.  returns a copy of the list; the rules themselves never change
+func (s *sharedState) getRules() []*watchRule {
+
+    s.rules_lock.RLock()
+    defer s.rules_lock.RUnlock()
+
+    return append([]*watchRule(nil), s.rules...)
 
 }
 
 // return tree head
 func (m *Monitor) getTreeHead() Signed_tree_head {
 
+    m.tree_head_lock.RLock()
+    defer m.tree_head_lock.RUnlock()
+
     return m.tree_head
 
 }
 
+// replace tree head
+func (m *Monitor) setTreeHead(sth Signed_tree_head) {
+
+    m.tree_head_lock.Lock()
+    defer m.tree_head_lock.Unlock()
+
+    m.tree_head = sth
+
+}
+
+// return the index of the next entry to search
+func (m *Monitor) getNextIndex() uint64 {
+
+    m.tree_head_lock.RLock()
+    defer m.tree_head_lock.RUnlock()
+
+    return m.next_index
+
+}
+
+// advance the index of the next entry to search
+func (m *Monitor) setNextIndex(next_index uint64) {
+
+    m.tree_head_lock.Lock()
+    defer m.tree_head_lock.Unlock()
+
+    m.next_index = next_index
+
+}
+
 // return timestamp of treehead
 func (m *Monitor) getTimestamp() uint64 {
     
-    return m.tree_head.Timestamp
+    return m.getTreeHead().Timestamp
 
 }
 
 // return treesize
 func (m *Monitor) getTreeSize() uint64 {
 
-    return m.tree_head.Tree_size
+    return m.getTreeHead().Tree_size
 
 }
 
-// get timestamps and certificates for specified hostname
-func (m *Monitor) listCerts(hostname string) []db_row {
+// get timestamps, certificates and their metadata for specified hostname, from every log.  'filters' maps metadata columns to the values they must have
+func (s *sharedState) listCerts(hostname string, filters map[string]string) ([]db_row, error) {
+
+    hostname = s.ruleText(hostname)
+    query := "SELECT DISTINCT timestamp, commonname, IFNULL(matched_name, commonname), IFNULL(matched_name_unicode, IFNULL(matched_name, commonname)), certificate, logentrytype, IFNULL(ctl, ''), IFNULL(leaf_index, -1), IFNULL(sha256, ''), IFNULL(serial, ''), IFNULL(issuer_dn, ''), IFNULL(subject_dn, ''), IFNULL(sans, ''), IFNULL(not_before, 0), IFNULL(not_after, 0), IFNULL(key_algorithm, ''), IFNULL(key_size, 0), IFNULL(signature_algorithm, ''), IFNULL(key_usage, ''), IFNULL(ext_key_usage, ''), IFNULL(basic_constraints, ''), IFNULL(subject_key_id, ''), IFNULL(authority_key_id, '') FROM certificates WHERE hostname = ?"
+    args := []interface{}{hostname}
+    fields := make([]string, 0, len(filters))
+    for field := range filters {
+        if !isMetadataColumn(field) {
+            return nil, fmt.Errorf("Unknown certificate field %s", field)
+        }
+        fields = append(fields, field)
+    }
+    sort.Strings(fields)
+    for _, field := range fields {
+        query += " AND " + field + " = ?"
+        args = append(args, filters[field])
+    }
 
 // query the database
-    rows, err := m.database.Query("SELECT DISTINCT timestamp, certificate, logentrytype FROM certificates WHERE commonname = ?", hostname)
+    rows, err := s.database.Query(query, args...)
     if err != nil {
         log.Println("Error accessing database.")
-        log.Fatalln(err)
+        return nil, err
     }
     defer rows.Close()
 
@@ -154,155 +432,585 @@ func (m *Monitor) listCerts(hostname string) []db_row {
     var results []db_row
     var row db_row
     for rows.Next() {
-        err = rows.Scan(&row.timestamp, &row.cert, &row.logentrytype)
+        metadata := &row.metadata
+        err = rows.Scan(&row.timestamp, &row.common_name, &row.matched_name, &row.matched_name_unicode, &row.cert, &row.logentrytype, &row.ctl, &row.leaf_index, &metadata.sha256, &metadata.serial, &metadata.issuer_dn, &metadata.subject_dn, &metadata.sans, &metadata.not_before, &metadata.not_after, &metadata.key_algorithm, &metadata.key_size, &metadata.signature_algorithm, &metadata.key_usage, &metadata.ext_key_usage, &metadata.basic_constraints, &metadata.subject_key_id, &metadata.authority_key_id)
         if err != nil {
             log.Println("Error accessing database row.")
-            log.Fatalln(err)
+            return results, err
         }
         results = append(results, row)
     }
 
 // return results
-    return results
+    return results, rows.Err()
+
+}
+
+// the registrable domains that the rule 'hostname' has matched, with the first certificate name seen in each
+func (s *sharedState) listRegistrableDomains(hostname string) ([]domain_row, error) {
+
+    hostname = s.ruleText(hostname)
+    rows, err := s.database.Query("SELECT registrable_domain, timestamp, name, ctl FROM registrable_domains WHERE hostname = ? ORDER BY timestamp", hostname)
+    if err != nil {
+        log.Println("Error accessing database.")
+        return nil, err
+    }
+    defer rows.Close()
+
+    var results []domain_row
+    var row domain_row
+    for rows.Next() {
+        err = rows.Scan(&row.registrable_domain, &row.timestamp, &row.name, &row.ctl)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            return results, err
+        }
+        results = append(results, row)
+    }
+
+    return results, rows.Err()
+
+}
+
+// rows are stored under the rule as it was given.  a rule can be looked up by its id, or written another way (the other form of an internationalized name, say); this gives the text it was stored under
+func (s *sharedState) ruleText(hostname string) string {
+
+    s.rules_lock.RLock()
+    defer s.rules_lock.RUnlock()
+
+    if i := s.findRule(hostname); i != -1 {
+        return s.rules[i].text
+    }
+    return hostname
 
 }
 
-// search entire ct log and build database
-func (m *Monitor) buildDB() {
+// search entire ct log and build database.  every leaf is hashed along the way, and the resulting Merkle root is checked against the signed tree head; a mismatch raises an alert and is returned as an error
+func (m *Monitor) buildDB() error {
+
+// hold on to the tree head we're building against, in case Check replaces it while we work
+    sth := m.getTreeHead()
 
 // add all entries
-    if m.VERBOSE { fmt.Printf("Building database of certificates for hostnames %v\n", m.hostnames) }
-    m.addEntries(0, m.tree_head.Tree_size-1)
+    if m.VERBOSE { fmt.Printf("Building database of certificates in %s for hostnames %v\n", m.ctl_host, m.getHostnames()) }
+    var merkle_range compactRange
+    err := m.addEntries(0, sth.Tree_size-1, &merkle_range, false)
+    if err != nil {
+        log.Println("Error building database from", m.ctl_host)
+        log.Println(err)
+        return err
+    }
+
+    if merkle_range.size != sth.Tree_size {
+        err := fmt.Errorf("Only hashed %d of %d entries in %s; not checking the root hash", merkle_range.size, sth.Tree_size, m.ctl_host)
+        log.Println(err)
+        return err
+    }
+
+    root := base64.StdEncoding.EncodeToString(merkle_range.root())
+    if root != sth.Sha256_root_hash {
+        err := fmt.Errorf("Root hash computed from the entries of %s is %s, but the signed tree head of size %d has root %s", m.ctl_host, root, sth.Tree_size, sth.Sha256_root_hash)
+        log.Println("ALERT:", err)
+        m.root_mismatch_metrics.WithLabelValues(m.ctl_host).Inc()
+        return err
+    }
+
+    if m.VERBOSE { fmt.Printf("Root hash of the entries of %s matches the signed tree head of size %d\n", m.ctl_host, sth.Tree_size) }
+    return nil
 
 }
 
-// search ct log from entry 'start' to entry 'end' and add the appropriate certificates to the database.  if 'end' >= 'tree_size', replaces 'end' with 'tree_size'-1
-func (m *Monitor) addEntries(start uint64, end uint64) {
+// search ct log from entry 'start' to entry 'end' and add the appropriate certificates to the database.  if 'end' >= 'tree_size', replaces 'end' with 'tree_size'-1.  entries are fetched and parsed concurrently, but batches are written in order, one transaction each.  if 'merkle_range' isn't nil, the leaf hash of every entry is appended to it.  if 'checkpoint' is set, the checkpoint is advanced past each batch in the same transaction as the batch's rows, so an interruption loses at most one batch
+func (m *Monitor) addEntries(start uint64, end uint64, merkle_range *compactRange, checkpoint bool) error {
+
+// make sure we don't go past the end of the CT log
+    tree_size := m.getTreeSize()
+    if tree_size == 0 {
+        return nil
+    }
+    max := min(tree_size - 1, end)
+    if start > max {
+        return nil
+    }
 
 // prepare a statement to insert results into the database
-    if m.VERBOSE { fmt.Printf("Searching %s between entries %d and %d for certificates for hostnames %v\n", m.ctl_host, start, end, m.hostnames) }
-    statement, err := m.database.Prepare("INSERT OR IGNORE INTO certificates (timestamp, commonname, certificate, logentrytype) VALUES (?, ?, ?, ?)")
+    if m.VERBOSE { fmt.Printf("Searching %s between entries %d and %d for certificates for hostnames %v\n", m.ctl_host, start, max, m.getHostnames()) }
+    statement, err := m.database.Prepare("INSERT OR IGNORE INTO certificates (timestamp, commonname, certificate, logentrytype, leaf_hash, leaf_index, ctl, hostname, matched_name, matched_name_ascii, matched_name_unicode, registrable_domain, issuer_key_hash, tbs_hash, not_before, not_after, issuer_sha256, sha256, serial, issuer_dn, subject_dn, sans, key_algorithm, key_size, signature_algorithm, key_usage, ext_key_usage, basic_constraints, subject_key_id, authority_key_id, rule_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
     if err != nil {
-        log.Fatalln(err)
+        log.Println("Database error while preparing to add certificates")
+        return err
     }
     defer statement.Close()
 
-    var entries []rawEntry
+    pipeline := m.fetchEntries(start, max)
+    defer pipeline.stop()
+
+// batches finish out of order; hold on to each one until every batch before it has been written
+    pending := make(map[uint64]*entryBatch)
+    next := start
+    for batch := range pipeline.batches {
+        if m.removed() {
+            return errors.New("Stopped searching " + m.ctl_host + ": the log was removed")
+        }
+        if batch.err != nil {
+            log.Println("Error fetching entries", batch.start, "to", batch.end, "from", m.ctl_host)
+            return batch.err
+        }
+        pending[batch.start] = batch
+
+        for batch, ok := pending[next]; ok; batch, ok = pending[next] {
+            delete(pending, next)
+            err = m.writeBatch(statement, batch, merkle_range, checkpoint)
+            if err != nil {
+                return err
+            }
+            pipeline.release()
+            next = batch.end + 1
+        }
+    }
+
+    if next <= max {
+        return fmt.Errorf("Only searched %s up to entry %d of %d", m.ctl_host, next, max)
+    }
+
+    if m.VERBOSE { fmt.Printf("Done searching %s for certificates for hostnames %v\n", m.ctl_host, m.getHostnames()) }
+
+    return nil
+
+}
+
+// hash each entry in a batch, and find the ones that match a hostname.  this doesn't touch the database, so batches can be parsed concurrently
+func (m *Monitor) parseBatch(batch *entryBatch) {
+
+    batch.leaf_hashes = make([][]byte, len(batch.entries))
+
     var leaf MerkleTreeLeaf
     var timestamp uint64
-    var common_name string
-// make sure we don't go past the end of the CT log
-    max := min(m.tree_head.Tree_size - 1, end)
-
-// certificate logs are big; only fetch a few entries at a time
-    for ; start <= max; start += REQUEST_SIZE {
-        if m.VERBOSE { fmt.Printf("Checking entries starting at %d\n", start) }
-// request at most REQUEST_SIZE entries from the CT log
-        finish := min(start+REQUEST_SIZE, max)
-        entries = getEntries(m.ctl_host, start, finish)
+// the hostname list may change while we work; use the same list for the whole batch
+    matcher := m.getMatcher()
 
 // parse each entry the CT log returned
-        for _, entry := range entries {
+    for i, entry := range batch.entries {
+// hash every leaf, including ones we skip below.  if a leaf can't even be decoded, skip it; the root can't be recomputed
+        leaf_input, err := base64.StdEncoding.DecodeString(entry.Leaf_input)
+        if err != nil {
+            log.Println("Could not decode leaf", batch.start+uint64(i))
+            continue
+        }
+        leaf_hash := leafHash(leaf_input)
+        batch.leaf_hashes[i] = leaf_hash
+
 // if the entry is malformed, skip it and go on to the next one
-            leaf, err = parseLeafInput(entry)
-            if err != nil {
-                log.Println(err)
-                continue
-            }
-            timestamp = leaf.Timestamp
+        leaf, err = parseLeafInput(entry)
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+        timestamp = leaf.Timestamp
 
 // if the LogEntryType is neither 0 (X509) nor 1 (PreCert), skip it and go on to the next entry
-            if leaf.LogEntryType != 0 && leaf.LogEntryType != 1 {
-                continue
+        if leaf.LogEntryType != 0 && leaf.LogEntryType != 1 {
+            continue
+        }
+
+// parse the certificate entry and extract the commonname and subject alternative names.  if it's malformed, skip it and go on to the next entry
+        cert, err := getCertificate(leaf)
+        if err != nil {
+            continue
+        }
+        names := getNames(cert)
+        if m.VERBOSE { fmt.Println(timestamp, names, LOG_ENTRY_TYPE_MAP[leaf.LogEntryType]) }
+
+// keep one row for each rule that one of the names matches
+        matches := matcher.match(names)
+        var issuer_key_hash string
+        var chain []issuerCert
+        var tbs_hash string
+        var scts []embeddedSCT
+        var metadata certMetadata
+        if len(matches) > 0 {
+            if leaf.LogEntryType == 1 {
+                precert, err := parsePrecertEntry(leaf)
+                if err != nil {
+                    log.Println("Could not parse precertificate entry", batch.start+uint64(i))
+                    log.Println(err)
+                    continue
+                }
+                issuer_key_hash = base64.StdEncoding.EncodeToString(precert.Issuer_key_hash)
+            }
+            chain = getIssuers(leaf)
+            if leaf.LogEntryType == 0 && len(chain) > 0 {
+                issuer_key_hash = chain[0].key_hash
+            }
+            tbs_hash = tbsHash(cert)
+            if leaf.LogEntryType == 0 {
+                scts = m.checkEmbeddedSCTs(cert, issuer_key_hash)
             }
+            metadata = getMetadata(cert, leaf)
+        }
+        for _, match := range matches {
+            batch.matches = append(batch.matches, matchedCert{hostname: match.rule.text, rule_id: match.rule.id, rule_label: match.rule.label(), matched_name: match.name, matched_ascii: normalizeName(match.name), matched_unicode: unicodeName(normalizeName(match.name)), registrable_domain: registrableDomain(match.name), issuer_key_hash: issuer_key_hash, tbs_hash: tbs_hash, chain: chain, metadata: metadata, scts: scts, leaf_index: batch.start+uint64(i), timestamp: timestamp, common_name: cert.Subject.CommonName, cert: leaf.Entry, logentrytype: LOG_ENTRY_TYPE_MAP[leaf.LogEntryType], leaf_hash: base64.StdEncoding.EncodeToString(leaf_hash)})
+        }
+
+// a certificate that matches no rule may still be for a lookalike of one of the watched domains
+        if DETECT_LOOKALIKES && len(matches) == 0 {
+            for _, name := range names {
+                found, ok := detectLookalike(name, matcher.brands)
+                if !ok {
+                    continue
+                }
+                if m.VERBOSE { fmt.Printf("%s looks like %s (%s, score %.2f)\n", found.unicode_name, found.brand.domain, found.reason, found.score) }
+                batch.lookalikes = append(batch.lookalikes, lookalikeCert{lookalike: found, timestamp: timestamp, common_name: cert.Subject.CommonName, cert: leaf.Entry, logentrytype: LOG_ENTRY_TYPE_MAP[leaf.LogEntryType], leaf_hash: base64.StdEncoding.EncodeToString(leaf_hash)})
+            }
+        }
+    }
+
+}
+
+// write the matches from a parsed batch to the database in one transaction, along with the checkpoint if 'checkpoint' is set, then count them in the metrics.  batches must be written in order, since the leaf hashes are appended to 'merkle_range' and the checkpoint moves past the batch
+func (m *Monitor) writeBatch(statement *sql.Stmt, batch *entryBatch, merkle_range *compactRange, checkpoint bool) error {
+
+    if m.VERBOSE { fmt.Printf("Writing entries %d to %d of %s\n", batch.start, batch.end, m.ctl_host) }
+
+    if merkle_range != nil {
+        for i, leaf_hash := range batch.leaf_hashes {
+            if leaf_hash != nil && merkle_range.size == batch.start+uint64(i) {
+                merkle_range.appendLeafHash(leaf_hash)
+            }
+        }
+    }
+
+// each batch is written in its own transaction.  if any row of it can't be written, none are, and the checkpoint stays before it, so it's searched again
+    tx, err := m.database.Begin()
+    if err != nil {
+        log.Println("Database error while adding certificates")
+        return err
+    }
+    tx_statement := tx.Stmt(statement)
+
+// add the timestamp, commonname, certificate, certificate type, hostname and the name that matched it to the database, and count it for the appropriate metric
+    rows_added := make(map[[3]string]int64)
+    domains_added := make(map[[3]string]int64)
+    var new_domains []matchedCert
+    var invalid_scts [][2]string
+    for _, match := range batch.matches {
+        if m.VERBOSE { fmt.Println("Adding", match.timestamp, match.matched_name, match.cert, match.logentrytype, "for", match.hostname) }
+        issuer_sha256 := ""
+        if len(match.chain) > 0 {
+            issuer_sha256 = match.chain[0].fingerprint
+        }
+        metadata := match.metadata
+        results, err := tx_statement.Exec(match.timestamp, match.common_name, match.cert, match.logentrytype, match.leaf_hash, match.leaf_index, m.ctl_host, match.hostname, match.matched_name, match.matched_ascii, match.matched_unicode, match.registrable_domain, match.issuer_key_hash, match.tbs_hash, metadata.not_before, metadata.not_after, issuer_sha256, metadata.sha256, metadata.serial, metadata.issuer_dn, metadata.subject_dn, metadata.sans, metadata.key_algorithm, metadata.key_size, metadata.signature_algorithm, metadata.key_usage, metadata.ext_key_usage, metadata.basic_constraints, metadata.subject_key_id, metadata.authority_key_id, match.rule_id)
+        if err != nil {
+            tx.Rollback()
+            log.Println("Database error while adding certificates")
+            return err
+        }
+
+// each issuer is stored once, however many certificates it's in the chain of
+        err = saveIssuers(tx, match.chain)
+        if err != nil {
+            tx.Rollback()
+            log.Println("Database error while adding certificates")
+            return err
+        }
+        err = saveChain(tx, match.leaf_hash, m.ctl_host, match.chain)
+        if err != nil {
+            tx.Rollback()
+            log.Println("Database error while adding certificates")
+            return err
+        }
+        err = saveIssuance(tx, match, m.ctl_host)
+        if err != nil {
+            tx.Rollback()
+            log.Println("Database error while adding certificates")
+            return err
+        }
+        invalid, err := saveSCTs(tx, match, m.ctl_host)
+        if err != nil {
+            tx.Rollback()
+            log.Println("Database error while adding certificates")
+            return err
+        }
+        for _, sct := range invalid {
+            invalid_scts = append(invalid_scts, [2]string{sct.sct_ctl, match.common_name})
+        }
+        added, _ := results.RowsAffected()
+
+        rows_added[[3]string{match.hostname, match.rule_label, match.logentrytype}] += added
+        if match.registrable_domain != "" {
+            domains_added[[3]string{match.hostname, match.rule_label, match.registrable_domain}] += added
+        }
 
-// parse the certificate entry and extract the commonname field.  if it's malformed, skip it and go on to the next entry
-            common_name, err = getCommonname(leaf)
+// note the first certificate seen for each registrable domain a rule matches
+        if match.registrable_domain != "" && added > 0 {
+            results, err = tx.Exec("INSERT OR IGNORE INTO registrable_domains (registrable_domain, hostname, rule_id, timestamp, name, ctl) VALUES (?, ?, ?, ?, ?, ?)", match.registrable_domain, match.hostname, match.rule_id, match.timestamp, match.matched_name, m.ctl_host)
             if err != nil {
-                log.Println(err)
-                continue
+                tx.Rollback()
+                log.Println("Database error while adding registrable domains")
+                return err
             }
-            if m.VERBOSE { fmt.Println(timestamp, common_name, LOG_ENTRY_TYPE_MAP[leaf.LogEntryType]) }
-
-// check whether the commonname is one of the hostnames we're monitoring for
-            var hostname string
-            var i int
-            if m.NON_STRICT {
-                hostname, i = indexNonStrict(m.hostnames, common_name)
-            } else {
-                hostname = common_name
-                i = index(m.hostnames, common_name)
+            if new_domain, _ := results.RowsAffected(); new_domain > 0 {
+                new_domains = append(new_domains, match)
             }
+        }
+    }
+
+// lookalikes go in their own table, so they can be triaged apart from our own certificates
+    lookalikes_added := make(map[[3]string]int64)
+    for _, found := range batch.lookalikes {
+        results, err := tx.Exec("INSERT OR IGNORE INTO lookalikes (timestamp, name, unicode_name, hostname, rule_id, score, reason, commonname, certificate, logentrytype, leaf_hash, ctl) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", found.timestamp, found.name, found.unicode_name, found.brand.rule.text, found.brand.rule.id, found.score, found.reason, found.common_name, found.cert, found.logentrytype, found.leaf_hash, m.ctl_host)
+        if err != nil {
+            tx.Rollback()
+            log.Println("Database error while adding lookalikes")
+            return err
+        }
+        added, _ := results.RowsAffected()
 
-// if it is, add the timestamp, certificate type, commonname, and certificate type to the database, and increment the appropriate metric
-            if i != -1 {
-                if m.VERBOSE { fmt.Println("Adding", timestamp, common_name, leaf.Entry, LOG_ENTRY_TYPE_MAP[leaf.LogEntryType]) }
-                results, _ := statement.Exec(timestamp, common_name, leaf.Entry, LOG_ENTRY_TYPE_MAP[leaf.LogEntryType])
-                rows_added, _ := results.RowsAffected()
+        lookalikes_added[[3]string{found.brand.rule.text, found.brand.rule.label(), found.reason}] += added
+    }
 
-                metric := m.certificate_metrics.WithLabelValues(hostname, LOG_ENTRY_TYPE_MAP[leaf.LogEntryType])
-                metric.Add(float64(rows_added))
-            }        
+    if checkpoint {
+        err = m.saveCheckpoint(tx, batch.end + 1)
+        if err != nil {
+            tx.Rollback()
+            log.Println("Database error while saving checkpoint")
+            return err
         }
     }
 
-    if m.VERBOSE { fmt.Printf("Done searching %s for certificates for hostnames %v\n", m.ctl_host, m.hostnames) }
+    err = tx.Commit()
+    if err != nil {
+        log.Println("Database error while adding certificates")
+        return err
+    }
+
+// only count rows once they're safely in the database
+    for labels, count := range rows_added {
+        m.certificate_metrics.WithLabelValues(labels[0], labels[1], labels[2]).Add(float64(count))
+    }
+    for labels, count := range lookalikes_added {
+        m.lookalike_metrics.WithLabelValues(labels[0], labels[1], labels[2]).Add(float64(count))
+    }
+    for labels, count := range domains_added {
+        m.registrable_domain_metrics.WithLabelValues(labels[0], labels[1], labels[2]).Add(float64(count))
+    }
+    for _, sct := range invalid_scts {
+        log.Printf("ALERT: an SCT from %s in the certificate for %s found in %s does not verify\n", sct[0], sct[1], m.ctl_host)
+        m.sct_failure_metrics.WithLabelValues(sct[0]).Inc()
+    }
+    for _, match := range new_domains {
+        log.Printf("New registrable domain %s for %s: %s in %s\n", match.registrable_domain, match.hostname, match.matched_name, m.ctl_host)
+    }
+    if checkpoint {
+        m.setNextIndex(batch.end + 1)
+    }
+
+    return nil
 
 }
 
-// wakes up every SLEEP minutes to check for new entries.  
-func (m *Monitor) Activate(signal chan int) {
+// wakes up every SLEEP minutes to check for new entries, until 'stop' is closed or the log is removed
+func (m *Monitor) Activate(stop chan struct{}) {
 
-    if m.VERBOSE { fmt.Printf("Monitoring certificate transparency log %s for certificates for the following hostnames:\n%v\n", m.ctl_host, m.hostnames) }
+    if m.VERBOSE { fmt.Printf("Monitoring certificate transparency log %s for certificates for the following hostnames:\n%v\n", m.ctl_host, m.getHostnames()) }
     loop:
     for true {
         
         m.Check()
+        m.proveInclusions()
 
-// function exits if it receives a signal from the Stop() function
+// function exits once the Stop() function closes 'stop'
         select {
-            case <- signal: break loop
+            case <- stop: break loop
+            case <- m.done: break loop
             case <- time.After(SLEEP): if m.VERBOSE { fmt.Printf("Waking up\n") }
         }
     }
 
 }
 
-// check for new certificates
-func (m *Monitor) Check() {
+// check for new certificates.  requests to the log have already been retried by the time an error gets here; it's logged, counted in the metrics, and returned, and the next Check picks up from the checkpoint
+func (m *Monitor) Check() error {
+
+    m.check_lock.Lock()
+    defer m.check_lock.Unlock()
+
+// however the check goes, the age of the tree head we have goes up
+    old_sth := m.getTreeHead()
+    defer m.updateSTHMetrics(old_sth)
 
 // get the new signed tree head; if there's a problem, print and error and return
-    new_sth, err := getSTH(m.ctl_host)
+    new_sth, err := getSTH(m.ctl_host, m.done)
     if err != nil {
         log.Println("Error getting a new signed tree head")
         log.Println(err)
-        return
+        m.countRequestFailure(err)
+        return err
+    }
+    fetched := time.Now()
+
+// refuse the new signed tree head unless its signature checks out
+    err = m.verifySTH(new_sth)
+    if err != nil {
+        log.Println("Refusing signed tree head from", m.ctl_host)
+        log.Println(err)
+        m.recordSTH(new_sth, fetched, STH_INVALID, STH_UNCHECKED, err)
+        return err
+    }
+
+// make sure the new tree is an append-only extension of the old one before fetching anything from it.  an error that came from requesting the proof says nothing about consistency
+    err = m.checkConsistency(new_sth)
+    if err != nil {
+        consistency := STH_INCONSISTENT
+        if errorKind(err) != "other" {
+            consistency = STH_UNCHECKED
+        }
+        m.recordSTH(new_sth, fetched, m.verificationResult(), consistency, err)
+        m.countRequestFailure(err)
+        return err
     }
 
-    if new_sth.Tree_size != m.tree_head.Tree_size {
-        if m.VERBOSE { fmt.Printf("New entries found; %s now contains %d entries\n", m.ctl_host, new_sth.Tree_size) }
+// the new tree head is verified, so adopt it before fetching the entries it covers.  once it's in the history, it's published to the gossip peers
+    m.setTreeHead(new_sth)
+    m.recordSTH(new_sth, fetched, m.verificationResult(), STH_CONSISTENT, nil)
 
-        m.addEntries(m.tree_head.Tree_size, new_sth.Tree_size-1)
+    next_index := m.getNextIndex()
+    if next_index < new_sth.Tree_size {
+        if m.VERBOSE { fmt.Printf("New entries found; %s now contains %d entries, searching from entry %d\n", m.ctl_host, new_sth.Tree_size, next_index) }
 
-        m.tree_head = new_sth
+// the checkpoint moves forward with each batch
+        err = m.addEntries(next_index, new_sth.Tree_size-1, nil, true)
+        if err != nil {
+            log.Println("Error searching new entries in", m.ctl_host)
+            log.Println(err)
+            m.countRequestFailure(err)
+            return err
+        }
     }
 
+    err = m.saveCheckpoint(m.database, m.getNextIndex())
+    if err != nil {
+        log.Println("Error saving checkpoint for", m.ctl_host)
+        log.Println(err)
+        return err
+    }
+
+    return nil
+
+}
+
+// count a request to the log that failed even after retrying.  errors that didn't come from a request (a consistency proof that doesn't verify, say) are counted elsewhere
+func (m *Monitor) countRequestFailure(err error) {
+
+    kind := errorKind(err)
+    if kind != "other" {
+        m.request_failure_metrics.WithLabelValues(m.ctl_host, kind).Inc()
+    }
+
+}
+
+// check the signature on the tree head of a checkpoint.  it was verified when it was fetched, so one that fails was signed with a key the log has since rotated away from (or the database was changed), not sent by a misbehaving log: it isn't recorded or counted like a tree head that fails verifySTH
+func (m *Monitor) checkCheckpoint(sth Signed_tree_head) error {
+
+    if m.log_key == nil {
+        return nil
+    }
+
+    return verifySTHSignature(sth, m.log_key)
+
 }
 
-// stop automatically checking for new entries every SLEEP
-func (m *Monitor) Stop(signal chan int) {
+// check the signature on a signed tree head against the log's public key.  a tree head that fails is recorded in the 'rejected_sths' table and counted in the metrics
+func (m *Monitor) verifySTH(sth Signed_tree_head) error {
+
+    if m.log_key == nil {
+        return nil
+    }
+
+    err := verifySTHSignature(sth, m.log_key)
+    if err == nil {
+        if m.VERBOSE { fmt.Printf("Verified signed tree head of size %d\n", sth.Tree_size) }
+        return nil
+    }
+
+    m.recordRejectedSTH(sth, err)
+    m.sth_failure_metrics.WithLabelValues(m.ctl_host).Inc()
+
+    return err
+
+}
+
+// check that 'new_sth' is consistent with the current tree head: the same root if the size hasn't changed, or a valid consistency proof if the tree grew.  a log that shrinks or fails to prove consistency raises an alert, is recorded in the 'rejected_sths' table and counted in the metrics.  network errors while fetching the proof are returned without raising an alert
+func (m *Monitor) checkConsistency(new_sth Signed_tree_head) error {
+
+    old_sth := m.getTreeHead()
+    var proof [][]byte
+
+    if new_sth.Tree_size > old_sth.Tree_size && old_sth.Tree_size > 0 {
+        var err error
+        proof, err = getSTHConsistency(m.ctl_host, old_sth.Tree_size, new_sth.Tree_size, m.done)
+        if err != nil {
+            log.Println("Error getting a consistency proof from", m.ctl_host)
+            log.Println(err)
+            return err
+        }
+    }
+
+    err := verifySTHConsistency(old_sth, new_sth, proof)
+    if err == nil {
+        if m.VERBOSE && new_sth.Tree_size > old_sth.Tree_size { fmt.Printf("Verified consistency between trees of size %d and %d\n", old_sth.Tree_size, new_sth.Tree_size) }
+        return nil
+    }
+
+    log.Printf("ALERT: %s is not consistent with its previous tree head (size %d, root %s); new tree head has size %d, root %s: %v\n", m.ctl_host, old_sth.Tree_size, old_sth.Sha256_root_hash, new_sth.Tree_size, new_sth.Sha256_root_hash, err)
+    m.recordRejectedSTH(new_sth, err)
+    m.consistency_failure_metrics.WithLabelValues(m.ctl_host).Inc()
+
+    return err
+
+}
+
+// store a refused signed tree head in the 'rejected_sths' table, along with the reason it was refused
+func (m *Monitor) recordRejectedSTH(sth Signed_tree_head, reason error) {
+
+    statement, err := m.database.Prepare("INSERT INTO rejected_sths (ctl, fetched, tree_size, timestamp, root_hash, signature, reason) VALUES (?, ?, ?, ?, ?, ?, ?)")
+    if err != nil {
+        log.Println("Database error while recording rejected signed tree head")
+        log.Println(err)
+        return
+    }
+    statement.Exec(m.ctl_host, time.Now().UnixNano()/1e6, sth.Tree_size, sth.Timestamp, sth.Sha256_root_hash, sth.Tree_head_signature, reason.Error())
+    statement.Close()
+
+}
+
+// stop automatically checking for new entries every SLEEP.  this doesn't wait for a check in progress to finish
+func (m *Monitor) Stop(stop chan struct{}) {
 
     if m.VERBOSE { fmt.Printf("No longer actively monitoring %s\n", m.ctl_host) }
-    signal <- 1
+    close(stop)
 
 }
 
-// deletes database entries for specified hostname
-func (m *Monitor) deleteDBEntries(hostname string) {
+// whether the log has been removed
+func (m *Monitor) removed() bool {
+
+    select {
+    case <- m.done:
+        return true
+    default:
+        return false
+    }
 
-    if m.VERBOSE { fmt.Printf("Deleting database entries for hostname %s.", hostname) }
+}
+
+// deletes database entries for specified hostname, from every log
+func (s *sharedState) deleteDBEntries(hostname string) {
+
+    if s.VERBOSE { fmt.Printf("Deleting database entries for hostname %s.", hostname) }
 // prepare a statement to delete entries from the database
-    statement, err := m.database.Prepare("DELETE FROM certificates WHERE commonname = ?")
+    statement, err := s.database.Prepare("DELETE FROM certificates WHERE hostname = ?")
     if err != nil {
         log.Println("Database error while attempting to delete entries for hostname " + hostname)
         log.Println(err)
@@ -310,14 +1018,25 @@ func (m *Monitor) deleteDBEntries(hostname string) {
     }
     statement.Exec(hostname)
     statement.Close()
+    _, err = s.database.Exec("DELETE FROM lookalikes WHERE hostname = ?", hostname)
+    if err != nil {
+        log.Println("Database error while attempting to delete lookalikes for hostname " + hostname)
+        log.Println(err)
+    }
+    _, err = s.database.Exec("DELETE FROM registrable_domains WHERE hostname = ?", hostname)
+    if err != nil {
+        log.Println("Database error while attempting to delete registrable domains for hostname " + hostname)
+        log.Println(err)
+    }
 
-    m.certificate_metrics.DeleteLabelValues(hostname, "X509")
-    m.certificate_metrics.DeleteLabelValues(hostname, "PreCert")
+    s.certificate_metrics.DeletePartialMatch(prometheus.Labels{"hostname": hostname})
+    s.lookalike_metrics.DeletePartialMatch(prometheus.Labels{"hostname": hostname})
+    s.registrable_domain_metrics.DeletePartialMatch(prometheus.Labels{"hostname": hostname})
 
 }
 
 // make a database name out of ctl_host
-func makeDBName(ctl_host string) string {
+func MakeDBName(ctl_host string) string {
 
     name := ctl_host + ".db"
 
@@ -334,19 +1053,6 @@ func makeDBName(ctl_host string) string {
 
 }
 
-// finds the index of the first occurence of 'word' as a superstring in an array of strings, and returns the substring and the index.  returns "", -1 if word does not appear in array
-func indexNonStrict(array []string, word string) (string, int) {
-
-    for i, entry := range array {
-        if strings.Contains(word, entry) {
-            return entry, i
-        }
-    }
-
-    return "", -1
-
-}
-
 // finds the index of the first occurence of 'word' in an array of strings.  returns -1 if word does not appear in array
 func index(array []string, word string) int {
 
@@ -360,14 +1066,6 @@ func index(array []string, word string) int {
 
 }
 
-// min of two uint64's
-func min(a uint64, b uint64) uint64 {
-    if a < b {
-        return a
-    }
-    return b
-}
-
 // prepare database
 func prepareDatabase(database_name string, verbose bool, no_delete bool) (*sql.DB, error) {
 
@@ -379,6 +1077,9 @@ func prepareDatabase(database_name string, verbose bool, no_delete bool) (*sql.D
 
     if verbose { fmt.Printf("Results stored in sqlite3 database %s\n", database_name) }
 
+// monitors for several logs share the database; a single connection keeps their writes from colliding
+    db.SetMaxOpenConns(1)
+
 // clear the database if it wasn't empty, unless no_delete is set
     if !no_delete {
         statement, _ := db.Prepare("DROP TABLE IF EXISTS certificates")
@@ -386,12 +1087,139 @@ func prepareDatabase(database_name string, verbose bool, no_delete bool) (*sql.D
         statement.Close()
     }
 
-// create a table with columns 'timestamp', 'commonname', 'certificate', 'logentrytype', and require each row to be unique
-    statement, _ := db.Prepare("CREATE TABLE IF NOT EXISTS certificates (timestamp INTEGER, commonname TEXT, certificate TEXT, logentrytype TEXT, PRIMARY KEY (timestamp, commonname, certificate, logentrytype) )")
+// create a table with columns 'timestamp', 'commonname', 'certificate', 'logentrytype', 'ctl', 'hostname', and require each row to be unique
+    statement, _ := db.Prepare(CREATE_CERTIFICATES_TABLE)
+    statement.Exec()
+    statement.Close()
+
+// a table from before 'hostname' was part of the primary key has to be copied into a new one
+    if !hasColumn(db, "certificates", "hostname") {
+        err = migrateCertificatesTable(db)
+        if err != nil {
+            log.Println("Error migrating table 'certificates'")
+            return db, err
+        }
+    }
+    addCertificatesColumns(db)
+
+    if verbose { fmt.Println("Table 'certificates' created with columns 'timestamp', 'commonname', 'certificate', 'logentrytype', 'ctl', 'hostname', 'rule_id', 'matched_name', 'matched_name_ascii', 'matched_name_unicode', 'registrable_domain', 'issuer_key_hash', 'tbs_hash', 'not_before', 'not_after', 'issuer_sha256', 'sha256', 'serial', 'issuer_dn', 'subject_dn', 'sans', 'key_algorithm', 'key_size', 'signature_algorithm', 'key_usage', 'ext_key_usage', 'basic_constraints', 'subject_key_id', 'authority_key_id', 'leaf_hash', 'leaf_index', 'inclusion_proof', 'proof_tree_size', 'proof_failed_tree_size' and 'proof_error'") }
+
+// the last verified signed tree head of each log, and how far the log has been searched
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS checkpoints")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare("CREATE TABLE IF NOT EXISTS checkpoints (ctl TEXT PRIMARY KEY, next_index INTEGER, tree_size INTEGER, timestamp INTEGER, root_hash TEXT, signature TEXT)")
+    statement.Exec()
+    statement.Close()
+
+// watch rules get their ids from 'rules'
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS rules")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare("CREATE TABLE IF NOT EXISTS rules (id INTEGER PRIMARY KEY, rule TEXT UNIQUE, kind TEXT, pattern TEXT)")
+    statement.Exec()
+    statement.Close()
+
+// signed tree heads that failed verification are kept in 'rejected_sths'
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS rejected_sths")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare("CREATE TABLE IF NOT EXISTS rejected_sths (ctl TEXT, fetched INTEGER, tree_size INTEGER, timestamp INTEGER, root_hash TEXT, signature TEXT, reason TEXT)")
     statement.Exec()
     statement.Close()
+    addColumn(db, "rejected_sths", "ctl", "TEXT")
 
-    if verbose { fmt.Println("Table 'certificates' created with columns 'timestamp', 'commonname', 'certificate', and 'logentrytype'") }
+// every signed tree head fetched from the logs, and the ones gossip peers published
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS sth_history")
+        statement.Exec()
+        statement.Close()
+        statement, _ = db.Prepare("DROP TABLE IF EXISTS peer_sths")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare(CREATE_STH_HISTORY_TABLE)
+    statement.Exec()
+    statement.Close()
+    statement, _ = db.Prepare(CREATE_PEER_STHS_TABLE)
+    statement.Exec()
+    statement.Close()
+
+// names that look like a watched domain are kept in 'lookalikes'
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS lookalikes")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare(CREATE_LOOKALIKES_TABLE)
+    statement.Exec()
+    statement.Close()
+
+// the intermediates and roots in the chains of the certificates found
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS issuers")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare(CREATE_ISSUERS_TABLE)
+    statement.Exec()
+    statement.Close()
+
+// which issuers are in the chain of each certificate found, and where
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS certificate_chains")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare(CREATE_CERTIFICATE_CHAINS_TABLE)
+    statement.Exec()
+    statement.Close()
+
+// the SCTs embedded in the certificates found
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS scts")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare(CREATE_SCTS_TABLE)
+    statement.Exec()
+    statement.Close()
+
+// the promises in those SCTs, and whether they were kept
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS sct_audits")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare(CREATE_SCT_AUDITS_TABLE)
+    statement.Exec()
+    statement.Close()
+
+// precertificates and the certificates issued from them
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS issuances")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare(CREATE_ISSUANCES_TABLE)
+    statement.Exec()
+    statement.Close()
+
+// the registrable domains each rule has matched, and when each was first seen
+    if !no_delete {
+        statement, _ := db.Prepare("DROP TABLE IF EXISTS registrable_domains")
+        statement.Exec()
+        statement.Close()
+    }
+    statement, _ = db.Prepare("CREATE TABLE IF NOT EXISTS registrable_domains (registrable_domain TEXT, hostname TEXT, rule_id INTEGER, timestamp INTEGER, name TEXT, ctl TEXT, PRIMARY KEY (registrable_domain, hostname) )")
+    statement.Exec()
+    statement.Close()
 
 // delete any rows from the new table.  this shouldn't do anything
     if !no_delete {
@@ -405,20 +1233,263 @@ func prepareDatabase(database_name string, verbose bool, no_delete bool) (*sql.D
 
 }
 
-// prepare metrics
-func prepareMetrics(hostnames []string) *prometheus.CounterVec {
+// columns added to 'certificates' since the table was first created; a database kept with --no-delete may not have them yet
+func addCertificatesColumns(db queryExecer) {
+
+    addColumn(db, "certificates", "ctl", "TEXT")
+    addColumn(db, "certificates", "matched_name", "TEXT")
+    addColumn(db, "certificates", "matched_name_ascii", "TEXT")
+    addColumn(db, "certificates", "matched_name_unicode", "TEXT")
+    addColumn(db, "certificates", "registrable_domain", "TEXT")
+    addColumn(db, "certificates", "issuer_key_hash", "TEXT")
+    addColumn(db, "certificates", "tbs_hash", "TEXT")
+    addColumn(db, "certificates", "issuer_sha256", "TEXT")
+    for _, column := range METADATA_COLUMNS {
+        addColumn(db, "certificates", column[0], column[1])
+    }
+    addColumn(db, "certificates", "rule_id", "INTEGER")
+    addColumn(db, "certificates", "leaf_hash", "TEXT")
+    addColumn(db, "certificates", "leaf_index", "INTEGER")
+    addColumn(db, "certificates", "inclusion_proof", "TEXT")
+    addColumn(db, "certificates", "proof_tree_size", "INTEGER")
+    addColumn(db, "certificates", "proof_failed_tree_size", "INTEGER")
+    addColumn(db, "certificates", "proof_error", "TEXT")
 
-// initialize a vector of counters, indexed by hostname and log entry type
-    countervec := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "certificate_metric",
-		Help: "Counts certificates added to the database.",
-	}, []string{"hostname", "log_entry_type"})
+}
 
-    for _, entry := range hostnames {
-        countervec.WithLabelValues(entry, "X509")
-        countervec.WithLabelValues(entry, "PreCert")
+// copy a 'certificates' table whose primary key doesn't include 'hostname' into one whose does.  rows from before a certificate could match several hostnames were stored under their commonname, so that's their hostname
+func migrateCertificatesTable(db *sql.DB) error {
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+// make sure the old table has every column we copy
+    addCertificatesColumns(tx)
+
+    _, err = tx.Exec("ALTER TABLE certificates RENAME TO certificates_old")
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(CREATE_CERTIFICATES_TABLE)
+    if err != nil {
+        return err
+    }
+    addCertificatesColumns(tx)
+    _, err = tx.Exec("INSERT INTO certificates (timestamp, commonname, certificate, logentrytype, ctl, hostname, matched_name, leaf_hash, leaf_index, inclusion_proof, proof_tree_size) SELECT timestamp, commonname, certificate, logentrytype, ctl, commonname, commonname, leaf_hash, leaf_index, inclusion_proof, proof_tree_size FROM certificates_old")
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec("DROP TABLE certificates_old")
+    if err != nil {
+        return err
+    }
+
+    return tx.Commit()
+
+}
+
+// a database or a transaction
+type queryExecer interface {
+    Query(query string, args ...interface{}) (*sql.Rows, error)
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// whether a table has a column
+func hasColumn(db queryExecer, table string, column string) bool {
+
+    rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+    if err != nil {
+        log.Println(err)
+        return false
+    }
+    defer rows.Close()
+
+    var name string
+    for rows.Next() {
+        rows.Scan(&name)
+        if name == column {
+            return true
+        }
+    }
+
+    return false
+
+}
+
+// add a column to an existing table, unless it's already there
+func addColumn(db queryExecer, table string, column string, column_type string) {
+
+    if hasColumn(db, table, column) {
+        return
+    }
+
+    _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + column_type)
+    if err != nil {
+        log.Println(err)
+    }
+
+}
+
+// register a vector of counters with prometheus.  if one with the same name is already registered (by another controller in the same process), use that one instead
+func registerCounterVec(countervec *prometheus.CounterVec) *prometheus.CounterVec {
+
+    err := prometheus.Register(countervec)
+    if err != nil {
+        if already_registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+            return already_registered.ExistingCollector.(*prometheus.CounterVec)
+        }
+        log.Fatalln(err)
     }
 
     return countervec
 
 }
+
+// register a vector of gauges, or return the one already registered under its name
+func registerGaugeVec(gaugevec *prometheus.GaugeVec) *prometheus.GaugeVec {
+
+    err := prometheus.Register(gaugevec)
+    if err != nil {
+        if already_registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+            return already_registered.ExistingCollector.(*prometheus.GaugeVec)
+        }
+        log.Fatalln(err)
+    }
+
+    return gaugevec
+
+}
+
+// prepare metrics
+func prepareMetrics() *prometheus.CounterVec {
+
+// initialize a vector of counters, indexed by hostname (the rule, as it was given), rule id and log entry type.  addHostnames creates the counters for each rule
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "certificate_metric",
+		Help: "Counts certificates added to the database, by the rule they matched.",
+	}, []string{"hostname", "rule", "log_entry_type"})
+
+}
+
+// prepare metrics for signed tree heads that fail verification
+func prepareSTHFailureMetrics() *prometheus.CounterVec {
+
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sth_verification_failure_metric",
+		Help: "Counts signed tree heads refused because their signature did not verify.",
+	}, []string{"ctl"})
+
+}
+
+// prepare metrics for signed tree heads that are not consistent with the previous one
+func prepareConsistencyFailureMetrics() *prometheus.CounterVec {
+
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consistency_failure_metric",
+		Help: "Counts signed tree heads refused because the log shrank or could not prove consistency with the previous tree head.",
+	}, []string{"ctl"})
+
+}
+
+// prepare metrics for full builds whose recomputed root hash doesn't match the signed tree head
+func prepareRootMismatchMetrics() *prometheus.CounterVec {
+
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "root_mismatch_metric",
+		Help: "Counts full builds where the root hash recomputed from the entries did not match the signed tree head.",
+	}, []string{"ctl"})
+
+}
+
+// prepare metrics for stored certificates whose inclusion proof fails
+func prepareInclusionFailureMetrics() *prometheus.CounterVec {
+
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "inclusion_failure_metric",
+		Help: "Counts stored certificates whose inclusion proof did not verify against the signed tree head.",
+	}, []string{"ctl"})
+
+}
+
+// prepare metrics for requests to a log that failed even after retrying
+func prepareRequestFailureMetrics() *prometheus.CounterVec {
+
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "request_failure_metric",
+		Help: "Counts requests to a log that failed even after retrying, by kind of error (network, http_status, rate_limited or decode).",
+	}, []string{"ctl", "kind"})
+
+}
+
+// prepare metrics for certificates with names that look like a watched domain
+func prepareLookalikeMetrics() *prometheus.CounterVec {
+
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lookalike_metric",
+		Help: "Counts certificates added to 'lookalikes' because a name looks like a watched domain, by the rule and the reason.",
+	}, []string{"hostname", "rule", "reason"})
+
+}
+
+// prepare metrics for SCTs in certificates whose signature did not verify with the key of the log that issued them
+func prepareSCTFailureMetrics() *prometheus.CounterVec {
+
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sct_verification_failure_metric",
+		Help: "Counts SCTs embedded in certificates whose signature did not verify, by the log that issued them.",
+	}, []string{"ctl"})
+
+}
+
+// prepare metrics for SCTs whose logs haven't included what they promised
+func prepareOverdueSCTMetrics() *prometheus.GaugeVec {
+
+    return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "overdue_sct_metric",
+		Help: "The number of SCTs issued by a log whose leaf the log has not included within its maximum merge delay.",
+	}, []string{"ctl"})
+
+}
+
+// prepare metrics for signed tree heads from gossip peers that are inconsistent with the ones this instance was shown
+func prepareSplitViewMetrics() *prometheus.CounterVec {
+
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "split_view_metric",
+		Help: "Counts signed tree heads published by gossip peers that are not consistent with the ones the log showed this instance.",
+	}, []string{"ctl"})
+
+}
+
+// prepare metrics for how old each log's latest signed tree head is
+func prepareSTHAgeMetrics() *prometheus.GaugeVec {
+
+    return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sth_age_metric",
+		Help: "Seconds between the timestamp of the signed tree head adopted from a log and the last check for a new one.",
+	}, []string{"ctl"})
+
+}
+
+// prepare metrics for how fast each log is growing
+func prepareSTHGrowthRateMetrics() *prometheus.GaugeVec {
+
+    return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sth_growth_rate_metric",
+		Help: "Entries per second added to a log between the last two signed tree heads adopted from it.",
+	}, []string{"ctl"})
+
+}
+
+// prepare metrics for certificates by registrable domain
+func prepareRegistrableDomainMetrics() *prometheus.CounterVec {
+
+    return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registrable_domain_metric",
+		Help: "Counts certificates added to the database, by the rule they matched and the registrable domain of the name that matched it.",
+	}, []string{"hostname", "rule", "registrable_domain"})
+
+}
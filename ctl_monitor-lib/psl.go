@@ -0,0 +1,152 @@
+package ctl_monitor_lib
+
+import "fmt"
+import "io/ioutil"
+import "log"
+import "net"
+import "strings"
+import "sync/atomic"
+import "time"
+import "golang.org/x/net/publicsuffix"
+
+// the Public Suffix List file (https://publicsuffix.org/list/public_suffix_list.dat) and how often to read it again.  set from the command line.  without a file, the copy of the list built into golang.org/x/net/publicsuffix is used
+var PSL_FILE string = ""
+var PSL_RELOAD time.Duration = 24 * time.Hour
+
+// the list in use, as a *publicSuffixList.  it's replaced, never changed, when the file is read again
+var public_suffixes atomic.Value
+
+// the rules of a Public Suffix List, with every suffix in its A-label form
+type publicSuffixList struct {
+    file string
+    rules map[string]bool
+// '*.ck' is stored as 'ck'
+    wildcards map[string]bool
+// '!www.ck' is stored as 'www.ck'
+    exceptions map[string]bool
+}
+
+// read the Public Suffix List from PSL_FILE and use it from now on.  if PSL_RELOAD is set, the file is read again that often; a file that can't be read then is logged, and the list already loaded is kept
+func LoadPublicSuffixList() error {
+
+    if PSL_FILE == "" {
+        return nil
+    }
+
+    err := reloadPublicSuffixList()
+    if err != nil {
+        return err
+    }
+
+    if PSL_RELOAD > 0 {
+        go func() {
+            for range time.Tick(PSL_RELOAD) {
+                err := reloadPublicSuffixList()
+                if err != nil {
+                    log.Println("Error reloading the public suffix list:", err)
+                }
+            }
+        }()
+    }
+
+    return nil
+
+}
+
+// read PSL_FILE again
+func reloadPublicSuffixList() error {
+
+    list, err := parsePublicSuffixList(PSL_FILE)
+    if err != nil {
+        return err
+    }
+    public_suffixes.Store(list)
+
+    return nil
+
+}
+
+// read a Public Suffix List file.  each line is a rule, and only the first word of it counts; comments start with '//'
+func parsePublicSuffixList(file_name string) (*publicSuffixList, error) {
+
+    contents, err := ioutil.ReadFile(file_name)
+    if err != nil {
+        return nil, err
+    }
+
+    list := publicSuffixList{file: file_name, rules: make(map[string]bool), wildcards: make(map[string]bool), exceptions: make(map[string]bool)}
+    for _, line := range strings.Split(string(contents), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+            continue
+        }
+        rule := fields[0]
+        switch {
+        case strings.HasPrefix(rule, "!"):
+            list.exceptions[normalizeName(rule[1:])] = true
+        case strings.HasPrefix(rule, "*."):
+            list.wildcards[normalizeName(rule[2:])] = true
+        default:
+            list.rules[normalizeName(rule)] = true
+        }
+    }
+
+    if len(list.rules) == 0 && len(list.wildcards) == 0 {
+        return nil, fmt.Errorf("Invalid public suffix list %s: no rules", file_name)
+    }
+
+    return &list, nil
+
+}
+
+// the public suffix list in use, or nil for the built-in one
+func getPublicSuffixList() *publicSuffixList {
+
+    list, _ := public_suffixes.Load().(*publicSuffixList)
+    return list
+
+}
+
+// the public suffix of a normalized domain: the longest suffix matching a rule, where an exception rule beats the wildcard it's an exception to.  a domain that matches no rule is under a top-level domain of its own
+func (list *publicSuffixList) publicSuffix(domain string) string {
+
+    if list == nil {
+        suffix, _ := publicsuffix.PublicSuffix(domain)
+        return suffix
+    }
+
+    labels := strings.Split(domain, ".")
+    for i := range labels {
+        candidate := strings.Join(labels[i:], ".")
+        if list.exceptions[candidate] {
+            return strings.Join(labels[i+1:], ".")
+        }
+        if list.rules[candidate] {
+            return candidate
+        }
+        if i+1 < len(labels) && list.wildcards[strings.Join(labels[i+1:], ".")] {
+            return candidate
+        }
+    }
+
+    return labels[len(labels)-1]
+
+}
+
+// the registrable domain (eTLD+1) of a name from a certificate: its public suffix and the label before it, so 'ttmail.npp.co.th' is in 'npp.co.th'.  returns "" for a name that is itself a public suffix, and for IP addresses, email addresses and URIs
+func registrableDomain(name string) string {
+
+    domain := strings.TrimPrefix(normalizeName(name), "*.")
+    if domain == "" || strings.ContainsAny(domain, "@:/") || net.ParseIP(domain) != nil {
+        return ""
+    }
+
+    suffix := getPublicSuffixList().publicSuffix(domain)
+    if suffix == domain || !strings.HasSuffix(domain, "." + suffix) {
+        return ""
+    }
+    rest := strings.TrimSuffix(domain, "." + suffix)
+
+    return rest[strings.LastIndex(rest, ".")+1:] + "." + suffix
+
+}
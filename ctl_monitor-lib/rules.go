@@ -0,0 +1,249 @@
+package ctl_monitor_lib
+
+import "errors"
+import "fmt"
+import "regexp"
+import "strconv"
+import "strings"
+import "unicode"
+
+// the kinds of watch rule.  a rule is written KIND:PATTERN; a bare hostname is an exact rule, or a suffix rule if it starts with '*.' or '.'
+var RULE_KINDS []string = []string{"exact", "suffix", "registrable", "keyword", "glob", "regex"}
+
+// a rule for the names to watch for.  rules are immutable once parsed, so they can be shared between goroutines
+type watchRule struct {
+// assigned when the rule is stored in the 'rules' table
+    id int64
+    kind string
+    pattern string
+// the rule as it was given.  rows and metrics are labeled with it, so it stays recognizable
+    text string
+// glob and regex rules are compiled once
+    regex *regexp.Regexp
+}
+
+// parse and validate a watch rule:
+//   - exact:NAME matches NAME (and, with --non-strict, its subdomains); see matchName
+//   - suffix:DOMAIN matches DOMAIN and every name below it, on label boundaries.  suffix:*.DOMAIN only matches the names below it
+//   - registrable:DOMAIN matches every name whose registrable domain (see registrableDomain) is DOMAIN, which has to be a registrable domain itself
+//   - keyword:WORD matches every name whose registrable domain contains WORD before its public suffix, like 'paypal-login.co.uk' for keyword:paypal
+//   - glob:PATTERN matches the whole name against PATTERN, where '*' is any run of characters and '?' is any single character
+//   - regex:EXPRESSION matches names against an RE2 regular expression
+// names are lower-cased and lose any trailing dot before they're matched, so glob and regex rules should be written in lower case
+func parseRule(text string) (*watchRule, error) {
+
+    rule := watchRule{text: strings.TrimSpace(text)}
+    if rule.text == "" {
+        return nil, errors.New("Invalid rule: empty")
+    }
+
+    rule.kind = "exact"
+    rule.pattern = rule.text
+    for _, kind := range RULE_KINDS {
+        if strings.HasPrefix(rule.text, kind + ":") {
+            rule.kind = kind
+            rule.pattern = strings.TrimPrefix(rule.text, kind + ":")
+            break
+        }
+    }
+    if rule.kind == "exact" && (strings.HasPrefix(rule.pattern, "*.") || strings.HasPrefix(rule.pattern, ".")) {
+        rule.kind = "suffix"
+    }
+
+    if rule.pattern == "" {
+        return nil, fmt.Errorf("Invalid rule %q: empty pattern", rule.text)
+    }
+
+    var err error
+    switch rule.kind {
+    case "exact":
+        if strings.IndexFunc(rule.pattern, unicode.IsSpace) != -1 {
+            return nil, fmt.Errorf("Invalid rule %q: names can't contain spaces", rule.text)
+        }
+        err = validateIDN(rule.pattern)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid rule %q: %v", rule.text, err)
+        }
+    case "suffix":
+        err = validateDomain(strings.TrimPrefix(strings.TrimPrefix(rule.pattern, "*"), "."))
+        if err == nil {
+            err = validateIDN(strings.TrimPrefix(strings.TrimPrefix(rule.pattern, "*"), "."))
+        }
+        if err != nil {
+            return nil, fmt.Errorf("Invalid rule %q: %v", rule.text, err)
+        }
+    case "registrable":
+        err = validateDomain(rule.pattern)
+        if err == nil {
+            err = validateIDN(rule.pattern)
+        }
+        if err == nil && registrableDomain(rule.pattern) != normalizeName(rule.pattern) {
+            err = fmt.Errorf("not a registrable domain (names in it are in %q)", registrableDomain(rule.pattern))
+        }
+        if err != nil {
+            return nil, fmt.Errorf("Invalid rule %q: %v", rule.text, err)
+        }
+    case "keyword":
+        if strings.IndexFunc(rule.pattern, unicode.IsSpace) != -1 || strings.Contains(rule.pattern, ".") {
+            return nil, fmt.Errorf("Invalid rule %q: keywords can't contain spaces or dots", rule.text)
+        }
+    case "glob":
+        if strings.IndexFunc(rule.pattern, unicode.IsSpace) != -1 {
+            return nil, fmt.Errorf("Invalid rule %q: patterns can't contain spaces", rule.text)
+        }
+        rule.regex = regexp.MustCompile(globToRegexp(strings.ToLower(rule.pattern)))
+    case "regex":
+        rule.regex, err = regexp.Compile(rule.pattern)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid rule %q: %v", rule.text, err)
+        }
+    }
+
+    return &rule, nil
+
+}
+
+// check that 'domain' is made of non-empty DNS labels, without spaces
+func validateDomain(domain string) error {
+
+    domain = strings.TrimSuffix(domain, ".")
+    if domain == "" {
+        return errors.New("empty domain")
+    }
+    if len(domain) > 253 {
+        return errors.New("domain is longer than 253 characters")
+    }
+    for _, label := range strings.Split(domain, ".") {
+        if label == "" {
+            return errors.New("empty label")
+        }
+        if len(label) > 63 {
+            return fmt.Errorf("label %q is longer than 63 characters", label)
+        }
+        if strings.IndexFunc(label, unicode.IsSpace) != -1 {
+            return fmt.Errorf("label %q contains a space", label)
+        }
+    }
+
+    return nil
+
+}
+
+// check that a name given in Unicode is a valid internationalized domain name, so it has an A-label form to match certificates with.  email addresses and URIs are left alone
+func validateIDN(name string) error {
+
+    if isASCII(name) || strings.ContainsAny(name, "@:/") {
+        return nil
+    }
+    _, err := IDNA_PROFILE.ToASCII(strings.TrimSuffix(strings.ToLower(name), "."))
+    if err != nil {
+        return fmt.Errorf("not a valid internationalized domain name: %v", err)
+    }
+
+    return nil
+
+}
+
+// translate a glob into an anchored regular expression
+func globToRegexp(glob string) string {
+
+    var expression strings.Builder
+    expression.WriteString("^")
+    for _, c := range glob {
+        switch c {
+        case '*':
+            expression.WriteString(".*")
+        case '?':
+            expression.WriteString(".")
+        default:
+            expression.WriteString(regexp.QuoteMeta(string(c)))
+        }
+    }
+    expression.WriteString("$")
+
+    return expression.String()
+
+}
+
+// whether the name 'name' from a certificate matches the rule.  'subdomains' makes exact rules match subdomains too
+func (r *watchRule) match(name string, subdomains bool) bool {
+
+    switch r.kind {
+    case "exact":
+        return matchName(r.pattern, name, subdomains)
+    case "suffix":
+        return matchName(r.pattern, name, true)
+    case "registrable":
+        registrable := registrableDomain(name)
+        return registrable != "" && registrable == normalizeName(r.pattern)
+    case "keyword":
+// the keyword is looked for in the label as it's displayed
+        registrable := registrableDomain(name)
+        if registrable == "" {
+            return false
+        }
+        label := unicodeName(registrable[:strings.Index(registrable, ".")])
+        return strings.Contains(label, strings.ToLower(r.pattern))
+    case "glob", "regex":
+// a pattern may be written with either form of an internationalized name
+        normalized := normalizeName(name)
+        if r.regex.MatchString(normalized) {
+            return true
+        }
+        unicode_name := unicodeName(normalized)
+        return unicode_name != normalized && r.regex.MatchString(unicode_name)
+    }
+
+    return false
+
+}
+
+// rules written differently that match the same names have the same key: 'münchen.example', 'exact:xn--mnchen-3ya.example' and 'exact:MÜNCHEN.example.', or '*.example.com' and '.example.com'
+func (r *watchRule) key() string {
+
+    switch r.kind {
+    case "exact":
+        return r.kind + ":" + normalizeName(r.pattern)
+    case "suffix":
+        return r.kind + ":" + normalizeName(strings.TrimPrefix(r.pattern, "*"))
+    case "registrable":
+        return r.kind + ":" + normalizeName(r.pattern)
+    case "keyword":
+        return r.kind + ":" + strings.ToLower(r.pattern)
+    }
+
+    return r.kind + ":" + r.pattern
+
+}
+
+// the rule's id, as a metric label
+func (r *watchRule) label() string {
+
+    return strconv.FormatInt(r.id, 10)
+
+}
+
+// split the rules given to /Add.  commas separate bare hostnames, but a typed rule is taken whole, since a regular expression may contain commas
+func splitRules(value string) []string {
+
+    for _, kind := range RULE_KINDS {
+        if strings.HasPrefix(strings.TrimSpace(value), kind + ":") {
+            return []string{value}
+        }
+    }
+
+    return strings.Split(value, ",")
+
+}
+
+// store a rule in the 'rules' table, unless it's already there, and set its id.  a rule keeps its id for as long as the table is kept
+func (s *sharedState) saveRule(rule *watchRule) error {
+
+    _, err := s.database.Exec("INSERT OR IGNORE INTO rules (rule, kind, pattern) VALUES (?, ?, ?)", rule.text, rule.kind, rule.pattern)
+    if err != nil {
+        return err
+    }
+
+    return s.database.QueryRow("SELECT id FROM rules WHERE rule = ?", rule.text).Scan(&rule.id)
+
+}
@@ -0,0 +1,296 @@
+package ctl_monitor_lib
+
+import "crypto/x509"
+import "encoding/asn1"
+import "encoding/base64"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "log"
+import "time"
+
+// what's known of a log whose SCTs can be checked: where it is, its key, and how long it has to include what it promises to.  every monitor with a key adds its log
+type knownLog struct {
+    ctl_host string
+    key *logKey
+    mmd time.Duration
+}
+
+// each SCT embedded in a certificate, with the log that issued it and whether its signature verified.  'entry_leaf_hash' is the hash of the leaf that log promised to add
+const CREATE_SCTS_TABLE string = "CREATE TABLE IF NOT EXISTS scts (leaf_hash TEXT, ctl TEXT, log_id TEXT, sct_ctl TEXT, timestamp INTEGER, extensions TEXT, hash_algorithm INTEGER, signature_algorithm INTEGER, signature TEXT, entry_leaf_hash TEXT, status TEXT, PRIMARY KEY (leaf_hash, log_id, timestamp) )"
+
+// the results of checking an SCT.  an SCT from a log we have no key for, or in a certificate whose issuer isn't known, can't be checked
+const SCT_VERIFIED string = "verified"
+const SCT_INVALID string = "invalid"
+const SCT_UNKNOWN_LOG string = "unknown_log"
+const SCT_NO_ISSUER string = "no_issuer"
+
+// a v1 SignedCertificateTimestamp (RFC 6962, section 3.2)
+type signedCertificateTimestamp struct {
+    Version uint8
+    Log_id [32]byte
+    Timestamp uint64
+    Extensions []byte
+    Signature digitallySigned
+}
+
+// an SCT embedded in a certificate, and what checking it found
+type embeddedSCT struct {
+    signedCertificateTimestamp
+// the log that issued it, if it's known, and how long that log has to include the leaf
+    sct_ctl string
+    mmd time.Duration
+    entry_leaf_hash []byte
+    status string
+}
+
+// an SCT in a certificate for a rule
+type sct_row struct {
+    common_name string
+    log_id string
+    sct_ctl string
+    timestamp uint64
+    status string
+}
+
+// note a log's key, so SCTs it issued can be checked
+func (s *sharedState) addKnownLog(ctl_host string, key *logKey, mmd time.Duration) {
+
+    s.known_logs_lock.Lock()
+    defer s.known_logs_lock.Unlock()
+
+    if s.known_logs == nil {
+        s.known_logs = make(map[[32]byte]*knownLog)
+    }
+    s.known_logs[key.log_id] = &knownLog{ctl_host: ctl_host, key: key, mmd: mmd}
+
+}
+
+// forget a log's key, once it's no longer monitored or has been replaced, so it doesn't verify SCTs or tree heads any more
+func (s *sharedState) removeKnownLog(log_id [32]byte) {
+
+    s.known_logs_lock.Lock()
+    defer s.known_logs_lock.Unlock()
+
+    delete(s.known_logs, log_id)
+
+}
+
+// the log with id 'log_id', or nil if its key isn't known
+func (s *sharedState) getKnownLog(log_id [32]byte) *knownLog {
+
+    s.known_logs_lock.RLock()
+    defer s.known_logs_lock.RUnlock()
+
+    return s.known_logs[log_id]
+
+}
+
+// the SCTs in a certificate's SCT list extension, if it has one
+func getEmbeddedSCTs(cert *x509.Certificate) ([]signedCertificateTimestamp, error) {
+
+    for _, extension := range cert.Extensions {
+        if extension.Id.Equal(SCT_LIST_OID) {
+            return parseSCTList(extension.Value)
+        }
+    }
+
+    return nil, nil
+
+}
+
+// decode the value of an SCT list extension: an OCTET STRING holding a SignedCertificateTimestampList, which is a 2 byte length followed by SCTs, each with a 2 byte length of its own
+func parseSCTList(value []byte) ([]signedCertificateTimestamp, error) {
+
+    var list []byte
+    rest, err := asn1.Unmarshal(value, &list)
+    if err != nil || len(rest) > 0 {
+        return nil, errors.New("Invalid SCT list: not an OCTET STRING")
+    }
+
+    scts, err := readLengthPrefixed16(list)
+    if err != nil || len(scts) != len(list) {
+        return nil, errors.New("Invalid SCT list: length does not match")
+    }
+    scts = scts[2:]
+
+    var results []signedCertificateTimestamp
+    for len(scts) > 0 {
+        serialized, err := readLengthPrefixed16(scts)
+        if err != nil {
+            return results, fmt.Errorf("Invalid SCT list: %v", err)
+        }
+        scts = scts[len(serialized):]
+        sct, err := parseSCT(serialized[2:])
+        if err != nil {
+            return results, err
+        }
+        results = append(results, sct)
+    }
+
+    return results, nil
+
+}
+
+// the 2 byte length at the start of 'data', and the bytes it covers
+func readLengthPrefixed16(data []byte) ([]byte, error) {
+
+    if len(data) < 2 {
+        return nil, errors.New("too short")
+    }
+    length := int(binary.BigEndian.Uint16(data))
+    if len(data) < 2+length {
+        return nil, errors.New("length does not match")
+    }
+
+    return data[:2+length], nil
+
+}
+
+// decode a serialized SCT: version, log id, timestamp, 2 byte length prefixed extensions, and a DigitallySigned signature
+func parseSCT(data []byte) (signedCertificateTimestamp, error) {
+
+    var sct signedCertificateTimestamp
+
+    if len(data) < 1+32+8+2 {
+        return sct, errors.New("Invalid SCT: too short")
+    }
+    sct.Version = data[0]
+    if sct.Version != 0 {
+        return sct, fmt.Errorf("Unsupported SCT version %d", sct.Version)
+    }
+    copy(sct.Log_id[:], data[1:33])
+    sct.Timestamp = binary.BigEndian.Uint64(data[33:41])
+
+    extensions, err := readLengthPrefixed16(data[41:])
+    if err != nil {
+        return sct, fmt.Errorf("Invalid SCT extensions: %v", err)
+    }
+    sct.Extensions = extensions[2:]
+
+    sct.Signature, err = parseDigitallySigned(data[41+len(extensions):])
+    if err != nil {
+        return sct, err
+    }
+
+    return sct, nil
+
+}
+
+// serialize what an SCT for a precertificate signs (RFC 6962, section 3.2): version, signature type, timestamp, the PreCert entry type, the issuer key hash, the TBSCertificate and the SCT's extensions.  a PreCert Merkle tree leaf is the same, with the leaf type in place of the signature type, and both are 0
+func precertSCTInput(sct signedCertificateTimestamp, issuer_key_hash []byte, tbs []byte) []byte {
+
+    data := make([]byte, 12, 12+len(issuer_key_hash)+3+len(tbs)+2+len(sct.Extensions))
+    data[0] = sct.Version
+    data[1] = SIGNATURE_TYPE_CERTIFICATE_TIMESTAMP
+    binary.BigEndian.PutUint64(data[2:10], sct.Timestamp)
+    binary.BigEndian.PutUint16(data[10:12], 1)
+    data = append(data, issuer_key_hash...)
+    data = append(data, byte(len(tbs)>>16), byte(len(tbs)>>8), byte(len(tbs)))
+    data = append(data, tbs...)
+    data = append(data, byte(len(sct.Extensions)>>8), byte(len(sct.Extensions)))
+    data = append(data, sct.Extensions...)
+
+    return data
+
+}
+
+// the SCTs embedded in a certificate, each checked against the key of the log that issued it.  an SCT in a certificate is for the precertificate it was issued from, so it signs the TBSCertificate without the SCT list, and the key hash of the certificate's issuer (base64, as in the 'issuer_key_hash' column)
+func (s *sharedState) checkEmbeddedSCTs(cert *x509.Certificate, issuer_key_hash string) []embeddedSCT {
+
+    scts, err := getEmbeddedSCTs(cert)
+    if err != nil {
+        log.Println("Could not parse SCTs in certificate:", err)
+    }
+    if len(scts) == 0 {
+        return nil
+    }
+
+    key_hash, _ := base64.StdEncoding.DecodeString(issuer_key_hash)
+    tbs, err := canonicalTBS(cert.RawTBSCertificate)
+    if err != nil {
+        log.Println(err)
+        key_hash = nil
+    }
+
+    results := make([]embeddedSCT, len(scts))
+    for i, sct := range scts {
+        results[i].signedCertificateTimestamp = sct
+        known_log := s.getKnownLog(sct.Log_id)
+        if known_log != nil {
+            results[i].sct_ctl = known_log.ctl_host
+            results[i].mmd = known_log.mmd
+        }
+        if len(key_hash) != 32 {
+            results[i].status = SCT_NO_ISSUER
+            continue
+        }
+        data := precertSCTInput(sct, key_hash, tbs)
+        results[i].entry_leaf_hash = leafHash(data)
+        switch {
+        case known_log == nil:
+            results[i].status = SCT_UNKNOWN_LOG
+        case known_log.key.verify(data, sct.Signature) != nil:
+            results[i].status = SCT_INVALID
+        default:
+            results[i].status = SCT_VERIFIED
+        }
+    }
+
+    return results
+
+}
+
+// store the SCTs embedded in a matched certificate, unless they're already there, and queue the verified ones to be audited.  returns the invalid ones that weren't there.  'db' is either the database or a transaction
+func saveSCTs(db execer, match matchedCert, ctl string) ([]embeddedSCT, error) {
+
+    var invalid []embeddedSCT
+    for _, sct := range match.scts {
+        var entry_leaf_hash interface{}
+        if sct.entry_leaf_hash != nil {
+            entry_leaf_hash = base64.StdEncoding.EncodeToString(sct.entry_leaf_hash)
+        }
+        results, err := db.Exec("INSERT OR IGNORE INTO scts (leaf_hash, ctl, log_id, sct_ctl, timestamp, extensions, hash_algorithm, signature_algorithm, signature, entry_leaf_hash, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", match.leaf_hash, ctl, base64.StdEncoding.EncodeToString(sct.Log_id[:]), sct.sct_ctl, sct.Timestamp, base64.StdEncoding.EncodeToString(sct.Extensions), sct.Signature.HashAlgorithm, sct.Signature.SignatureAlgorithm, base64.StdEncoding.EncodeToString(sct.Signature.Signature), entry_leaf_hash, sct.status)
+        if err != nil {
+            return invalid, err
+        }
+        if added, _ := results.RowsAffected(); added > 0 && sct.status == SCT_INVALID {
+            invalid = append(invalid, sct)
+        }
+        if sct.status == SCT_VERIFIED {
+            err = queueSCTAudit(db, sct.sct_ctl, base64.StdEncoding.EncodeToString(sct.Log_id[:]), entry_leaf_hash.(string), sct.Timestamp, sct.mmd)
+            if err != nil {
+                return invalid, err
+            }
+        }
+    }
+
+    return invalid, nil
+
+}
+
+// the SCTs in the certificates for the rule 'hostname', in the order they were issued
+func (s *sharedState) listSCTs(hostname string) ([]sct_row, error) {
+
+    hostname = s.ruleText(hostname)
+    rows, err := s.database.Query("SELECT DISTINCT certificates.commonname, scts.log_id, scts.sct_ctl, scts.timestamp, scts.status FROM certificates JOIN scts ON certificates.leaf_hash = scts.leaf_hash AND certificates.ctl = scts.ctl WHERE certificates.hostname = ? ORDER BY scts.timestamp", hostname)
+    if err != nil {
+        log.Println("Error accessing database.")
+        return nil, err
+    }
+    defer rows.Close()
+
+    var results []sct_row
+    var row sct_row
+    for rows.Next() {
+        err = rows.Scan(&row.common_name, &row.log_id, &row.sct_ctl, &row.timestamp, &row.status)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            return results, err
+        }
+        results = append(results, row)
+    }
+
+    return results, rows.Err()
+
+}
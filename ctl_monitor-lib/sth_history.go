@@ -0,0 +1,102 @@
+package ctl_monitor_lib
+
+import "encoding/base64"
+import "log"
+import "time"
+
+// every signed tree head fetched from each log, when it was fetched (in milliseconds), and what checking it found.  'error' is why it was refused, and is NULL for the ones the monitor adopted
+const CREATE_STH_HISTORY_TABLE string = "CREATE TABLE IF NOT EXISTS sth_history (ctl TEXT, log_id TEXT, fetched INTEGER, tree_size INTEGER, timestamp INTEGER, root_hash TEXT, signature TEXT, verification TEXT, consistency TEXT, error TEXT)"
+
+// the results of checking a tree head's signature.  a tree head from a log whose key isn't known is unverified
+const STH_VERIFIED string = "verified"
+const STH_UNVERIFIED string = "unverified"
+const STH_INVALID string = "invalid"
+
+// the results of checking a tree head's consistency with the one before it.  it's unchecked if its signature was refused, if there was no tree head before it, or if the log didn't return a consistency proof
+const STH_CONSISTENT string = "consistent"
+const STH_INCONSISTENT string = "inconsistent"
+const STH_UNCHECKED string = "unchecked"
+
+// a tree head fetched from a log, and what checking it found
+type sth_history_row struct {
+    fetched uint64
+    sth Signed_tree_head
+    verification string
+    consistency string
+    err string
+}
+
+// the verification result of a tree head whose signature wasn't refused
+func (m *Monitor) verificationResult() string {
+
+    if m.log_key == nil {
+        return STH_UNVERIFIED
+    }
+
+    return STH_VERIFIED
+
+}
+
+// store a tree head fetched from the log in 'sth_history'.  'reason' is why it was refused, or nil if it was adopted
+func (m *Monitor) recordSTH(sth Signed_tree_head, fetched time.Time, verification string, consistency string, reason error) {
+
+    log_id := ""
+    if m.log_key != nil {
+        log_id = base64.StdEncoding.EncodeToString(m.log_key.log_id[:])
+    }
+    var reason_text interface{}
+    if reason != nil {
+        reason_text = reason.Error()
+    }
+
+    _, err := m.database.Exec("INSERT INTO sth_history (ctl, log_id, fetched, tree_size, timestamp, root_hash, signature, verification, consistency, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", m.ctl_host, log_id, fetched.UnixMilli(), sth.Tree_size, sth.Timestamp, sth.Sha256_root_hash, sth.Tree_head_signature, verification, consistency, reason_text)
+    if err != nil {
+        log.Println("Database error while recording signed tree head")
+        log.Println(err)
+    }
+
+}
+
+// set the age of the tree head the monitor has adopted, and how fast the log grew since the one before it ('old_sth'), in entries per second.  the rate is left alone if no new tree head was adopted
+func (m *Monitor) updateSTHMetrics(old_sth Signed_tree_head) {
+
+    sth := m.getTreeHead()
+    if sth.Timestamp == 0 {
+        return
+    }
+    m.sth_age_metrics.WithLabelValues(m.ctl_host).Set(time.Since(time.UnixMilli(int64(sth.Timestamp))).Seconds())
+
+    if old_sth.Timestamp != 0 && sth.Timestamp > old_sth.Timestamp && sth.Tree_size >= old_sth.Tree_size {
+        seconds := float64(sth.Timestamp - old_sth.Timestamp) / 1000
+        m.sth_growth_rate_metrics.WithLabelValues(m.ctl_host).Set(float64(sth.Tree_size - old_sth.Tree_size) / seconds)
+    }
+
+}
+
+// the tree heads fetched from the log 'ctl_host' between 'since' and 'until' (when they were fetched, in milliseconds; 0 for no limit), newest first
+func (s *sharedState) listSTHHistory(ctl_host string, since uint64, until uint64) ([]sth_history_row, error) {
+
+    if until == 0 {
+        until = ^uint64(0) >> 1
+    }
+    rows, err := s.database.Query("SELECT fetched, tree_size, timestamp, root_hash, signature, verification, consistency, IFNULL(error, '') FROM sth_history WHERE ctl = ? AND fetched >= ? AND fetched <= ? ORDER BY fetched DESC", ctl_host, since, until)
+    if err != nil {
+        log.Println("Error accessing database.")
+        return nil, err
+    }
+    defer rows.Close()
+
+    var results []sth_history_row
+    var row sth_history_row
+    for rows.Next() {
+        err = rows.Scan(&row.fetched, &row.sth.Tree_size, &row.sth.Timestamp, &row.sth.Sha256_root_hash, &row.sth.Tree_head_signature, &row.verification, &row.consistency, &row.err)
+        if err != nil {
+            log.Println("Error accessing database row.")
+            return results, err
+        }
+        results = append(results, row)
+    }
+
+    return results, rows.Err()
+
+}
@@ -0,0 +1,198 @@
+package ctl_monitor_lib
+
+import "crypto"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rsa"
+import "crypto/sha256"
+import "crypto/x509"
+import "encoding/base64"
+import "encoding/binary"
+import "encoding/pem"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "strings"
+
+// TLS HashAlgorithm and SignatureAlgorithm values used by CT logs (RFC 5246, section 7.4.1.4.1)
+const HASH_ALGORITHM_SHA256 uint8 = 4
+const SIGNATURE_ALGORITHM_RSA uint8 = 1
+const SIGNATURE_ALGORITHM_ECDSA uint8 = 3
+
+// SignatureType values from RFC 6962, section 3.2
+const SIGNATURE_TYPE_CERTIFICATE_TIMESTAMP uint8 = 0
+const SIGNATURE_TYPE_TREE_HASH uint8 = 1
+
+// the public key of a CT log, along with its log id (the SHA-256 hash of the DER-encoded SubjectPublicKeyInfo)
+type logKey struct {
+    public_key crypto.PublicKey
+    log_id [32]byte
+}
+
+// a TLS DigitallySigned struct: 1 byte hash algorithm, 1 byte signature algorithm, then a 2 byte length followed by the signature itself
+type digitallySigned struct {
+    HashAlgorithm uint8
+    SignatureAlgorithm uint8
+    Signature []byte
+}
+
+// load a log public key.  'key' may be PEM text, base64-encoded DER, or the path to a file containing either one.  only ECDSA P-256 and RSA keys are accepted
+func loadLogKey(key string) (*logKey, error) {
+
+    key = strings.TrimSpace(key)
+
+// PEM-encoded key
+    if strings.HasPrefix(key, "-----BEGIN") {
+        block, _ := pem.Decode([]byte(key))
+        if block == nil {
+            return nil, errors.New("Invalid public key: could not decode PEM block")
+        }
+        return parseLogKey(block.Bytes)
+    }
+
+// base64-encoded DER
+    var parse_err error
+    der, err := base64.StdEncoding.DecodeString(key)
+    if err == nil {
+        log_key, err := parseLogKey(der)
+        if err == nil {
+            return log_key, nil
+        }
+        parse_err = err
+    }
+
+// otherwise it should be a file containing the key.  a file name can be made only of base64 characters, like 'logkey', so it's tried even if the name decoded
+    contents, err := ioutil.ReadFile(key)
+    if err != nil && parse_err != nil {
+        return nil, parse_err
+    }
+    if err != nil {
+        return nil, fmt.Errorf("Invalid public key: not PEM, base64 DER, or a readable file: %v", err)
+    }
+    if strings.TrimSpace(string(contents)) == key {
+        return nil, errors.New("Invalid public key")
+    }
+
+    return loadLogKey(string(contents))
+
+}
+
+// parse a DER-encoded SubjectPublicKeyInfo and compute the log id
+func parseLogKey(der []byte) (*logKey, error) {
+
+    public_key, err := x509.ParsePKIXPublicKey(der)
+    if err != nil {
+        return nil, err
+    }
+
+    switch k := public_key.(type) {
+    case *ecdsa.PublicKey:
+        if k.Curve != elliptic.P256() {
+            return nil, errors.New("Unsupported public key: ECDSA keys must use P-256")
+        }
+    case *rsa.PublicKey:
+    default:
+        return nil, errors.New("Unsupported public key: must be ECDSA P-256 or RSA")
+    }
+
+    return &logKey{public_key: public_key, log_id: sha256.Sum256(der)}, nil
+
+}
+
+// decode a TLS DigitallySigned struct.  returns an error if it's truncated or has trailing data
+func parseDigitallySigned(data []byte) (digitallySigned, error) {
+
+    var ds digitallySigned
+
+    if len(data) < 4 {
+        return ds, errors.New("Invalid signature: too short")
+    }
+
+    ds.HashAlgorithm = data[0]
+    ds.SignatureAlgorithm = data[1]
+    length := int(binary.BigEndian.Uint16(data[2:4]))
+
+    if len(data) != 4+length {
+        return ds, errors.New("Invalid signature: length does not match")
+    }
+    ds.Signature = data[4:]
+
+    return ds, nil
+
+}
+
+// check a DigitallySigned signature over 'data' with the log's key
+func (k *logKey) verify(data []byte, ds digitallySigned) error {
+
+    if ds.HashAlgorithm != HASH_ALGORITHM_SHA256 {
+        return fmt.Errorf("Unsupported hash algorithm %d", ds.HashAlgorithm)
+    }
+    digest := sha256.Sum256(data)
+
+    switch public_key := k.public_key.(type) {
+    case *ecdsa.PublicKey:
+        if ds.SignatureAlgorithm != SIGNATURE_ALGORITHM_ECDSA {
+            return fmt.Errorf("Signature algorithm %d does not match ECDSA log key", ds.SignatureAlgorithm)
+        }
+        if !ecdsa.VerifyASN1(public_key, digest[:], ds.Signature) {
+            return errors.New("ECDSA signature verification failed")
+        }
+    case *rsa.PublicKey:
+        if ds.SignatureAlgorithm != SIGNATURE_ALGORITHM_RSA {
+            return fmt.Errorf("Signature algorithm %d does not match RSA log key", ds.SignatureAlgorithm)
+        }
+        err := rsa.VerifyPKCS1v15(public_key, crypto.SHA256, digest[:], ds.Signature)
+        if err != nil {
+            return fmt.Errorf("RSA signature verification failed: %v", err)
+        }
+    default:
+        return errors.New("Unsupported public key")
+    }
+
+    return nil
+
+}
+
+// serialize the TreeHeadSignature struct that the log signs (RFC 6962, section 3.5): version, signature type, timestamp, tree size and root hash
+func treeHeadSignatureInput(sth Signed_tree_head) ([]byte, error) {
+
+    root_hash, err := base64.StdEncoding.DecodeString(sth.Sha256_root_hash)
+    if err != nil {
+        return nil, err
+    }
+    if len(root_hash) != sha256.Size {
+        return nil, errors.New("Invalid root hash: must be 32 bytes")
+    }
+
+    data := make([]byte, 18, 18+sha256.Size)
+// version v1 is 0
+    data[0] = 0
+    data[1] = SIGNATURE_TYPE_TREE_HASH
+    binary.BigEndian.PutUint64(data[2:10], sth.Timestamp)
+    binary.BigEndian.PutUint64(data[10:18], sth.Tree_size)
+    data = append(data, root_hash...)
+
+    return data, nil
+
+}
+
+// verify the signature on a signed tree head
+func verifySTHSignature(sth Signed_tree_head, key *logKey) error {
+
+    signature, err := base64.StdEncoding.DecodeString(sth.Tree_head_signature)
+    if err != nil {
+        return err
+    }
+    ds, err := parseDigitallySigned(signature)
+    if err != nil {
+        return err
+    }
+
+    data, err := treeHeadSignatureInput(sth)
+    if err != nil {
+        return err
+    }
+
+    return key.verify(data, ds)
+
+}
@@ -27,28 +27,61 @@ func (list *list_flags) String() string {
 
 func main() {
 
-    ctl_host := flag.String("ctl", "", "certificate transparency log to monitor (required)")
+    var ctl_hosts list_flags
+    flag.Var(&ctl_hosts, "ctl", "certificate transparency log to monitor (at least one is required; more than one may be specified)")
+    var log_keys list_flags
+    flag.Var(&log_keys, "key", "public key of a certificate transparency log (PEM, base64 DER, or a file containing either), used to verify signed tree heads; the n-th --key belongs to the n-th --ctl")
+    log_list := flag.String("log-list", "", "CT log list file (v3 schema); a monitor is started for every log in the list in one of the states given by --log-states")
+    log_states := flag.String("log-states", strings.Join(ctl_monitor_lib.LOG_LIST_STATES, ","), "comma-separated log states to monitor from the log list")
+    database_name := flag.String("database", "", "sqlite3 database to store certificates in; defaults to one named after the log if there's only one, and ctl_monitor.db otherwise")
     var hostnames list_flags
-    flag.Var(&hostnames, "hostname", "hostname to monitor (more than one may be specified)")
+    flag.Var(&hostnames, "hostname", "hostname or watch rule (exact:, suffix:, glob: or regex:) to monitor (more than one may be specified)")
     verbose := flag.Bool("verbose", false, "verbose output to log; defaults to false")
     no_auto := flag.Bool("no-auto", false, "don't start actively monitoring; defaults to false")
     build := flag.Bool("build", false, "automatically build a database on start-up; defaults to false")
     no_delete := flag.Bool("no-delete", false, "do not clear any existing database on start-up; defaults to false")
-    non_strict := flag.Bool("non-strict", false, "add certificates to the database if they contain a hostname as a substring; defaults to false")
+    non_strict := flag.Bool("non-strict", false, "also add certificates for subdomains of each hostname; defaults to false")
     port := flag.Int("port", 8000, "port to listen on; defaults to 8000")
+    fetch_concurrency := flag.Int("fetch-concurrency", ctl_monitor_lib.FETCH_CONCURRENCY, "number of get-entries requests to keep in flight for each log (at most " + strconv.Itoa(ctl_monitor_lib.MAX_FETCH_CONCURRENCY) + "); defaults to " + strconv.Itoa(ctl_monitor_lib.FETCH_CONCURRENCY))
+    lookalikes := flag.Bool("lookalikes", false, "also store certificates for names that look like a watched domain (typos, homoglyphs, other TLDs) in the 'lookalikes' table; defaults to false")
+    psl_file := flag.String("psl", "", "Public Suffix List file, used to find the registrable domain of each name; defaults to the list built into golang.org/x/net/publicsuffix")
+    psl_reload := flag.Duration("psl-reload", ctl_monitor_lib.PSL_RELOAD, "how often to read the --psl file again; defaults to 24h")
+    var gossip_peers list_flags
+    flag.Var(&gossip_peers, "gossip-peer", "URL of another instance of ctl_monitor to exchange signed tree heads with, to detect logs showing different trees to different monitors (more than one may be specified)")
+    gossip_interval := flag.Duration("gossip-interval", ctl_monitor_lib.GOSSIP_INTERVAL, "how often to ask the --gossip-peer instances for new signed tree heads; defaults to 5m")
+    sct_audit := flag.Duration("sct-audit", ctl_monitor_lib.SCT_AUDIT_INTERVAL, "how often to check that the logs that issued SCTs in the certificates found have included them within their maximum merge delay (like 1h); defaults to 0, which doesn't")
     flag.Parse()
 
-    if *ctl_host == "" {
-        log.Fatalln("command-line options: \n [--hostname HOSTNAME] \n \t hostname to monitor (more than one may be specified) \n [--verbose] \n \t verbose output to log; defaults to false \n [--port PORT] \n \t port to listen on; defaults to 8000 \n [--build] \n \t automatically build a database on start-up; defaults to false \n --ctl CTL \n \t certificate transparency log to monitor (required)")
+    if len(ctl_hosts) == 0 && *log_list == "" {
+        log.Fatalln("command-line options: \n [--hostname HOSTNAME] \n \t hostname to monitor (more than one may be specified) \n [--verbose] \n \t verbose output to log; defaults to false \n [--port PORT] \n \t port to listen on; defaults to 8000 \n [--build] \n \t automatically build a database on start-up; defaults to false \n [--fetch-concurrency N] \n \t number of get-entries requests to keep in flight for each log; defaults to 4 \n [--lookalikes] \n \t also store certificates for names that look like a watched domain; defaults to false \n [--psl FILE] \n \t Public Suffix List file; defaults to the built-in list \n [--psl-reload DURATION] \n \t how often to read the --psl file again; defaults to 24h \n [--sct-audit DURATION] \n \t how often to audit the SCTs in the certificates found; defaults to never \n [--gossip-peer URL] \n \t another instance of ctl_monitor to exchange signed tree heads with (more than one may be specified) \n [--gossip-interval DURATION] \n \t how often to ask the gossip peers for new signed tree heads; defaults to 5m \n [--key KEY] \n \t public key of the certificate transparency log, used to verify signed tree heads (one per --ctl, in the same order) \n [--database DATABASE] \n \t sqlite3 database to store certificates in \n [--log-list FILE] \n \t CT log list file (v3 schema) to read logs from \n [--log-states STATES] \n \t comma-separated log states to monitor from the log list; defaults to usable,qualified,readonly \n --ctl CTL \n \t certificate transparency log to monitor (at least one --ctl or a --log-list is required; more than one --ctl may be specified)")
     }
 
 
-// initialize new controller
-    if (*ctl_host)[len(*ctl_host)-1] != "/"[0] {
-        *ctl_host = *ctl_host + "/"
+    ctl_monitor_lib.FETCH_CONCURRENCY = *fetch_concurrency
+    ctl_monitor_lib.DETECT_LOOKALIKES = *lookalikes
+    ctl_monitor_lib.SCT_AUDIT_INTERVAL = *sct_audit
+    ctl_monitor_lib.GOSSIP_PEERS = gossip_peers
+    ctl_monitor_lib.GOSSIP_INTERVAL = *gossip_interval
+
+// registrable rules are checked against the public suffix list, so it has to be loaded before the hostnames are
+    ctl_monitor_lib.PSL_FILE = *psl_file
+    ctl_monitor_lib.PSL_RELOAD = *psl_reload
+    err := ctl_monitor_lib.LoadPublicSuffixList()
+    if err != nil {
+        log.Fatalln(err)
     }
 
-    controller, err := ctl_monitor_lib.NewController(*ctl_host, hostnames, *verbose, *no_auto, *build, *no_delete, *non_strict)
+// all the logs share one database
+    if *database_name == "" {
+        if len(ctl_hosts) == 1 && *log_list == "" {
+            *database_name = ctl_monitor_lib.MakeDBName(ctl_hosts[0])
+        } else {
+            *database_name = "./ctl_monitor.db"
+        }
+    }
+
+// initialize new controller
+    controller, err := ctl_monitor_lib.NewController(ctl_hosts, log_keys, *log_list, strings.Split(*log_states, ","), *database_name, hostnames, *verbose, *no_auto, *build, *no_delete, *non_strict)
     if err != nil {
         log.Fatalln(err)
     }
@@ -61,10 +94,25 @@ func main() {
     r.HandleFunc("/Remove", controller.RemoveHostname).Queries("hostname", "{hostname}")
     r.HandleFunc("/ListHostnames", controller.ListHostnames)
     r.HandleFunc("/ListCertificates", controller.ListCertificates).Queries("hostname", "{hostname}")
+    r.HandleFunc("/ListRegistrableDomains", controller.ListRegistrableDomains).Queries("hostname", "{hostname}")
+    r.HandleFunc("/ListIssuers", controller.ListIssuers).Queries("hostname", "{hostname}")
+    r.HandleFunc("/ListPrecertificates", controller.ListPrecertificates).Queries("hostname", "{hostname}")
+    r.HandleFunc("/ListSCTs", controller.ListSCTs).Queries("hostname", "{hostname}")
+    r.HandleFunc("/SubmitSCT", controller.SubmitSCT).Queries("ctl", "{ctl}", "leaf_hash", "{leaf_hash}", "timestamp", "{timestamp}")
+    r.HandleFunc("/AuditSCTs", controller.AuditSCTs)
+    r.HandleFunc("/GetSTHs", controller.GetSTHs)
+    r.HandleFunc("/ListSTHHistory", controller.ListSTHHistory).Queries("ctl", "{ctl}")
+    r.HandleFunc("/Gossip", controller.Gossip)
     r.HandleFunc("/Start", controller.Start)
     r.HandleFunc("/Stop", controller.Stop)
     r.HandleFunc("/Build", controller.BuildDatabase)
     r.HandleFunc("/Check", controller.Check)
+    r.HandleFunc("/Prove", controller.ProveInclusions)
+    r.HandleFunc("/AddLog", controller.AddLog).Queries("ctl", "{ctl}")
+    r.HandleFunc("/RemoveLog", controller.RemoveLog).Queries("ctl", "{ctl}")
+    r.HandleFunc("/ListLogs", controller.ListLogs)
+    r.HandleFunc("/ReloadLogList", controller.ReloadLogList)
+    r.HandleFunc("/ReloadPublicSuffixList", controller.ReloadPublicSuffixList)
     r.HandleFunc("/Delete", controller.DeleteHostname).Queries("hostname", "{hostname}")
 
     r.Handle("/metrics", promhttp.Handler())